@@ -1,35 +1,67 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
 	"context"
+	"crypto/subtle"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"log/slog"
+	"maps"
+	"math"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Build info, set at build time with
+// -ldflags "-X main.Version=... -X main.GitCommit=... -X main.BuildTime=...".
+var (
+	Version   = "dev"
+	GitCommit = "unknown"
+	BuildTime = "unknown"
 )
 
 var (
 	// Business metrics
 	gamesTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{Name: "tictactoe_games_total", Help: "Total games played"},
-		[]string{"result", "mode"},
+		[]string{"result", "mode", "difficulty"},
 	)
 	winsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{Name: "tictactoe_wins_total", Help: "Wins by player and pattern"},
-		[]string{"player", "pattern", "mode"},
+		[]string{"player", "pattern", "mode", "difficulty"},
 	)
 	playerGamesTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{Name: "tictactoe_player_games_total", Help: "Games per player"},
@@ -37,7 +69,7 @@ var (
 	)
 	tiesTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{Name: "tictactoe_ties_total", Help: "Total tied games"},
-		[]string{"mode"},
+		[]string{"mode", "difficulty"},
 	)
 	winStreakGauge = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{Name: "tictactoe_current_win_streak", Help: "Current win streak"},
@@ -47,6 +79,31 @@ var (
 		prometheus.CounterOpts{Name: "tictactoe_dynamodb_operations_total", Help: "DynamoDB operations"},
 		[]string{"operation", "status"},
 	)
+	dynamoDBRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "tictactoe_dynamodb_retries_total", Help: "DynamoDB writes retried after a failed attempt"},
+		[]string{"operation"},
+	)
+	dynamoDBOpDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "tictactoe_dynamodb_op_duration_seconds",
+			Help:    "Duration of individual DynamoDB calls",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		},
+		[]string{"operation"},
+	)
+	writeQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "tictactoe_dynamodb_write_queue_depth", Help: "DynamoDB writes waiting for a save worker"},
+	)
+	dynamoWritesDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "tictactoe_dynamodb_writes_dropped_total", Help: "DynamoDB writes dropped because the write queue stayed full"},
+	)
+	dynamoDBScanItems = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "tictactoe_dynamodb_scan_items",
+			Help:    "Items returned per DynamoDB Scan call",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		},
+	)
 	onlineGamesActive = prometheus.NewGauge(
 		prometheus.GaugeOpts{Name: "tictactoe_online_games_active", Help: "Active online games"},
 	)
@@ -60,6 +117,82 @@ var (
 		prometheus.CounterOpts{Name: "tictactoe_websocket_messages_total", Help: "WebSocket messages"},
 		[]string{"type", "direction"},
 	)
+	onlineSpectatorsActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "tictactoe_online_spectators_active", Help: "Active spectator WebSocket connections"},
+	)
+	archivedGamesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "tictactoe_games_archived_total", Help: "Games archived to S3"},
+	)
+	onlineGamesAbandoned = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "tictactoe_online_games_abandoned_total", Help: "Online games removed while still waiting for a second player"},
+	)
+	invalidMoveSequences = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "tictactoe_invalid_move_sequences_total", Help: "Online games saved with a move log that does not replay legally"},
+	)
+	movesTruncated = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "tictactoe_moves_truncated_total", Help: "Online games saved with more moves than board cells, truncated to the cell count"},
+	)
+	wsSlowClientsClosed = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "tictactoe_websocket_slow_clients_closed_total", Help: "Game WebSocket connections closed because their send buffer was full"},
+	)
+	onlineGamesExpired = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "tictactoe_online_games_expired_total", Help: "Waiting online games expired without an opponent"},
+	)
+	cacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "tictactoe_cache_hits_total", Help: "Leaderboard/stats responses served from cache"},
+	)
+	cacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "tictactoe_cache_misses_total", Help: "Leaderboard/stats responses built from a table scan"},
+	)
+	movesRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "tictactoe_moves_rejected_total", Help: "Well-formed moves rejected by the server"},
+		[]string{"reason"},
+	)
+	gameDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "tictactoe_game_duration_seconds",
+			Help:    "Time from start to finish of completed games",
+			Buckets: []float64{5, 10, 20, 30, 60, 120, 300, 600},
+		},
+		[]string{"mode"},
+	)
+	aiMoveDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "tictactoe_ai_move_duration_seconds",
+			Help:    "Time the AI took to choose a move",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+		},
+		[]string{"difficulty"},
+	)
+	aiMovesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "tictactoe_ai_moves_total", Help: "Moves chosen by the AI"},
+		[]string{"difficulty"},
+	)
+	movesPerGame = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "tictactoe_moves_per_game",
+			Help:    "Moves played in completed games",
+			Buckets: []float64{5, 6, 7, 8, 9, 12, 16, 20, 25},
+		},
+		[]string{"mode"},
+	)
+	joinAttempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "tictactoe_join_attempts_total", Help: "Online game join attempts by result"},
+		[]string{"result"},
+	)
+	gamesRejectedCapacity = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "tictactoe_games_rejected_capacity_total", Help: "Online game creations rejected because MAX_ACTIVE_GAMES was reached"},
+	)
+	lobbyWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "tictactoe_lobby_wait_seconds",
+			Help:    "Time from creating an online game to the second player joining",
+			Buckets: []float64{1, 5, 10, 30, 60, 120, 300, 600},
+		},
+	)
+	leaderboardSubscribers = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "tictactoe_leaderboard_subscribers", Help: "Active live leaderboard WebSocket connections"},
+	)
 
 	// Ops metrics
 	httpRequestsTotal = prometheus.NewCounterVec(
@@ -70,15 +203,44 @@ var (
 		prometheus.HistogramOpts{
 			Name:    "http_request_duration_seconds",
 			Help:    "HTTP request duration",
-			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1},
+			Buckets: parseBuckets(os.Getenv("HTTP_DURATION_BUCKETS"), defaultDurationBuckets),
 		},
 		[]string{"method", "endpoint"},
 	)
+	httpResponsesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "tictactoe_http_responses_total", Help: "HTTP responses by status class (2xx, 4xx, ...)"},
+		[]string{"class"},
+	)
 	httpRequestsInFlight = prometheus.NewGauge(
 		prometheus.GaugeOpts{Name: "http_requests_in_flight", Help: "Current in-flight requests"},
 	)
+	rateLimitedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "tictactoe_rate_limited_total", Help: "Requests rejected by the per-IP rate limiter"},
+		[]string{"endpoint"},
+	)
 )
 
+// defaultDurationBuckets reach 10s so slow table scans still get a bucket.
+var defaultDurationBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// parseBuckets reads comma-separated histogram bounds in seconds, falling back
+// to def when v is empty or not a strictly increasing list of numbers.
+func parseBuckets(v string, def []float64) []float64 {
+	if v == "" {
+		return def
+	}
+	var buckets []float64
+	for _, field := range strings.Split(v, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || (len(buckets) > 0 && b <= buckets[len(buckets)-1]) {
+			log.Printf("Ignoring invalid HTTP_DURATION_BUCKETS %q", v)
+			return def
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
 // Game structures
 type GameResult struct {
 	Player1 string `json:"player1"`
@@ -86,7 +248,13 @@ type GameResult struct {
 	Winner  string `json:"winner"`
 	Pattern string `json:"pattern"`
 	IsTie   bool   `json:"isTie"`
-	Mode    string `json:"mode"` // "local" or "online"
+	Mode    string `json:"mode"` // "local", "online" or "ai"
+	// Difficulty is the AI level for "ai" games: easy, medium or hard
+	Difficulty string `json:"difficulty,omitempty"`
+	// Moves optionally records the 3x3 move sequence so the game can be replayed
+	Moves []Move `json:"moves,omitempty"`
+	// Synthetic marks games recorded by the synthetic monitor
+	Synthetic bool `json:"synthetic,omitempty"`
 }
 
 type Move struct {
@@ -96,20 +264,90 @@ type Move struct {
 }
 
 type OnlineGame struct {
-	ID          string            `json:"id"`
-	Board       [9]string         `json:"board"`
-	Turn        string            `json:"turn"`
-	FirstPlayer string            `json:"firstPlayer"`
-	Player1     string            `json:"player1"`
-	Player2     string            `json:"player2"`
-	Status      string            `json:"status"` // waiting, playing, finished
-	Winner      string            `json:"winner,omitempty"`
-	Pattern     string            `json:"pattern,omitempty"`
-	CreatedAt   time.Time         `json:"createdAt"`
-	StartedAt   time.Time         `json:"startedAt"`
-	Moves       []Move            `json:"moves"`
-	Conns       []*websocket.Conn `json:"-"`
-	mu          sync.Mutex        `json:"-"`
+	ID          string               `json:"id"`
+	Size        int                  `json:"size"`
+	Board       []string             `json:"board"`
+	Turn        string               `json:"turn"`
+	FirstPlayer string               `json:"firstPlayer"`
+	Player1     string               `json:"player1"`
+	Player2     string               `json:"player2"`
+	Status      string               `json:"status"` // waiting, playing, finished
+	Winner      string               `json:"winner,omitempty"`
+	Pattern     string               `json:"pattern,omitempty"`
+	CreatedAt   time.Time            `json:"createdAt"`
+	StartedAt   time.Time            `json:"startedAt"`
+	Moves       []Move               `json:"moves"`
+	RematchID   string               `json:"rematchId,omitempty"`
+	Code        string               `json:"code,omitempty"` // room code for joining while waiting
+	Version     int                  `json:"version"`        // bumped on every state change
+	Series      *Series              `json:"series,omitempty"`
+	Conns       []*wsClient          `json:"-"`
+	Spectators  []*wsClient          `json:"-"`
+	turnTimer   *time.Timer          `json:"-"`
+	turnSeq     int                  `json:"-"`
+	takeback    string               `json:"-"` // player with a pending takeback request
+	savedAt     string               `json:"-"` // timestamp key of the live item, once one exists
+	playerConns map[string]*wsClient `json:"-"` // latest connection per player
+	seen        map[string]bool      `json:"-"` // players who have connected before
+	deltaConns  map[*wsClient]bool   `json:"-"` // connections subscribed to move_delta
+	persistQ    []func()             `json:"-"`
+	persisting  bool                 `json:"-"`
+	changed     chan struct{}        `json:"-"` // closed on the next version bump, for long polls
+	mu          sync.Mutex           `json:"-"`
+
+	// passwordHash is the bcrypt hash of a private game's password. WebSocket
+	// connections to such a game need a one-time token from wsTokens (token ->
+	// player), issued on create and join and replaced on each connect.
+	passwordHash []byte
+	wsTokens     map[string]string
+
+	// seatKeys holds each player's secret (player -> key), handed only to
+	// that player on create or join. Leaving, resigning over a WebSocket and
+	// other seat actions must present it.
+	seatKeys map[string]string
+
+	// demo is the AI difficulty of a game the server plays against itself;
+	// such games only accept spectators and are saved with mode "ai".
+	// demoRand, seeded from the seed returned at create, drives every
+	// random choice the AI makes so a demo can be replayed exactly.
+	demo     string
+	demoRand *rand.Rand
+
+	// synthetic marks games created by the synthetic monitor; it carries over
+	// to rematches and series games and is saved so read endpoints skip them
+	synthetic bool
+}
+
+// Series is the score of a best-of-N match as of one of its games. Each game
+// keeps its own copy, updated when the game finishes, so games never share
+// mutable state.
+type Series struct {
+	ID          string `json:"id"`
+	BestOf      int    `json:"bestOf"`
+	Game        int    `json:"game"` // 1-based number of this game in the series
+	Player1Wins int    `json:"player1Wins"`
+	Player2Wins int    `json:"player2Wins"`
+	Ties        int    `json:"ties"`
+	Winner      string `json:"winner,omitempty"` // set once a player has won the majority
+}
+
+// record returns the score after a game between player1 and player2 won by
+// winner, or tied when winner is empty.
+func (s Series) record(winner, player1, player2 string) Series {
+	switch winner {
+	case "":
+		s.Ties++
+	case player1:
+		s.Player1Wins++
+	case player2:
+		s.Player2Wins++
+	}
+	if s.Player1Wins > s.BestOf/2 {
+		s.Winner = player1
+	} else if s.Player2Wins > s.BestOf/2 {
+		s.Winner = player2
+	}
+	return s
 }
 
 type WSMessage struct {
@@ -119,23 +357,506 @@ type WSMessage struct {
 
 var (
 	winStreaks   = make(map[string]int)
-	dynamoClient *dynamodb.Client
-	tableName    string
+	winStreaksMu sync.Mutex
+	store        GameStore
 	games        = make(map[string]*OnlineGame)
+	roomCodes    = make(map[string]string) // room code -> game ID, guarded by gamesMu
 	gamesMu      sync.RWMutex
 	upgrader     = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true },
+		CheckOrigin: checkWSOrigin,
 	}
+
+	writeAttempts = 3
+	writeBackoff  = 100 * time.Millisecond
+	// dynamoTimeout bounds each DynamoDB call so a hung request can't pin a goroutine
+	dynamoTimeout = 5 * time.Second
+
+	s3Client      *s3.Client
+	archiveBucket string
+	archivePrefix string
+	archiveAfter  = 90 * 24 * time.Hour
+	archiveDelete bool
+
+	// gameRetention sets the ttl attribute on saved games so DynamoDB's TTL
+	// feature expires them; 0 keeps games forever.
+	gameRetention = 90 * 24 * time.Hour
+
+	// persistMovesLive writes each move to DynamoDB as it is played instead of
+	// only saving the game when it ends, so crashed games can be reconstructed.
+	persistMovesLive = os.Getenv("PERSIST_MOVES_LIVE") == "true"
+
+	submitInterval  time.Duration
+	lastSubmit      = make(map[string]time.Time)
+	lastSubmitSweep time.Time
+	lastSubmitMu    sync.Mutex
+
+	// idempotencyKeys remembers recent Idempotency-Key headers on POST
+	// /api/game, newest first, so client retries aren't recorded twice
+	idempotencyKeys  = list.New()
+	idempotencyIndex = make(map[string]*list.Element)
+	idempotencyMu    sync.Mutex
+	idempotencyTTL   = 10 * time.Minute
+	idempotencyMax   = 10000
+
+	chatEnabled     = os.Getenv("CHAT_ENABLED") == "true"
+	chatMaxLength   = 200
+	chatMinInterval = time.Second
+
+	turnTimeout = 60 * time.Second
+
+	waitingGameTTL = 10 * time.Minute
+
+	// firstPlayerRand decides who moves first; tests swap in a fixed seed.
+	// *rand.Rand isn't safe for concurrent use, hence firstPlayerMu.
+	firstPlayerRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	firstPlayerMu   sync.Mutex
+
+	// demoMoveInterval is the default pause between moves in AI-vs-AI demos
+	demoMoveInterval = time.Second
+	// maxActiveGames caps unfinished online games; 0 means no limit
+	maxActiveGames int
+
+	// The load balancer drops idle connections after 60s, so ping well within that
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = 30 * time.Second
+	// wsMaxMessageBytes caps incoming WebSocket frames; larger ones close the connection
+	wsMaxMessageBytes int64 = 4096
+	// wsSendBuffer is how many outgoing game messages a connection may have
+	// queued; a client that falls further behind is disconnected
+	wsSendBuffer = 32
+	wsWriteWait  = 10 * time.Second
+	// maxLongPoll caps how long /api/game/get?waitForVersion= may block
+	maxLongPoll = 30 * time.Second
+	// shuttingDown is closed when shutdown starts so long polls return at once
+	// instead of holding up the HTTP server's drain
+	shuttingDown = make(chan struct{})
+	// wsDrain tracks open game WebSockets so shutdown can wait for them
+	wsDrain sync.WaitGroup
+	// pendingSaves tracks background DynamoDB writes so shutdown can flush them
+	pendingSaves sync.WaitGroup
+	// saveQueue feeds DynamoDB writes to saveWorkers goroutines so a burst of
+	// finished games can't open unbounded concurrent writes
+	saveQueue        chan func()
+	saveWorkers      = 4
+	saveQueueSize    = 100
+	saveQueueTimeout = time.Second
+	saveWorkersOnce  sync.Once
+
+	leaderboardSubs    = make(map[*leaderboardSubscriber]struct{})
+	leaderboardSubsMu  sync.Mutex
+	leaderboardUpdates = make(chan struct{}, 1)
+
+	readyCacheTTL  = 5 * time.Second
+	readyCheckedAt time.Time
+	readyErr       error
+	readyMu        sync.Mutex
+
+	// dynamoReady is cleared when the startup table check fails, so read
+	// endpoints answer 503 with dynamoNotReady instead of calling DynamoDB
+	dynamoReady    = true
+	dynamoNotReady string
+	dynamoMu       sync.RWMutex
+
+	// warmup is the state of the startup win streak seed: "warming" while it
+	// runs, then "done", or "timed_out"/"failed" when it gave up and streaks
+	// start from the games played since. /readyz answers 503 while warming.
+	warmup   = "done"
+	warmupMu sync.Mutex
+
+	// startedAt is when the process started, for uptime in /api/health/detail
+	startedAt = time.Now()
+
+	// adminToken gates admin endpoints via X-Admin-Token; empty disables them
+	adminToken = os.Getenv("ADMIN_TOKEN")
+
+	// allowedOrigins restricts CORS to these origins; empty allows any
+	allowedOrigins map[string]bool
+	// wsAllowAllOrigins skips the WebSocket Origin check, for local development
+	wsAllowAllOrigins bool
+
+	rateLimitRPS   = 2.0
+	rateLimitBurst = 20
+
+	cacheTTL        = 30 * time.Second
+	responseCache   = make(map[string]cacheEntry)
+	responseCacheMu sync.RWMutex
+	cacheInflight   = make(map[string]*cacheCall)
+	// analysisCacheTTL is longer than cacheTTL because analysis endpoints
+	// scan every game and their answers barely move between games
+	analysisCacheTTL = 10 * time.Minute
+
+	// winStreakLookback bounds the startup scan that rebuilds win streaks to
+	// recent games (0 scans every game); winStreakLoadTimeout caps how long
+	// that scan may hold up startup
+	winStreakLookback    = 30 * 24 * time.Hour
+	winStreakLoadTimeout = 30 * time.Second
 )
 
 func init() {
-	prometheus.MustRegister(gamesTotal, winsTotal, playerGamesTotal, tiesTotal, winStreakGauge, dynamoDBOps)
-	prometheus.MustRegister(onlineGamesActive, onlineGamesCreated, wsConnectionsActive, wsMessagesTotal)
-	prometheus.MustRegister(httpRequestsTotal, httpRequestDuration, httpRequestsInFlight)
+	prometheus.MustRegister(gamesTotal, winsTotal, playerGamesTotal, tiesTotal, winStreakGauge, dynamoDBOps, dynamoDBRetries, dynamoDBOpDuration, dynamoDBScanItems, writeQueueDepth, dynamoWritesDropped, aiMoveDuration, aiMovesTotal)
+	prometheus.MustRegister(onlineGamesActive, onlineGamesCreated, wsConnectionsActive, wsMessagesTotal, onlineSpectatorsActive, archivedGamesTotal, onlineGamesExpired, cacheHits, cacheMisses, leaderboardSubscribers, gameDuration, movesPerGame, movesRejected, gamesRejectedCapacity, joinAttempts, onlineGamesAbandoned, lobbyWait, invalidMoveSequences, movesTruncated, wsSlowClientsClosed)
+	prometheus.MustRegister(httpRequestsTotal, httpRequestDuration, httpRequestsInFlight, rateLimitedTotal, httpResponsesTotal)
+}
+
+// GameStore persists games. Items keep the DynamoDB attribute layout so the
+// getXAttr helpers read them the same way whatever the backing store.
+type GameStore interface {
+	// SaveGame writes a whole game, replacing any game with the same key.
+	SaveGame(ctx context.Context, item map[string]types.AttributeValue) error
+	// QueryGame returns the game with the given ID, or nil if there is none.
+	QueryGame(ctx context.Context, gameID string) (map[string]types.AttributeValue, error)
+	// ScanGames calls fn with each page of games matching filter, stopping at the first error.
+	ScanGames(ctx context.Context, filter GameFilter, fn func([]map[string]types.AttributeValue) error) error
+	// RecentGames returns up to limit games matching filter, newest first.
+	RecentGames(ctx context.Context, filter GameFilter, limit int) ([]map[string]types.AttributeValue, error)
+	// UpdateGame sets attributes on a game, creating it if needed.
+	UpdateGame(ctx context.Context, gameID, timestamp string, set map[string]types.AttributeValue) error
+	// AppendMoves appends to a game's moves and sets attributes, creating it if needed.
+	AppendMoves(ctx context.Context, gameID, timestamp string, moves []Move, set map[string]types.AttributeValue) error
+	DeleteGame(ctx context.Context, gameID, timestamp string) error
+	// Ping checks that the store is reachable.
+	Ping(ctx context.Context) error
+}
+
+// GameFilter narrows a scan; zero fields match every game.
+type GameFilter struct {
+	Mode          string // only games of this mode
+	Player        string // only games with this player1 or player2
+	PlayerPrefix  string // only games with a player1 or player2 starting with this
+	Winner        string // only games won by this player
+	Pattern       string // only games won with this line
+	Before        string // only games with an earlier RFC3339 timestamp
+	Since         string // only games with this RFC3339 timestamp or a later one
+	SkipSynthetic bool   // drop games recorded by the synthetic monitor
+}
+
+// expression renders the filter as a DynamoDB filter expression, empty when
+// it matches everything. names is nil when no attribute names are needed.
+func (f GameFilter) expression() (expr string, names map[string]string, values map[string]types.AttributeValue) {
+	var conds []string
+	values = make(map[string]types.AttributeValue)
+	if f.Mode != "" {
+		conds = append(conds, "#m = :mode")
+		names = map[string]string{"#m": "mode"}
+		values[":mode"] = &types.AttributeValueMemberS{Value: f.Mode}
+	}
+	if f.Player != "" {
+		conds = append(conds, "(player1 = :p OR player2 = :p)")
+		values[":p"] = &types.AttributeValueMemberS{Value: f.Player}
+	}
+	if f.PlayerPrefix != "" {
+		conds = append(conds, "(begins_with(player1, :prefix) OR begins_with(player2, :prefix))")
+		values[":prefix"] = &types.AttributeValueMemberS{Value: f.PlayerPrefix}
+	}
+	if f.Winner != "" {
+		conds = append(conds, "winner = :w")
+		values[":w"] = &types.AttributeValueMemberS{Value: f.Winner}
+	}
+	if f.Pattern != "" {
+		conds = append(conds, "#pat = :pat")
+		if names == nil {
+			names = make(map[string]string)
+		}
+		names["#pat"] = "pattern"
+		values[":pat"] = &types.AttributeValueMemberS{Value: f.Pattern}
+	}
+	if f.Before != "" {
+		conds = append(conds, "#ts < :before")
+		if names == nil {
+			names = make(map[string]string)
+		}
+		names["#ts"] = "timestamp"
+		values[":before"] = &types.AttributeValueMemberS{Value: f.Before}
+	}
+	if f.Since != "" {
+		conds = append(conds, "#ts >= :since")
+		if names == nil {
+			names = make(map[string]string)
+		}
+		names["#ts"] = "timestamp"
+		values[":since"] = &types.AttributeValueMemberS{Value: f.Since}
+	}
+	if f.SkipSynthetic {
+		conds = append(conds, "(attribute_not_exists(#syn) OR #syn = :false)")
+		if names == nil {
+			names = make(map[string]string)
+		}
+		names["#syn"] = "synthetic"
+		values[":false"] = &types.AttributeValueMemberBOOL{Value: false}
+	}
+	return strings.Join(conds, " AND "), names, values
+}
+
+// dynamoDBAPI is the subset of the DynamoDB client the store uses.
+type dynamoDBAPI interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error)
+}
+
+// dynamoStore is the GameStore backed by a DynamoDB table.
+type dynamoStore struct {
+	client dynamoDBAPI
+	table  string
+	// modeIndex is an optional GSI with mode (S) as HASH key and timestamp (S)
+	// as RANGE key, projecting ALL attributes. When unset, recent games fall
+	// back to a table scan.
+	modeIndex string
+}
+
+// dynamoContext derives the context for a single DynamoDB call.
+func dynamoContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, dynamoTimeout)
+}
+
+// observeOp records how long one DynamoDB call that began at start took.
+func observeOp(operation string, start time.Time) {
+	dynamoDBOpDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// countOp records the outcome of a DynamoDB call.
+func countOp(operation string, err error) {
+	status := "success"
+	if err != nil {
+		status = "error"
+	}
+	dynamoDBOps.WithLabelValues(operation, status).Inc()
+}
+
+func (s *dynamoStore) SaveGame(ctx context.Context, item map[string]types.AttributeValue) error {
+	err := withRetry(ctx, "PutItem", func() error {
+		callCtx, cancel := dynamoContext(ctx)
+		defer cancel()
+		start := time.Now()
+		_, err := s.client.PutItem(callCtx, &dynamodb.PutItemInput{
+			TableName: aws.String(s.table),
+			Item:      item,
+		})
+		observeOp("PutItem", start)
+		return err
+	})
+	countOp("PutItem", err)
+	return err
+}
+
+func (s *dynamoStore) QueryGame(ctx context.Context, gameID string) (map[string]types.AttributeValue, error) {
+	callCtx, cancel := dynamoContext(ctx)
+	defer cancel()
+	start := time.Now()
+	result, err := s.client.Query(callCtx, &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		KeyConditionExpression: aws.String("gameId = :gid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":gid": &types.AttributeValueMemberS{Value: gameID},
+		},
+		Limit: aws.Int32(1),
+	})
+	observeOp("Query", start)
+	countOp("Query", err)
+	if err != nil || len(result.Items) == 0 {
+		return nil, err
+	}
+	return result.Items[0], nil
+}
+
+func (s *dynamoStore) ScanGames(ctx context.Context, filter GameFilter, fn func([]map[string]types.AttributeValue) error) error {
+	expr, names, values := filter.expression()
+	var lastKey map[string]types.AttributeValue
+	for {
+		input := &dynamodb.ScanInput{
+			TableName:         aws.String(s.table),
+			ExclusiveStartKey: lastKey,
+		}
+		if expr != "" {
+			input.FilterExpression = aws.String(expr)
+			input.ExpressionAttributeNames = names
+			input.ExpressionAttributeValues = values
+		}
+		callCtx, cancel := dynamoContext(ctx)
+		start := time.Now()
+		result, err := s.client.Scan(callCtx, input)
+		observeOp("Scan", start)
+		cancel()
+		countOp("Scan", err)
+		if err != nil {
+			return err
+		}
+		dynamoDBScanItems.Observe(float64(len(result.Items)))
+		if err := fn(result.Items); err != nil {
+			return err
+		}
+		lastKey = result.LastEvaluatedKey
+		if lastKey == nil {
+			return nil
+		}
+	}
+}
+
+// RecentGames pages through the mode GSI when one is configured. Otherwise it
+// scans a single page of 100 items and returns the newest matches among them.
+func (s *dynamoStore) RecentGames(ctx context.Context, filter GameFilter, limit int) ([]map[string]types.AttributeValue, error) {
+	if s.modeIndex == "" || filter.Mode == "" {
+		return s.scanRecentGames(ctx, filter, limit)
+	}
+	// mode is the index key, so it belongs in the key condition
+	rest := filter
+	rest.Mode = ""
+	expr, names, values := rest.expression()
+	if names == nil {
+		names = make(map[string]string)
+	}
+	names["#m"] = "mode"
+	values[":mode"] = &types.AttributeValueMemberS{Value: filter.Mode}
+
+	items := make([]map[string]types.AttributeValue, 0, limit)
+	var lastKey map[string]types.AttributeValue
+	for {
+		input := &dynamodb.QueryInput{
+			TableName:                 aws.String(s.table),
+			IndexName:                 aws.String(s.modeIndex),
+			KeyConditionExpression:    aws.String("#m = :mode"),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+			ScanIndexForward:          aws.Bool(false),
+			Limit:                     aws.Int32(int32(limit)),
+			ExclusiveStartKey:         lastKey,
+		}
+		if expr != "" {
+			input.FilterExpression = aws.String(expr)
+		}
+		callCtx, cancel := dynamoContext(ctx)
+		start := time.Now()
+		result, err := s.client.Query(callCtx, input)
+		observeOp("Query", start)
+		cancel()
+		countOp("Query", err)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range result.Items {
+			items = append(items, item)
+			if len(items) == limit {
+				return items, nil
+			}
+		}
+		lastKey = result.LastEvaluatedKey
+		if lastKey == nil {
+			return items, nil
+		}
+	}
+}
+
+func (s *dynamoStore) scanRecentGames(ctx context.Context, filter GameFilter, limit int) ([]map[string]types.AttributeValue, error) {
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(s.table),
+		Limit:     aws.Int32(100),
+	}
+	if expr, names, values := filter.expression(); expr != "" {
+		input.FilterExpression = aws.String(expr)
+		input.ExpressionAttributeNames = names
+		input.ExpressionAttributeValues = values
+	}
+	callCtx, cancel := dynamoContext(ctx)
+	defer cancel()
+	start := time.Now()
+	result, err := s.client.Scan(callCtx, input)
+	observeOp("Scan", start)
+	countOp("Scan", err)
+	if err != nil {
+		return nil, err
+	}
+	dynamoDBScanItems.Observe(float64(len(result.Items)))
+	items := result.Items
+	sortItemsByTime(items)
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	return items, nil
+}
+
+func (s *dynamoStore) UpdateGame(ctx context.Context, gameID, timestamp string, set map[string]types.AttributeValue) error {
+	sets, names, values := setExpression(set)
+	return s.update(ctx, gameID, timestamp, "SET "+strings.Join(sets, ", "), names, values)
+}
+
+func (s *dynamoStore) AppendMoves(ctx context.Context, gameID, timestamp string, moves []Move, set map[string]types.AttributeValue) error {
+	sets, names, values := setExpression(set)
+	sets = append([]string{"moves = list_append(if_not_exists(moves, :empty), :moves)"}, sets...)
+	values[":moves"] = &types.AttributeValueMemberL{Value: movesToAttr(moves)}
+	values[":empty"] = &types.AttributeValueMemberL{Value: []types.AttributeValue{}}
+	return s.update(ctx, gameID, timestamp, "SET "+strings.Join(sets, ", "), names, values)
+}
+
+// setExpression turns attributes into SET clauses, naming every attribute
+// through a placeholder since mode, size and status are reserved words.
+func setExpression(set map[string]types.AttributeValue) ([]string, map[string]string, map[string]types.AttributeValue) {
+	attrs := make([]string, 0, len(set))
+	for attr := range set {
+		attrs = append(attrs, attr)
+	}
+	sort.Strings(attrs)
+	sets := make([]string, 0, len(attrs))
+	names := make(map[string]string, len(attrs))
+	values := make(map[string]types.AttributeValue, len(attrs)+2)
+	for i, attr := range attrs {
+		sets = append(sets, fmt.Sprintf("#a%d = :v%d", i, i))
+		names[fmt.Sprintf("#a%d", i)] = attr
+		values[fmt.Sprintf(":v%d", i)] = set[attr]
+	}
+	return sets, names, values
+}
+
+func (s *dynamoStore) update(ctx context.Context, gameID, timestamp, expr string, names map[string]string, values map[string]types.AttributeValue) error {
+	if len(names) == 0 {
+		names = nil
+	}
+	callCtx, cancel := dynamoContext(ctx)
+	defer cancel()
+	start := time.Now()
+	_, err := s.client.UpdateItem(callCtx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"gameId":    &types.AttributeValueMemberS{Value: gameID},
+			"timestamp": &types.AttributeValueMemberS{Value: timestamp},
+		},
+		UpdateExpression:          aws.String(expr),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	observeOp("UpdateItem", start)
+	countOp("UpdateItem", err)
+	return err
+}
+
+func (s *dynamoStore) DeleteGame(ctx context.Context, gameID, timestamp string) error {
+	callCtx, cancel := dynamoContext(ctx)
+	defer cancel()
+	start := time.Now()
+	_, err := s.client.DeleteItem(callCtx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"gameId":    &types.AttributeValueMemberS{Value: gameID},
+			"timestamp": &types.AttributeValueMemberS{Value: timestamp},
+		},
+	})
+	observeOp("DeleteItem", start)
+	countOp("DeleteItem", err)
+	return err
+}
+
+func (s *dynamoStore) Ping(ctx context.Context) error {
+	start := time.Now()
+	_, err := s.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(s.table)})
+	observeOp("DescribeTable", start)
+	countOp("DescribeTable", err)
+	return err
 }
 
 func initDynamoDB() {
-	tableName = os.Getenv("DYNAMODB_TABLE")
+	tableName := os.Getenv("DYNAMODB_TABLE")
 	if tableName == "" {
 		log.Println("DYNAMODB_TABLE not set, game persistence disabled")
 		return
@@ -145,12 +866,110 @@ func initDynamoDB() {
 		log.Printf("Failed to load AWS config: %v", err)
 		return
 	}
-	dynamoClient = dynamodb.NewFromConfig(cfg)
+	if d, err := time.ParseDuration(os.Getenv("DYNAMODB_TIMEOUT")); err == nil && d > 0 {
+		dynamoTimeout = d
+	}
+	store = &dynamoStore{
+		client:    dynamodb.NewFromConfig(cfg),
+		table:     tableName,
+		modeIndex: os.Getenv("DYNAMODB_MODE_INDEX"),
+	}
 	log.Printf("DynamoDB client initialized for table: %s", tableName)
+	if os.Getenv("DYNAMODB_STARTUP_CHECK") != "false" {
+		checkDynamoTable(tableName)
+	}
+}
+
+// checkDynamoTable describes the table once at startup and marks DynamoDB
+// not ready when it is missing or off limits, rather than letting every
+// read fail with its own AWS error.
+func checkDynamoTable(tableName string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+	defer cancel()
+	if err := store.Ping(ctx); err != nil {
+		reason := tableErrorReason(tableName, err)
+		slog.Warn("DynamoDB startup check failed, reads disabled until it passes", "reason", reason, "err", err)
+		setDynamoReady(false, reason)
+	}
+}
+
+// tableErrorReason turns a DescribeTable error into a message for clients.
+func tableErrorReason(tableName string, err error) string {
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return fmt.Sprintf("DynamoDB table %s does not exist", tableName)
+	}
+	var apiErr interface{ ErrorCode() string }
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "AccessDeniedException" {
+		return fmt.Sprintf("Access denied to DynamoDB table %s", tableName)
+	}
+	return fmt.Sprintf("DynamoDB table %s is unreachable", tableName)
+}
+
+func setDynamoReady(ready bool, reason string) {
+	dynamoMu.Lock()
+	defer dynamoMu.Unlock()
+	dynamoReady, dynamoNotReady = ready, reason
+}
+
+// requireStore writes a 503 and returns false when reads can't be served,
+// either because persistence is disabled or the startup check failed.
+func requireStore(w http.ResponseWriter) bool {
+	if store == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "DATABASE_UNAVAILABLE", "Database not available")
+		return false
+	}
+	dynamoMu.RLock()
+	ready, reason := dynamoReady, dynamoNotReady
+	dynamoMu.RUnlock()
+	if !ready {
+		writeJSONError(w, http.StatusServiceUnavailable, "DATABASE_UNAVAILABLE", reason)
+		return false
+	}
+	return true
+}
+
+// startSaveWorkers starts the goroutines that perform queued DynamoDB
+// writes. Only the first call does anything.
+func startSaveWorkers() {
+	saveWorkersOnce.Do(func() {
+		queue := make(chan func(), saveQueueSize)
+		saveQueue = queue
+		for i := 0; i < saveWorkers; i++ {
+			go func() {
+				for save := range queue {
+					writeQueueDepth.Dec()
+					save()
+					pendingSaves.Done()
+				}
+			}()
+		}
+	})
+}
+
+// queueSave hands save to the write workers, waiting up to saveQueueTimeout
+// for room in the queue. A save that doesn't fit in time is dropped so a
+// DynamoDB slowdown can't pile up goroutines; it reports whether save was queued.
+func queueSave(what string, save func()) bool {
+	startSaveWorkers()
+	pendingSaves.Add(1)
+	writeQueueDepth.Inc()
+	timer := time.NewTimer(saveQueueTimeout)
+	defer timer.Stop()
+	select {
+	case saveQueue <- save:
+		return true
+	case <-timer.C:
+		writeQueueDepth.Dec()
+		pendingSaves.Done()
+		dynamoWritesDropped.Inc()
+		slog.Warn("DynamoDB write queue full, dropping save", "save", what, "timeout", saveQueueTimeout)
+		return false
+	}
 }
 
-func saveGameToDynamoDB(result GameResult) {
-	if dynamoClient == nil {
+func saveGameToDynamoDB(ctx context.Context, result GameResult) {
+	if store == nil {
 		return
 	}
 	gameId := uuid.New().String()
@@ -163,40 +982,76 @@ func saveGameToDynamoDB(result GameResult) {
 		"isTie":     &types.AttributeValueMemberBOOL{Value: result.IsTie},
 		"mode":      &types.AttributeValueMemberS{Value: result.Mode},
 	}
+	if result.Mode == "ai" {
+		item["difficulty"] = &types.AttributeValueMemberS{Value: difficultyLabel(result)}
+	}
 	if !result.IsTie {
 		item["winner"] = &types.AttributeValueMemberS{Value: result.Winner}
 		item["pattern"] = &types.AttributeValueMemberS{Value: result.Pattern}
 	}
-	_, err := dynamoClient.PutItem(context.Background(), &dynamodb.PutItemInput{
-		TableName: aws.String(tableName),
-		Item:      item,
-	})
-	if err != nil {
-		log.Printf("Failed to save game to DynamoDB: %v", err)
-		dynamoDBOps.WithLabelValues("PutItem", "error").Inc()
-	} else {
-		dynamoDBOps.WithLabelValues("PutItem", "success").Inc()
+	if n := len(result.Moves); n > 0 {
+		item["size"] = &types.AttributeValueMemberN{Value: "3"}
+		item["moves"] = &types.AttributeValueMemberL{Value: movesToAttr(result.Moves)}
+		item["moveCount"] = &types.AttributeValueMemberN{Value: strconv.Itoa(n)}
+		item["duration"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", result.Moves[n-1].Time)}
+	}
+	if result.Synthetic {
+		item["synthetic"] = &types.AttributeValueMemberBOOL{Value: true}
+	}
+	setExpiry(item)
+	if err := store.SaveGame(ctx, item); err != nil {
+		requestLogger(ctx).Error("failed to save game to DynamoDB", "gameId", gameId, "mode", result.Mode, "err", err)
+	}
+}
+
+// withRetry runs a DynamoDB write up to writeAttempts times, backing off
+// exponentially with jitter between attempts. Only use it for idempotent
+// writes such as PutItem: a list_append that timed out may still have landed.
+func withRetry(ctx context.Context, operation string, write func() error) error {
+	var err error
+	for attempt := 0; attempt < writeAttempts; attempt++ {
+		if attempt > 0 {
+			dynamoDBRetries.WithLabelValues(operation).Inc()
+			backoff := writeBackoff << (attempt - 1)
+			select {
+			case <-time.After(backoff/2 + time.Duration(rand.Int63n(int64(backoff)))):
+			case <-ctx.Done():
+				return err
+			}
+		}
+		if err = write(); err == nil {
+			return nil
+		}
 	}
+	return err
 }
 
 func saveOnlineGameToDynamoDB(g *OnlineGame) {
-	if dynamoClient == nil {
+	if store == nil {
 		return
 	}
-	timestamp := time.Now().UTC().Format(time.RFC3339)
+	// Overwrite the live item if moves were persisted as they were played
+	timestamp := g.savedAt
+	if timestamp == "" {
+		timestamp = time.Now().UTC().Format(time.RFC3339)
+	}
+	moves := g.Moves
+	if cells := g.Size * g.Size; len(moves) > cells {
+		// A game can't have more moves than cells; don't let a runaway
+		// list push the item past DynamoDB's 400KB limit
+		log.Printf("Online game %s has %d moves for %d cells, saving the first %d", g.ID, len(moves), cells, cells)
+		movesTruncated.Inc()
+		moves = moves[:cells]
+	}
 	duration := int64(0)
-	if len(g.Moves) > 0 {
-		duration = g.Moves[len(g.Moves)-1].Time
+	if len(moves) > 0 {
+		duration = moves[len(moves)-1].Time
 	}
-
-	// Convert moves to DynamoDB list
-	movesList := make([]types.AttributeValue, len(g.Moves))
-	for i, m := range g.Moves {
-		movesList[i] = &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
-			"index":  &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", m.Index)},
-			"player": &types.AttributeValueMemberS{Value: m.Player},
-			"time":   &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", m.Time)},
-		}}
+	movesList := movesToAttr(moves)
+	if err := validateMoveSequence(moves, g.Size); err != nil {
+		// The board and move log diverged; save anyway so the game isn't lost
+		log.Printf("Online game %s has an illegal move sequence: %v", g.ID, err)
+		invalidMoveSequences.Inc()
 	}
 
 	item := map[string]types.AttributeValue{
@@ -204,54 +1059,402 @@ func saveOnlineGameToDynamoDB(g *OnlineGame) {
 		"timestamp": &types.AttributeValueMemberS{Value: timestamp},
 		"player1":   &types.AttributeValueMemberS{Value: g.Player1},
 		"player2":   &types.AttributeValueMemberS{Value: g.Player2},
-		"isTie":     &types.AttributeValueMemberBOOL{Value: g.Winner == ""},
+		"isTie":     &types.AttributeValueMemberBOOL{Value: g.Winner == "" && g.Status == "finished"},
 		"mode":      &types.AttributeValueMemberS{Value: "online"},
+		"size":      &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", g.Size)},
 		"moves":     &types.AttributeValueMemberL{Value: movesList},
+		"moveCount": &types.AttributeValueMemberN{Value: strconv.Itoa(len(moves))},
 		"duration":  &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", duration)},
 	}
+	if g.FirstPlayer != "" {
+		item["firstPlayer"] = &types.AttributeValueMemberS{Value: g.FirstPlayer}
+	}
 	if g.Winner != "" {
 		item["winner"] = &types.AttributeValueMemberS{Value: g.Winner}
 		item["pattern"] = &types.AttributeValueMemberS{Value: g.Pattern}
 	}
-	_, err := dynamoClient.PutItem(context.Background(), &dynamodb.PutItemInput{
-		TableName: aws.String(tableName),
-		Item:      item,
-	})
-	if err != nil {
+	if g.demo != "" {
+		item["mode"] = &types.AttributeValueMemberS{Value: "ai"}
+		item["difficulty"] = &types.AttributeValueMemberS{Value: g.demo}
+		item["demo"] = &types.AttributeValueMemberBOOL{Value: true}
+	}
+	if g.Series != nil {
+		item["seriesId"] = &types.AttributeValueMemberS{Value: g.Series.ID}
+		item["seriesGame"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", g.Series.Game)}
+		if g.Series.Winner != "" {
+			// The deciding game carries the final series result
+			item["seriesBestOf"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", g.Series.BestOf)}
+			item["seriesWinner"] = &types.AttributeValueMemberS{Value: g.Series.Winner}
+			item["seriesPlayer1Wins"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", g.Series.Player1Wins)}
+			item["seriesPlayer2Wins"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", g.Series.Player2Wins)}
+		}
+	}
+	if g.synthetic {
+		item["synthetic"] = &types.AttributeValueMemberBOOL{Value: true}
+	}
+	if g.Status != "finished" {
+		// Saved mid-game on shutdown; excluded from stats and streaks
+		item["status"] = &types.AttributeValueMemberS{Value: g.Status}
+	}
+	setExpiry(item)
+	if err := store.SaveGame(context.Background(), item); err != nil {
 		log.Printf("Failed to save online game to DynamoDB: %v", err)
-		dynamoDBOps.WithLabelValues("PutItem", "error").Inc()
 	} else {
-		dynamoDBOps.WithLabelValues("PutItem", "success").Inc()
+		notifyLeaderboard()
 	}
 }
 
-func metricsMiddleware(endpoint string, next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		httpRequestsInFlight.Inc()
-		defer httpRequestsInFlight.Dec()
-		rw := &responseWriter{w, http.StatusOK}
-		next(rw, r)
-		httpRequestsTotal.WithLabelValues(r.Method, endpoint, http.StatusText(rw.status)).Inc()
-		httpRequestDuration.WithLabelValues(r.Method, endpoint).Observe(time.Since(start).Seconds())
+// setExpiry stamps item with a ttl of now plus gameRetention, in Unix epoch
+// seconds as DynamoDB TTL expects, unless retention is disabled.
+func setExpiry(item map[string]types.AttributeValue) {
+	if gameRetention <= 0 {
+		return
 	}
+	item["ttl"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(gameRetention).Unix(), 10)}
+}
+
+// movesToAttr converts moves to a DynamoDB list of {index, player, time} maps.
+func movesToAttr(moves []Move) []types.AttributeValue {
+	movesList := make([]types.AttributeValue, len(moves))
+	for i, m := range moves {
+		movesList[i] = &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+			"index":  &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", m.Index)},
+			"player": &types.AttributeValueMemberS{Value: m.Player},
+			"time":   &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", m.Time)},
+		}}
+	}
+	return movesList
+}
+
+// saveLiveMoves writes moves to the item of a game still in progress, creating
+// it on the first move. Moves are appended unless replace is set, in which case
+// they become the whole list (used after a takeback). The item is marked
+// status=playing until the final save overwrites it.
+func saveLiveMoves(gameID, timestamp, player1, player2 string, size int, moves []Move, replace bool) {
+	set := map[string]types.AttributeValue{
+		"player1": &types.AttributeValueMemberS{Value: player1},
+		"player2": &types.AttributeValueMemberS{Value: player2},
+		"mode":    &types.AttributeValueMemberS{Value: "online"},
+		"size":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", size)},
+		"status":  &types.AttributeValueMemberS{Value: "playing"},
+	}
+	setExpiry(set)
+	var err error
+	if replace {
+		set["moves"] = &types.AttributeValueMemberL{Value: movesToAttr(moves)}
+		err = store.UpdateGame(context.Background(), gameID, timestamp, set)
+	} else {
+		err = store.AppendMoves(context.Background(), gameID, timestamp, moves, set)
+	}
+	if err != nil {
+		log.Printf("Failed to save moves for game %s: %v", gameID, err)
+	}
+}
+
+// Archival of old games to S3. Archived games are removed from the read path:
+// leaderboard, stats and replay endpoints only serve what is still in DynamoDB.
+
+// archiveItem converts a whole DynamoDB item to plain JSON values so the
+// archive keeps every attribute, including ones added after this was written.
+func archiveItem(item map[string]types.AttributeValue) map[string]interface{} {
+	out := make(map[string]interface{}, len(item))
+	for k, v := range item {
+		out[k] = attrToJSON(v)
+	}
+	return out
+}
+
+// attrToJSON unwraps a DynamoDB attribute value. Numbers stay json.Number so
+// they keep their exact digits.
+func attrToJSON(v types.AttributeValue) interface{} {
+	switch v := v.(type) {
+	case *types.AttributeValueMemberS:
+		return v.Value
+	case *types.AttributeValueMemberN:
+		return json.Number(v.Value)
+	case *types.AttributeValueMemberBOOL:
+		return v.Value
+	case *types.AttributeValueMemberB:
+		return v.Value
+	case *types.AttributeValueMemberSS:
+		return v.Value
+	case *types.AttributeValueMemberNS:
+		nums := make([]json.Number, len(v.Value))
+		for i, n := range v.Value {
+			nums[i] = json.Number(n)
+		}
+		return nums
+	case *types.AttributeValueMemberBS:
+		return v.Value
+	case *types.AttributeValueMemberL:
+		list := make([]interface{}, len(v.Value))
+		for i, e := range v.Value {
+			list[i] = attrToJSON(e)
+		}
+		return list
+	case *types.AttributeValueMemberM:
+		return archiveItem(v.Value)
+	}
+	return nil
+}
+
+func initArchiver() {
+	archiveBucket = os.Getenv("ARCHIVE_S3_BUCKET")
+	if archiveBucket == "" || store == nil {
+		log.Println("ARCHIVE_S3_BUCKET not set, game archival disabled")
+		return
+	}
+	archivePrefix = os.Getenv("ARCHIVE_S3_PREFIX")
+	if d, err := time.ParseDuration(os.Getenv("ARCHIVE_AFTER")); err == nil && d > 0 {
+		archiveAfter = d
+	}
+	archiveDelete = os.Getenv("ARCHIVE_DELETE") == "true"
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Printf("Failed to load AWS config for archival: %v", err)
+		return
+	}
+	s3Client = s3.NewFromConfig(cfg)
+	log.Printf("Game archival enabled: s3://%s/%s (after %s, delete=%t)", archiveBucket, archivePrefix, archiveAfter, archiveDelete)
+}
+
+func runArchiver() {
+	if s3Client == nil {
+		return
+	}
+	interval := 24 * time.Hour
+	if d, err := time.ParseDuration(os.Getenv("ARCHIVE_INTERVAL")); err == nil && d > 0 {
+		interval = d
+	}
+	ticker := time.NewTicker(interval)
+	for {
+		if n, err := archiveOldGames(time.Now().Add(-archiveAfter)); err != nil {
+			log.Printf("Archival failed after %d games: %v", n, err)
+		} else if n > 0 {
+			log.Printf("Archived %d games to S3", n)
+		}
+		<-ticker.C
+	}
+}
+
+// archiveOldGames writes every game older than cutoff to S3 as gzipped JSON,
+// one object per scan page, and optionally deletes the archived items.
+func archiveOldGames(cutoff time.Time) (int, error) {
+	runID := time.Now().UTC().Format("20060102T150405Z")
+	archived := 0
+	page := 0
+	ctx := context.Background()
+	err := store.ScanGames(ctx, GameFilter{Before: cutoff.UTC().Format(time.RFC3339)}, func(items []map[string]types.AttributeValue) error {
+		if len(items) == 0 {
+			return nil
+		}
+		batch := make([]map[string]interface{}, 0, len(items))
+		for _, item := range items {
+			batch = append(batch, archiveItem(item))
+		}
+		key := fmt.Sprintf("%sgames-%s-%04d.json.gz", archivePrefix, runID, page)
+		if err := putArchive(key, batch); err != nil {
+			return err
+		}
+		page++
+		archived += len(batch)
+		archivedGamesTotal.Add(float64(len(batch)))
+		if archiveDelete {
+			for _, item := range items {
+				gameID := getStringAttr(item, "gameId")
+				if err := store.DeleteGame(ctx, gameID, getStringAttr(item, "timestamp")); err != nil {
+					log.Printf("Failed to delete archived game %s: %v", gameID, err)
+				}
+			}
+		}
+		return nil
+	})
+	return archived, err
+}
+
+func putArchive(key string, batch []map[string]interface{}) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(batch); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	_, err := s3Client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:          aws.String(archiveBucket),
+		Key:             aws.String(key),
+		Body:            bytes.NewReader(buf.Bytes()),
+		ContentType:     aws.String("application/json"),
+		ContentEncoding: aws.String("gzip"),
+	})
+	return err
+}
+
+func metricsMiddleware(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		httpRequestsInFlight.Inc()
+		defer httpRequestsInFlight.Dec()
+		rw := &responseWriter{w, http.StatusOK}
+		next(rw, r)
+		httpRequestsTotal.WithLabelValues(r.Method, endpoint, http.StatusText(rw.status)).Inc()
+		httpResponsesTotal.WithLabelValues(fmt.Sprintf("%dxx", rw.status/100)).Inc()
+		httpRequestDuration.WithLabelValues(r.Method, endpoint).Observe(time.Since(start).Seconds())
+	}
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	status int
 }
 
-type responseWriter struct {
-	http.ResponseWriter
-	status int
-}
-
 func (rw *responseWriter) WriteHeader(code int) {
 	rw.status = code
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Flush passes through to the underlying writer, so handlers that stream a
+// response, like /api/export, still flush behind metricsMiddleware.
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+type requestIDKey struct{}
+
+// requestIDMiddleware tags each request with the caller's X-Request-ID, or a
+// new one if it is missing or malformed, and echoes it in the response.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 || strings.IndexFunc(id, func(c rune) bool { return c <= ' ' || c > '~' }) >= 0 {
+			id = uuid.New().String()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestLogger returns the default logger tagged with ctx's request ID.
+func requestLogger(ctx context.Context) *slog.Logger {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return slog.Default().With("requestId", id)
+	}
+	return slog.Default()
+}
+
+// tokenBucket holds a client's remaining requests as of last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimitMiddleware allows each client IP up to burst requests at once,
+// refilling at rate per second, and answers 429 with Retry-After once empty.
+// A rate of zero or less disables limiting.
+func rateLimitMiddleware(endpoint string, rate float64, burst int, next http.HandlerFunc) http.HandlerFunc {
+	if rate <= 0 {
+		return next
+	}
+	var mu sync.Mutex
+	buckets := make(map[string]*tokenBucket)
+	var lastSweep time.Time
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		ip := clientIP(r)
+		mu.Lock()
+		if now.Sub(lastSweep) > time.Minute {
+			for key, b := range buckets {
+				if b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst) {
+					delete(buckets, key)
+				}
+			}
+			lastSweep = now
+		}
+		b, ok := buckets[ip]
+		if !ok {
+			b = &tokenBucket{tokens: float64(burst), last: now}
+			buckets[ip] = b
+		}
+		b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+		b.last = now
+		allowed := b.tokens >= 1
+		if allowed {
+			b.tokens--
+		}
+		wait := (1 - b.tokens) / rate
+		mu.Unlock()
+		if !allowed {
+			rateLimitedTotal.WithLabelValues(endpoint).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait))))
+			writeJSONError(w, http.StatusTooManyRequests, "RATE_LIMITED", "Too many requests")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clientIP returns the caller's address, preferring the last X-Forwarded-For
+// hop since that one is appended by our load balancer and can't be spoofed.
+func clientIP(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// parseOrigins splits a comma-separated ALLOWED_ORIGINS value into a set.
+func parseOrigins(v string) map[string]bool {
+	origins := make(map[string]bool)
+	for _, o := range strings.Split(v, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins[o] = true
+		}
+	}
+	return origins
+}
+
+// checkWSOrigin guards WebSocket upgrades against cross-site hijacking. Browsers
+// always send Origin, so requests without one (CLIs, the synthetic monitor) are
+// allowed. Otherwise the origin must be in ALLOWED_ORIGINS or, when that is
+// unset, match the request host.
+func checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if wsAllowAllOrigins || origin == "" {
+		return true
+	}
+	if len(allowedOrigins) > 0 {
+		return allowedOrigins[origin]
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// corsMiddleware allows any origin unless allowedOrigins is set, in which case
+// only a listed Origin is echoed back.
 func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if len(allowedOrigins) == 0 {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Add("Vary", "Origin")
+			if origin := r.Header.Get("Origin"); allowedOrigins[origin] {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+		}
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Request-ID")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -262,665 +1465,3550 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
 func gameHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
 		return
 	}
 	var result GameResult
 	if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "INVALID_JSON", err.Error())
 		return
 	}
 	if result.Mode == "" {
 		result.Mode = "local"
 	}
-	go saveGameToDynamoDB(result)
+	var err error
+	if result.Player1, err = validatePlayerName(result.Player1); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_PLAYER_NAME", err.Error())
+		return
+	}
+	if result.Player2, err = validatePlayerName(result.Player2); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_PLAYER_NAME", err.Error())
+		return
+	}
+	result.Winner = strings.TrimSpace(result.Winner)
+	if result.Winner != "" && result.Winner != result.Player1 && result.Winner != result.Player2 {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_REQUEST", "winner must be one of the players")
+		return
+	}
+	if err := validateMoveSequence(result.Moves, 3); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_MOVES", err.Error())
+		return
+	}
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > 128 {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_REQUEST", "Idempotency-Key must be at most 128 characters")
+		return
+	}
+	if key != "" && !claimIdempotencyKey(key) {
+		// A retry of a game already recorded gets the original response
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "recorded"})
+		return
+	}
+	if !allowSubmission(result.Player1, result.Player2) {
+		if key != "" {
+			releaseIdempotencyKey(key)
+		}
+		writeJSONError(w, http.StatusTooManyRequests, "PLAYER_THROTTLED", "Too many game submissions for player")
+		return
+	}
+	ctx := context.WithoutCancel(r.Context())
+	queueSave(result.Mode+" game", func() { saveGameToDynamoDB(ctx, result) })
 	recordMetrics(result)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "recorded"})
 }
 
+type idempotencyEntry struct {
+	key  string
+	seen time.Time
+}
+
+// claimIdempotencyKey records key and reports whether it is new. Keys are
+// forgotten after idempotencyTTL, or oldest first once idempotencyMax are held.
+func claimIdempotencyKey(key string) bool {
+	now := time.Now()
+	idempotencyMu.Lock()
+	defer idempotencyMu.Unlock()
+	for e := idempotencyKeys.Back(); e != nil && now.Sub(e.Value.(idempotencyEntry).seen) >= idempotencyTTL; e = idempotencyKeys.Back() {
+		delete(idempotencyIndex, e.Value.(idempotencyEntry).key)
+		idempotencyKeys.Remove(e)
+	}
+	if _, ok := idempotencyIndex[key]; ok {
+		return false
+	}
+	idempotencyIndex[key] = idempotencyKeys.PushFront(idempotencyEntry{key: key, seen: now})
+	if idempotencyKeys.Len() > idempotencyMax {
+		e := idempotencyKeys.Back()
+		delete(idempotencyIndex, e.Value.(idempotencyEntry).key)
+		idempotencyKeys.Remove(e)
+	}
+	return true
+}
+
+// releaseIdempotencyKey forgets key so a request rejected after claiming it
+// can be retried.
+func releaseIdempotencyKey(key string) {
+	idempotencyMu.Lock()
+	defer idempotencyMu.Unlock()
+	if e, ok := idempotencyIndex[key]; ok {
+		delete(idempotencyIndex, key)
+		idempotencyKeys.Remove(e)
+	}
+}
+
+// validatePlayerName trims name and checks it is 1-32 characters without
+// control characters, since names end up in metric labels and DynamoDB.
+func validatePlayerName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if n := utf8.RuneCountInString(name); n < 1 || n > 32 {
+		return "", errors.New("player name must be 1-32 characters")
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "", errors.New("player name must not contain control characters")
+	}
+	return name, nil
+}
+
+// validateMoveSequence checks moves replay on an empty size x size board:
+// alternating X and O on free cells with non-decreasing times.
+func validateMoveSequence(moves []Move, size int) error {
+	board := make([]bool, size*size)
+	for i, m := range moves {
+		if m.Index < 0 || m.Index >= len(board) {
+			return ErrOutOfRange
+		}
+		if board[m.Index] {
+			return ErrCellOccupied
+		}
+		board[m.Index] = true
+		if m.Player != "X" && m.Player != "O" {
+			return errors.New("move player must be X or O")
+		}
+		if i > 0 && m.Player == moves[i-1].Player {
+			return errors.New("moves must alternate between X and O")
+		}
+		if m.Time < 0 || (i > 0 && m.Time < moves[i-1].Time) {
+			return errors.New("move times must not decrease")
+		}
+	}
+	return nil
+}
+
+// allowSubmission enforces submitInterval between recorded games per player,
+// keyed by normalized name so "Alice" and " alice" share one budget.
+func allowSubmission(players ...string) bool {
+	if submitInterval <= 0 {
+		return true
+	}
+	now := time.Now()
+	lastSubmitMu.Lock()
+	defer lastSubmitMu.Unlock()
+	if now.Sub(lastSubmitSweep) > time.Minute {
+		for name, t := range lastSubmit {
+			if now.Sub(t) >= submitInterval {
+				delete(lastSubmit, name)
+			}
+		}
+		lastSubmitSweep = now
+	}
+	keys := make([]string, 0, len(players))
+	for _, p := range players {
+		key := strings.ToLower(strings.TrimSpace(p))
+		if t, ok := lastSubmit[key]; ok && now.Sub(t) < submitInterval {
+			return false
+		}
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		lastSubmit[key] = now
+	}
+	return true
+}
+
 func recordMetrics(result GameResult) {
+	difficulty := difficultyLabel(result)
 	playerGamesTotal.WithLabelValues(result.Player1, result.Mode).Inc()
 	playerGamesTotal.WithLabelValues(result.Player2, result.Mode).Inc()
 	if result.IsTie {
-		gamesTotal.WithLabelValues("tie", result.Mode).Inc()
-		tiesTotal.WithLabelValues(result.Mode).Inc()
+		gamesTotal.WithLabelValues("tie", result.Mode, difficulty).Inc()
+		tiesTotal.WithLabelValues(result.Mode, difficulty).Inc()
+	} else {
+		gamesTotal.WithLabelValues("win", result.Mode, difficulty).Inc()
+		winsTotal.WithLabelValues(result.Winner, result.Pattern, result.Mode, difficulty).Inc()
+	}
+	updateWinStreaks(result)
+}
+
+// difficultyLabel returns the AI difficulty metric label for result: "none"
+// outside AI games and "unknown" for AI games without a recognized level.
+func difficultyLabel(result GameResult) string {
+	if result.Mode != "ai" {
+		return "none"
+	}
+	switch result.Difficulty {
+	case "easy", "medium", "hard":
+		return result.Difficulty
+	}
+	return "unknown"
+}
+
+// updateWinStreaks is the only writer of winStreaks and the streak gauge. It is
+// called for every recorded game and when replaying history at startup.
+func updateWinStreaks(result GameResult) {
+	winStreaksMu.Lock()
+	defer winStreaksMu.Unlock()
+	if result.IsTie {
 		winStreaks[result.Player1] = 0
 		winStreaks[result.Player2] = 0
 		winStreakGauge.WithLabelValues(result.Player1).Set(0)
 		winStreakGauge.WithLabelValues(result.Player2).Set(0)
-	} else {
-		gamesTotal.WithLabelValues("win", result.Mode).Inc()
-		winsTotal.WithLabelValues(result.Winner, result.Pattern, result.Mode).Inc()
-		loser := result.Player1
-		if result.Winner == result.Player1 {
-			loser = result.Player2
-		}
-		winStreaks[result.Winner]++
-		winStreaks[loser] = 0
-		winStreakGauge.WithLabelValues(result.Winner).Set(float64(winStreaks[result.Winner]))
-		winStreakGauge.WithLabelValues(loser).Set(0)
+		return
+	}
+	loser := result.Player1
+	if result.Winner == result.Player1 {
+		loser = result.Player2
 	}
+	winStreaks[result.Winner]++
+	winStreaks[loser] = 0
+	winStreakGauge.WithLabelValues(result.Winner).Set(float64(winStreaks[result.Winner]))
+	winStreakGauge.WithLabelValues(loser).Set(0)
 }
 
-// Online game handlers
-func createGameHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+func getWinStreak(player string) (int, bool) {
+	winStreaksMu.Lock()
+	defer winStreaksMu.Unlock()
+	streak, ok := winStreaks[player]
+	return streak, ok
+}
+
+// loadWinStreaksFromDynamoDB rebuilds in-memory streaks after a restart by
+// replaying the games saved within winStreakLookback in timestamp order, so a
+// streak older than the lookback restarts from its recent games. The scan
+// gives up after winStreakLoadTimeout and leaves streaks empty.
+func loadWinStreaksFromDynamoDB() error {
+	if store == nil {
+		return nil
 	}
-	var req struct {
-		Player1 string `json:"player1"`
+	ctx, cancel := context.WithTimeout(context.Background(), winStreakLoadTimeout)
+	defer cancel()
+	var filter GameFilter
+	if winStreakLookback > 0 {
+		filter.Since = time.Now().Add(-winStreakLookback).UTC().Format(time.RFC3339)
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Player1 == "" {
-		http.Error(w, "player1 required", http.StatusBadRequest)
-		return
+	var items []map[string]types.AttributeValue
+	err := store.ScanGames(ctx, filter, func(page []map[string]types.AttributeValue) error {
+		items = append(items, page...)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to load win streaks: %v", err)
+		return err
 	}
-	// Coin flip: random first player
-	firstPlayer := "X"
-	if rand.Intn(2) == 1 {
-		firstPlayer = "O"
+	for _, result := range gameResultsByTime(items) {
+		updateWinStreaks(result)
 	}
-	game := &OnlineGame{
-		ID:          uuid.New().String()[:8],
-		Board:       [9]string{},
-		Turn:        firstPlayer,
-		FirstPlayer: firstPlayer,
-		Player1:     req.Player1,
-		Status:      "waiting",
-		CreatedAt:   time.Now(),
+	log.Printf("Restored win streaks from %d games", len(items))
+	return nil
+}
+
+// warmUp seeds win streaks, recording the outcome in warmup. main runs it in
+// the background once the listeners are up, so a slow scan can't keep the
+// pod from answering its liveness probe; /readyz keeps traffic away until it
+// is done.
+func warmUp() {
+	state := "done"
+	if err := loadWinStreaksFromDynamoDB(); errors.Is(err, context.DeadlineExceeded) {
+		state = "timed_out"
+	} else if err != nil {
+		state = "failed"
 	}
-	gamesMu.Lock()
-	games[game.ID] = game
-	gamesMu.Unlock()
-	onlineGamesCreated.Inc()
-	onlineGamesActive.Inc()
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"gameId": game.ID, "firstPlayer": game.FirstPlayer})
+	setWarmup(state)
 }
 
-func joinGameHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+func setWarmup(state string) {
+	warmupMu.Lock()
+	defer warmupMu.Unlock()
+	warmup = state
+}
+
+func warmupState() string {
+	warmupMu.Lock()
+	defer warmupMu.Unlock()
+	return warmup
+}
+
+func gameResultsByTime(items []map[string]types.AttributeValue) []GameResult {
+	sort.SliceStable(items, func(i, j int) bool {
+		return getStringAttr(items[i], "timestamp") < getStringAttr(items[j], "timestamp")
+	})
+	results := make([]GameResult, 0, len(items))
+	for _, item := range items {
+		if isUnfinished(item) {
+			continue
+		}
+		results = append(results, GameResult{
+			Player1: getStringAttr(item, "player1"),
+			Player2: getStringAttr(item, "player2"),
+			Winner:  getStringAttr(item, "winner"),
+			IsTie:   getBoolAttr(item, "isTie"),
+			Mode:    getStringAttr(item, "mode"),
+		})
 	}
-	var req struct {
-		GameID  string `json:"gameId"`
-		Player2 string `json:"player2"`
+	return results
+}
+
+// isUnfinished reports whether item is a game still being played or saved
+// unfinished on shutdown. Finished games carry no status attribute.
+func isUnfinished(item map[string]types.AttributeValue) bool {
+	return getStringAttr(item, "status") != ""
+}
+
+// isSyntheticGame reports whether item was recorded by the synthetic monitor.
+func isSyntheticGame(item map[string]types.AttributeValue) bool {
+	return getBoolAttr(item, "synthetic")
+}
+
+// ErrGameNotFound is returned when a game ID matches no active or saved game.
+var ErrGameNotFound = errors.New("game not found")
+
+var (
+	// ErrNotPlayer is returned when a game action names someone not playing in it.
+	ErrNotPlayer = errors.New("not a player in this game")
+	// ErrGameNotPlaying is returned for actions that need a game in progress.
+	ErrGameNotPlaying = errors.New("game not in progress")
+	// Move rule violations, from validateMove.
+	ErrWrongTurn    = errors.New("not this player's turn")
+	ErrOutOfRange   = errors.New("cell index out of range")
+	ErrCellOccupied = errors.New("cell already taken")
+)
+
+// moveRejectReasons labels validateMove errors for tictactoe_moves_rejected_total.
+var moveRejectReasons = map[error]string{
+	ErrGameNotPlaying: "game_over",
+	ErrWrongTurn:      "wrong_turn",
+	ErrOutOfRange:     "out_of_range",
+	ErrCellOccupied:   "occupied",
+}
+
+// validateMove checks that player may take cell idx: the game is in progress,
+// it is their turn (player1 plays X, player2 O), and the cell is on the board
+// and empty.
+func validateMove(board []string, status, turn, player, player1, player2 string, idx int) error {
+	if status != "playing" {
+		return ErrGameNotPlaying
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	expected := player1
+	if turn == "O" {
+		expected = player2
 	}
-	gamesMu.Lock()
-	game, exists := games[req.GameID]
-	if !exists {
-		gamesMu.Unlock()
-		http.Error(w, "Game not found", http.StatusNotFound)
-		return
+	if player != expected {
+		return ErrWrongTurn
 	}
-	if game.Status != "waiting" {
-		gamesMu.Unlock()
-		http.Error(w, "Game already started", http.StatusBadRequest)
-		return
+	if idx < 0 || idx >= len(board) {
+		return ErrOutOfRange
 	}
-	game.Player2 = req.Player2
-	game.Status = "playing"
-	game.StartedAt = time.Now()
-	gamesMu.Unlock()
-	game.broadcast(WSMessage{Type: "game_start", Payload: game.toJSON()})
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(game.toJSON())
+	if board[idx] != "" {
+		return ErrCellOccupied
+	}
+	return nil
 }
 
-func getGameHandler(w http.ResponseWriter, r *http.Request) {
-	gameID := r.URL.Query().Get("id")
+// lookupGameByCode returns the game holding the given room code.
+func lookupGameByCode(code string) (*OnlineGame, error) {
 	gamesMu.RLock()
-	game, exists := games[gameID]
+	id, ok := roomCodes[strings.ToUpper(strings.TrimSpace(code))]
 	gamesMu.RUnlock()
+	if !ok {
+		return nil, ErrGameNotFound
+	}
+	return lookupGame(id)
+}
+
+// releaseRoomCodeLocked frees game's room code for reuse. The caller must
+// hold gamesMu.
+func releaseRoomCodeLocked(game *OnlineGame) {
+	if game.Code != "" && roomCodes[game.Code] == game.ID {
+		delete(roomCodes, game.Code)
+	}
+}
+
+// lookupGame returns the active online game with the given ID.
+func lookupGame(id string) (*OnlineGame, error) {
+	gamesMu.RLock()
+	defer gamesMu.RUnlock()
+	game, exists := games[id]
 	if !exists {
-		http.Error(w, "Game not found", http.StatusNotFound)
-		return
+		return nil, ErrGameNotFound
+	}
+	return game, nil
+}
+
+// APIError is the body of every error response: {"error": {"code", "message"}}.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeJSONError writes a JSON error with a stable machine-readable code.
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]APIError{"error": {Code: code, Message: message}})
+}
+
+// writeDatabaseError reports a failed DynamoDB read, with 503 when it timed out.
+func writeDatabaseError(w http.ResponseWriter, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeJSONError(w, http.StatusServiceUnavailable, "DATABASE_TIMEOUT", "Database timed out")
+		return
+	}
+	writeJSONError(w, http.StatusInternalServerError, "DATABASE_ERROR", "Database error")
+}
+
+// writeGameError translates game lookup errors into HTTP responses.
+func writeGameError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrGameNotFound) {
+		writeJSONError(w, http.StatusNotFound, "GAME_NOT_FOUND", "Game not found")
+		return
+	}
+	if errors.Is(err, ErrNotPlayer) {
+		writeJSONError(w, http.StatusForbidden, "NOT_A_PLAYER", "Not a player in this game")
+		return
+	}
+	if errors.Is(err, ErrGameNotPlaying) {
+		writeJSONError(w, http.StatusConflict, "GAME_NOT_PLAYING", "Game not in progress")
+		return
+	}
+	writeJSONError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
+}
+
+// Online game handlers
+func createGameHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	var req struct {
+		Player1  string `json:"player1"`
+		Size     int    `json:"size"`
+		RoomCode bool   `json:"roomCode"`
+		BestOf   int    `json:"bestOf"`
+		Password string `json:"password"`
+		// Synthetic is set by the synthetic monitor so its games stay out of stats
+		Synthetic bool `json:"synthetic"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Player1 == "" {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_PLAYER_NAME", "player1 required")
+		return
+	}
+	if req.Size == 0 {
+		req.Size = 3
+	}
+	if req.Size < 3 || req.Size > 5 {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_REQUEST", "size must be 3, 4 or 5")
+		return
+	}
+	if req.BestOf < 0 || req.BestOf > 9 || (req.BestOf > 1 && req.BestOf%2 == 0) {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_REQUEST", "bestOf must be an odd number up to 9")
+		return
+	}
+	player1, err := validatePlayerName(req.Player1)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_PLAYER_NAME", err.Error())
+		return
+	}
+	var passwordHash []byte
+	if req.Password != "" {
+		if passwordHash, err = bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "INVALID_REQUEST", "password must be at most 72 bytes")
+			return
+		}
+	}
+	if atGameCapacity() {
+		gamesRejectedCapacity.Inc()
+		w.Header().Set("Retry-After", "30")
+		writeJSONError(w, http.StatusServiceUnavailable, "SERVER_AT_CAPACITY", "Too many active games, please try again shortly")
+		return
+	}
+	game := newOnlineGame(player1, coinFlip(), req.Size, req.RoomCode)
+	resp := map[string]string{"gameId": game.ID, "firstPlayer": game.FirstPlayer}
+	if game.Code != "" {
+		resp["code"] = game.Code
+	}
+	game.mu.Lock()
+	resp["playerKey"] = game.issueSeatKeyLocked(player1)
+	game.synthetic = req.Synthetic
+	if req.BestOf > 1 {
+		game.Series = &Series{ID: uuid.New().String()[:8], BestOf: req.BestOf, Game: 1}
+		resp["seriesId"] = game.Series.ID
+	}
+	if passwordHash != nil {
+		game.passwordHash = passwordHash
+		resp["token"] = game.issueTokenLocked(player1)
+	}
+	game.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// issueTokenLocked returns a new one-time WebSocket token for player in a
+// password game. The caller must hold g.mu.
+func (g *OnlineGame) issueTokenLocked(player string) string {
+	if g.wsTokens == nil {
+		g.wsTokens = make(map[string]string)
+	}
+	token := uuid.New().String()
+	g.wsTokens[token] = player
+	return token
+}
+
+// issueSeatKeyLocked returns a new secret binding the caller to player's
+// seat. The caller must hold g.mu.
+func (g *OnlineGame) issueSeatKeyLocked(player string) string {
+	if g.seatKeys == nil {
+		g.seatKeys = make(map[string]string)
+	}
+	key := uuid.New().String()
+	g.seatKeys[player] = key
+	return key
+}
+
+// seatAuthorizedLocked reports whether key is player's seat key. The caller
+// must hold g.mu.
+func (g *OnlineGame) seatAuthorizedLocked(player, key string) bool {
+	want, ok := g.seatKeys[player]
+	return ok && player != "" && subtle.ConstantTimeCompare([]byte(key), []byte(want)) == 1
+}
+
+// passwordMatches reports whether password opens game; games without a
+// password accept anything. bcrypt is deliberately slow, so the hash is
+// compared outside the lock.
+func passwordMatches(game *OnlineGame, password string) bool {
+	game.mu.Lock()
+	passwordHash := game.passwordHash
+	game.mu.Unlock()
+	return passwordHash == nil || bcrypt.CompareHashAndPassword(passwordHash, []byte(password)) == nil
+}
+
+// snapshotGames copies the games map's values under gamesMu.RLock so callers
+// can walk every game without holding gamesMu. Game fields are still guarded
+// by each game's mu, which must be taken after gamesMu is released to keep
+// the game.mu -> gamesMu lock order.
+func snapshotGames() []*OnlineGame {
+	gamesMu.RLock()
+	defer gamesMu.RUnlock()
+	snapshot := make([]*OnlineGame, 0, len(games))
+	for _, game := range games {
+		snapshot = append(snapshot, game)
+	}
+	return snapshot
+}
+
+// activeGameCount returns how many online games are waiting or in progress.
+func activeGameCount() int {
+	n := 0
+	for _, game := range snapshotGames() {
+		game.mu.Lock()
+		if game.Status == "waiting" || game.Status == "playing" {
+			n++
+		}
+		game.mu.Unlock()
+	}
+	return n
+}
+
+// DebugGame is the in-memory view of one online game for /api/debug/games.
+type DebugGame struct {
+	ID         string    `json:"id"`
+	Status     string    `json:"status"`
+	Player1    string    `json:"player1"`
+	Player2    string    `json:"player2"`
+	ConnCount  int       `json:"connCount"` // player and spectator connections
+	CreatedAt  time.Time `json:"createdAt"`
+	AgeSeconds int64     `json:"ageSeconds"`
+}
+
+// debugGamesHandler lists every game in memory, oldest first, so stuck games
+// and leaked connections can be spotted without going to DynamoDB.
+func debugGamesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	if !adminAuthorized(w, r) {
+		return
+	}
+	snapshot := snapshotGames()
+	now := time.Now()
+	list := make([]DebugGame, 0, len(snapshot))
+	for _, game := range snapshot {
+		game.mu.Lock()
+		list = append(list, DebugGame{
+			ID:         game.ID,
+			Status:     game.Status,
+			Player1:    game.Player1,
+			Player2:    game.Player2,
+			ConnCount:  len(game.Conns) + len(game.Spectators),
+			CreatedAt:  game.CreatedAt,
+			AgeSeconds: int64(now.Sub(game.CreatedAt).Seconds()),
+		})
+		game.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// atGameCapacity reports whether MAX_ACTIVE_GAMES has been reached, expiring
+// stale waiting games first so abandoned ones don't hold slots until the
+// janitor's next tick.
+func atGameCapacity() bool {
+	if maxActiveGames <= 0 || activeGameCount() < maxActiveGames {
+		return false
+	}
+	expireWaitingGames(time.Now().Add(-waitingGameTTL))
+	return activeGameCount() >= maxActiveGames
+}
+
+// atGameCapacityLocked is atGameCapacity for a caller holding held.mu, such as
+// a series starting its next game. held is not counted, and other games' locks
+// are only tried since waiting could deadlock against a game doing the same,
+// so a game busy at that moment counts as active. Stale waiting games are left
+// to the janitor.
+func atGameCapacityLocked(held *OnlineGame) bool {
+	if maxActiveGames <= 0 {
+		return false
+	}
+	n := 0
+	for _, game := range snapshotGames() {
+		if game == held {
+			continue
+		}
+		if !game.mu.TryLock() {
+			n++
+			continue
+		}
+		if game.Status == "waiting" || game.Status == "playing" {
+			n++
+		}
+		game.mu.Unlock()
+	}
+	return n >= maxActiveGames
+}
+
+// coinFlip picks the mark that moves first in a new game.
+func coinFlip() string {
+	firstPlayerMu.Lock()
+	defer firstPlayerMu.Unlock()
+	if firstPlayerRand.Intn(2) == 1 {
+		return "O"
+	}
+	return "X"
+}
+
+// roomCodeAlphabet leaves out O, 0, I and 1, which are easy to mix up.
+const roomCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// newRoomCodeLocked returns a 4-character room code not already in use.
+// The caller must hold gamesMu.
+func newRoomCodeLocked() string {
+	code := make([]byte, 4)
+	for {
+		for i := range code {
+			code[i] = roomCodeAlphabet[rand.Intn(len(roomCodeAlphabet))]
+		}
+		if _, taken := roomCodes[string(code)]; !taken {
+			return string(code)
+		}
+	}
+}
+
+// newOnlineGame registers a new size x size game waiting for a second player,
+// optionally with a room code it can be joined by until it starts.
+func newOnlineGame(player1, firstPlayer string, size int, roomCode bool) *OnlineGame {
+	game := &OnlineGame{
+		ID:          uuid.New().String()[:8],
+		Size:        size,
+		Board:       make([]string, size*size),
+		Turn:        firstPlayer,
+		FirstPlayer: firstPlayer,
+		Player1:     player1,
+		Status:      "waiting",
+		CreatedAt:   time.Now(),
+	}
+	gamesMu.Lock()
+	if roomCode {
+		game.Code = newRoomCodeLocked()
+		roomCodes[game.Code] = game.ID
+	}
+	games[game.ID] = game
+	gamesMu.Unlock()
+	onlineGamesCreated.Inc()
+	onlineGamesActive.Inc()
+	return game
+}
+
+// runJanitor expires waiting games that nobody joined within waitingGameTTL.
+func runJanitor() {
+	ticker := time.NewTicker(time.Minute)
+	for range ticker.C {
+		if n := expireWaitingGames(time.Now().Add(-waitingGameTTL)); n > 0 {
+			log.Printf("Expired %d waiting games", n)
+		}
+	}
+}
+
+// expireWaitingGames removes waiting games created before cutoff and closes
+// their connections, returning how many were expired.
+func expireWaitingGames(cutoff time.Time) int {
+	expired := 0
+	for _, game := range snapshotGames() {
+		game.mu.Lock()
+		if game.Status == "waiting" && game.CreatedAt.Before(cutoff) {
+			game.closeWaitingLocked("expired")
+			onlineGamesExpired.Inc()
+			expired++
+		}
+		game.mu.Unlock()
+	}
+	return expired
+}
+
+// closeWaitingLocked ends a game nobody joined with the given status, closing
+// its connections and forgetting it, and counts it as abandoned whether it
+// expired or its creator cancelled it. The caller must hold g.mu.
+func (g *OnlineGame) closeWaitingLocked(status string) {
+	g.Status = status
+	g.bumpVersionLocked()
+	for _, c := range g.Conns {
+		c.close()
+	}
+	for _, c := range g.Spectators {
+		c.close()
+	}
+	gamesMu.Lock()
+	delete(games, g.ID)
+	releaseRoomCodeLocked(g)
+	gamesMu.Unlock()
+	onlineGamesActive.Dec()
+	onlineGamesAbandoned.Inc()
+}
+
+// rematchHandler starts a new game between the players of a finished game with
+// the first move swapped. If both players are still connected the new game
+// starts immediately, otherwise it waits for the opponent to join again. Only
+// a player holding their playerKey (and the password of a private game) can
+// ask, and the rematch keeps the same keys and password.
+func rematchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	var req struct {
+		GameID    string `json:"gameId"`
+		Player    string `json:"player"`
+		PlayerKey string `json:"playerKey"`
+		Password  string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_JSON", err.Error())
+		return
+	}
+	old, err := lookupGame(req.GameID)
+	if err != nil {
+		writeGameError(w, err)
+		return
+	}
+	if !passwordMatches(old, req.Password) {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_PASSWORD", "Wrong password")
+		return
+	}
+	// atGameCapacity locks every game, so check it before taking old.mu
+	old.mu.Lock()
+	started := old.RematchID != ""
+	old.mu.Unlock()
+	if !started && atGameCapacity() {
+		gamesRejectedCapacity.Inc()
+		w.Header().Set("Retry-After", "30")
+		writeJSONError(w, http.StatusServiceUnavailable, "SERVER_AT_CAPACITY", "Too many active games, please try again shortly")
+		return
+	}
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	if !old.seatAuthorizedLocked(req.Player, req.PlayerKey) {
+		writeJSONError(w, http.StatusForbidden, "FORBIDDEN", "Invalid player key")
+		return
+	}
+	if old.Status != "finished" {
+		writeJSONError(w, http.StatusBadRequest, "GAME_NOT_FINISHED", "Game not finished")
+		return
+	}
+	if old.RematchID == "" {
+		firstPlayer := "X"
+		if old.FirstPlayer == "X" {
+			firstPlayer = "O"
+		}
+		game := newOnlineGame(old.Player1, firstPlayer, old.Size, false)
+		game.mu.Lock()
+		game.synthetic = old.synthetic
+		game.seatKeys = maps.Clone(old.seatKeys)
+		game.passwordHash = old.passwordHash
+		// Start at once only if both players' own sockets are open; Conns
+		// also holds unbound and duplicate connections
+		if old.playerConns[old.Player1] != nil && old.playerConns[old.Player2] != nil {
+			game.Player2 = old.Player2
+			game.Status = "playing"
+			game.StartedAt = time.Now()
+			game.resetTurnTimerLocked()
+		}
+		game.mu.Unlock()
+		old.RematchID = game.ID
+		old.broadcastLocked(WSMessage{Type: "rematch_ready", Payload: map[string]string{"gameId": game.ID, "firstPlayer": firstPlayer}})
+	}
+	game, err := lookupGame(old.RematchID)
+	if err != nil {
+		writeGameError(w, err)
+		return
+	}
+	game.mu.Lock()
+	state := game.toJSON()
+	game.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+func joinGameHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	var req struct {
+		GameID   string `json:"gameId"`
+		Code     string `json:"code"`
+		Player2  string `json:"player2"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		joinAttempts.WithLabelValues("bad_request").Inc()
+		writeJSONError(w, http.StatusBadRequest, "INVALID_JSON", err.Error())
+		return
+	}
+	player2, err := validatePlayerName(req.Player2)
+	if err != nil {
+		joinAttempts.WithLabelValues("bad_request").Inc()
+		writeJSONError(w, http.StatusBadRequest, "INVALID_PLAYER_NAME", err.Error())
+		return
+	}
+	var game *OnlineGame
+	if req.GameID == "" && req.Code != "" {
+		game, err = lookupGameByCode(req.Code)
+	} else {
+		game, err = lookupGame(req.GameID)
+	}
+	if err != nil {
+		if errors.Is(err, ErrGameNotFound) {
+			joinAttempts.WithLabelValues("not_found").Inc()
+		} else {
+			joinAttempts.WithLabelValues("bad_request").Inc()
+		}
+		writeGameError(w, err)
+		return
+	}
+	if !passwordMatches(game, req.Password) {
+		joinAttempts.WithLabelValues("bad_request").Inc()
+		writeJSONError(w, http.StatusBadRequest, "INVALID_PASSWORD", "Wrong password")
+		return
+	}
+	game.mu.Lock()
+	if game.Status != "waiting" {
+		game.mu.Unlock()
+		joinAttempts.WithLabelValues("already_started").Inc()
+		writeJSONError(w, http.StatusBadRequest, "GAME_ALREADY_STARTED", "Game already started")
+		return
+	}
+	lobbyWait.Observe(time.Since(game.CreatedAt).Seconds())
+	game.Player2 = player2
+	game.Status = "playing"
+	game.bumpVersionLocked()
+	game.StartedAt = time.Now()
+	game.resetTurnTimerLocked()
+	gamesMu.Lock()
+	releaseRoomCodeLocked(game)
+	gamesMu.Unlock()
+	state := game.toJSON()
+	game.broadcastLocked(WSMessage{Type: "game_start", Payload: state})
+	// Only the joining player sees their key and token, not the broadcast
+	state["playerKey"] = game.issueSeatKeyLocked(player2)
+	if game.passwordHash != nil {
+		state["token"] = game.issueTokenLocked(player2)
+	}
+	game.mu.Unlock()
+	joinAttempts.WithLabelValues("ok").Inc()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// leaveGameHandler resigns player from a game in progress; the opponent wins.
+// The creator of a game nobody has joined yet cancels it instead. The caller
+// proves the seat is theirs with its playerKey.
+func leaveGameHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	var req struct {
+		GameID    string `json:"gameId"`
+		Player    string `json:"player"`
+		PlayerKey string `json:"playerKey"`
+		Password  string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_JSON", err.Error())
+		return
+	}
+	game, err := lookupGame(req.GameID)
+	if err != nil {
+		writeGameError(w, err)
+		return
+	}
+	if !passwordMatches(game, req.Password) {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_PASSWORD", "Wrong password")
+		return
+	}
+	player := strings.TrimSpace(req.Player)
+	game.mu.Lock()
+	if !game.seatAuthorizedLocked(player, req.PlayerKey) {
+		game.mu.Unlock()
+		writeJSONError(w, http.StatusForbidden, "FORBIDDEN", "Invalid player key")
+		return
+	}
+	if game.Status == "waiting" && player != "" && player == game.Player1 {
+		game.closeWaitingLocked("cancelled")
+	} else {
+		err = game.resignLocked(player)
+	}
+	state := game.toJSON()
+	game.mu.Unlock()
+	if err != nil {
+		writeGameError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// moveHandler plays a move over plain HTTP for clients behind proxies that
+// block WebSockets; they poll /api/game/get for the opponent's moves while
+// WebSocket clients in the game get the usual broadcast. Private games need
+// the game password.
+func moveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	var req struct {
+		GameID    string `json:"gameId"`
+		Player    string `json:"player"`
+		PlayerKey string `json:"playerKey"`
+		Index     *int   `json:"index"`
+		Password  string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_JSON", err.Error())
+		return
+	}
+	if req.Index == nil {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_REQUEST", "index is required")
+		return
+	}
+	game, err := lookupGame(req.GameID)
+	if err != nil {
+		writeGameError(w, err)
+		return
+	}
+	game.mu.Lock()
+	demo := game.demo != ""
+	game.mu.Unlock()
+	if demo {
+		writeGameError(w, ErrNotPlayer)
+		return
+	}
+	if !passwordMatches(game, req.Password) {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_PASSWORD", "Wrong password")
+		return
+	}
+
+	game.mu.Lock()
+	if !game.seatAuthorizedLocked(req.Player, req.PlayerKey) {
+		game.mu.Unlock()
+		writeJSONError(w, http.StatusForbidden, "FORBIDDEN", "Invalid player key")
+		return
+	}
+	if err := validateMove(game.Board, game.Status, game.Turn, req.Player, game.Player1, game.Player2, *req.Index); err != nil {
+		game.mu.Unlock()
+		movesRejected.WithLabelValues(moveRejectReasons[err]).Inc()
+		writeJSONError(w, http.StatusConflict, "ILLEGAL_MOVE", err.Error())
+		return
+	}
+	game.applyMoveLocked(req.Player, *req.Index)
+	state := game.toJSON()
+	game.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// getGameHandler returns a game's state. With ?waitForVersion=N it long
+// polls: the response waits until the version passes N or ?timeout= seconds
+// (default 25, at most maxLongPoll) elapse, then returns the current state.
+func getGameHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	waitFor, timeout, err := parseLongPoll(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_PARAMETER", err.Error())
+		return
+	}
+	game, err := lookupGame(r.URL.Query().Get("id"))
+	if err != nil {
+		writeGameError(w, err)
+		return
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	game.mu.Lock()
+wait:
+	for game.Version <= waitFor {
+		changed := game.changedLocked()
+		game.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline.C:
+			game.mu.Lock()
+			break wait
+		case <-shuttingDown:
+			game.mu.Lock()
+			break wait
+		case <-r.Context().Done():
+			return
+		}
+		game.mu.Lock()
+	}
+	state := game.toJSON()
+	game.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// parseLongPoll reads ?waitForVersion= and ?timeout= for getGameHandler.
+// Without waitForVersion the returned version is -1, so nothing waits.
+func parseLongPoll(r *http.Request) (waitFor int, timeout time.Duration, err error) {
+	waitFor, timeout = -1, 25*time.Second
+	if v := r.URL.Query().Get("waitForVersion"); v != "" {
+		if waitFor, err = strconv.Atoi(v); err != nil || waitFor < 0 {
+			return 0, 0, errors.New("Invalid waitForVersion")
+		}
+	}
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs < 0 {
+			return 0, 0, errors.New("Invalid timeout")
+		}
+		timeout = time.Duration(secs) * time.Second
+	}
+	if timeout > maxLongPoll {
+		timeout = maxLongPoll
+	}
+	return waitFor, timeout, nil
+}
+
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	game, err := lookupGame(r.URL.Query().Get("id"))
+	if err != nil {
+		writeGameError(w, err)
+		return
+	}
+	spectator := r.URL.Query().Get("spectator") == "true"
+	player := r.URL.Query().Get("player")
+	// A one-time token or the player's seat key binds the connection to a
+	// seat; password games only accept bound connections
+	token := r.URL.Query().Get("token")
+	game.mu.Lock()
+	private := game.passwordHash != nil
+	tokenPlayer, ok := game.wsTokens[token]
+	delete(game.wsTokens, token)
+	if ok {
+		player = tokenPlayer
+	}
+	bound := ok || game.seatAuthorizedLocked(player, r.URL.Query().Get("key"))
+	if game.demo != "" {
+		spectator = true
+	}
+	game.mu.Unlock()
+	if private && (!bound || spectator) {
+		writeJSONError(w, http.StatusForbidden, "FORBIDDEN", "Invalid or used token")
+		return
+	}
+	wsDrain.Add(1)
+	defer wsDrain.Done()
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	conn.SetReadLimit(wsMaxMessageBytes)
+	wsConnectionsActive.Inc()
+	client := newWSClient(conn)
+	if bound && !spectator {
+		client.player = player
+	}
+	game.mu.Lock()
+	if spectator {
+		game.Spectators = append(game.Spectators, client)
+		onlineSpectatorsActive.Inc()
+	} else {
+		game.Conns = append(game.Conns, client)
+	}
+	client.queue(encodeWS(WSMessage{Type: "game_state", Payload: game.toJSON()}))
+	if private {
+		// A fresh token lets the player reconnect after this connection drops
+		client.queue(encodeWS(WSMessage{Type: "reconnect_token", Payload: map[string]string{"token": game.issueTokenLocked(player)}}))
+	}
+	// Only a bound connection may take over a seat's socket; otherwise anyone
+	// could disconnect a player by dialling with their name
+	if client.player != "" {
+		game.attachPlayerLocked(player, client)
+	}
+	game.mu.Unlock()
+	wsMessagesTotal.WithLabelValues("game_state", "out").Inc()
+	stopKeepAlive := keepAlive(conn, wsPongWait, wsPingPeriod)
+	defer func() {
+		stopKeepAlive()
+		wsConnectionsActive.Dec()
+		client.close()
+		game.mu.Lock()
+		if spectator {
+			game.Spectators = removeClient(game.Spectators, client)
+			onlineSpectatorsActive.Dec()
+		} else {
+			game.Conns = removeClient(game.Conns, client)
+			if game.playerConns[player] == client {
+				delete(game.playerConns, player)
+			}
+		}
+		delete(game.deltaConns, client)
+		game.mu.Unlock()
+	}()
+	var lastChat time.Time
+	for {
+		var msg WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			break
+		}
+		wsMessagesTotal.WithLabelValues(msg.Type, "in").Inc()
+		if msg.Type == "subscribe" {
+			// {"mode": "delta"} switches this connection to move_delta updates
+			payload, _ := msg.Payload.(map[string]interface{})
+			mode, _ := payload["mode"].(string)
+			game.mu.Lock()
+			if mode == "delta" {
+				if game.deltaConns == nil {
+					game.deltaConns = make(map[*wsClient]bool)
+				}
+				game.deltaConns[client] = true
+			} else {
+				delete(game.deltaConns, client)
+			}
+			game.mu.Unlock()
+			continue
+		}
+		if msg.Type == "get_moves" {
+			// Answered to this connection only; encoded under game.mu so the
+			// moves can't change while being marshalled
+			game.mu.Lock()
+			client.queue(encodeWS(WSMessage{Type: "moves_history", Payload: map[string]interface{}{"version": game.Version, "moves": game.Moves}}))
+			game.mu.Unlock()
+			wsMessagesTotal.WithLabelValues("moves_history", "out").Inc()
+			continue
+		}
+		if msg.Type == "chat" {
+			// Chat is rate-limited per connection here; handleMessage validates the sender
+			if !chatEnabled || spectator || time.Since(lastChat) < chatMinInterval {
+				wsMessagesTotal.WithLabelValues("chat", "dropped").Inc()
+				continue
+			}
+			lastChat = time.Now()
+		}
+		// Spectators are read-only
+		if spectator {
+			continue
+		}
+		// Only a connection bound to a seat may resign it, and a bound
+		// connection can't act for the other player
+		if (msg.Type == "resign" && client.player == "") || (seatMessages[msg.Type] && client.player != "" && payloadPlayer(msg) != client.player) {
+			wsMessagesTotal.WithLabelValues(msg.Type, "dropped").Inc()
+			continue
+		}
+		game.handleMessage(msg)
+	}
+}
+
+// shutdownGames tells every connected client the server is going away and
+// persists games still in progress as interrupted, waiting for the writes
+// until ctx is done.
+func shutdownGames(ctx context.Context) {
+	for _, game := range snapshotGames() {
+		game.mu.Lock()
+		game.broadcastLocked(WSMessage{Type: "server_shutdown"})
+		if game.Status == "playing" {
+			if game.turnTimer != nil {
+				game.turnTimer.Stop()
+			}
+			game.Status = "interrupted"
+			game.bumpVersionLocked()
+			onlineGamesActive.Dec()
+			game.persistLocked(saveOnlineGameToDynamoDB)
+		}
+		game.mu.Unlock()
+	}
+	saved := make(chan struct{})
+	go func() {
+		pendingSaves.Wait()
+		close(saved)
+	}()
+	select {
+	case <-saved:
+	case <-ctx.Done():
+		log.Println("Timed out waiting for game saves to finish")
+	}
+}
+
+// keepAlive pings conn every pingPeriod until the returned stop function is
+// called. Each pong extends the read deadline by pongWait, so a dead peer
+// makes the next read fail and ends the caller's read loop.
+func keepAlive(conn *websocket.Conn, pongWait, pingPeriod time.Duration) (stop func()) {
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pongWait)); err != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// attachPlayerLocked records conn as player's connection when they are in the
+// game. A player seen before is announced as player_reconnected rather than
+// player_joined, and any connection they left behind (e.g. before a page
+// refresh) is closed. The caller must hold g.mu.
+func (g *OnlineGame) attachPlayerLocked(player string, client *wsClient) {
+	if player == "" || (player != g.Player1 && player != g.Player2) {
+		return
+	}
+	if g.playerConns == nil {
+		g.playerConns = make(map[string]*wsClient)
+		g.seen = make(map[string]bool)
+	}
+	if old := g.playerConns[player]; old != nil {
+		old.close()
+	}
+	g.playerConns[player] = client
+	event := "player_joined"
+	if g.seen[player] {
+		event = "player_reconnected"
+	}
+	g.seen[player] = true
+	g.broadcastLocked(WSMessage{Type: event, Payload: map[string]string{"player": player}})
+}
+
+func removeClient(clients []*wsClient, client *wsClient) []*wsClient {
+	for i, c := range clients {
+		if c == client {
+			return append(clients[:i], clients[i+1:]...)
+		}
+	}
+	return clients
+}
+
+// wsClient is a game WebSocket connection with its own writer goroutine.
+// Messages are queued without blocking, so a slow or stalled client can't
+// hold up broadcasts (or g.mu) for everyone else.
+type wsClient struct {
+	// player is the seat this connection proved with a token or seat key,
+	// empty for unbound connections
+	player    string
+	conn      *websocket.Conn
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newWSClient(conn *websocket.Conn) *wsClient {
+	c := &wsClient{conn: conn, send: make(chan []byte, wsSendBuffer), done: make(chan struct{})}
+	go c.writeLoop()
+	return c
+}
+
+func (c *wsClient) writeLoop() {
+	for {
+		select {
+		case data := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// queue hands data to the writer goroutine. A client whose buffer is full
+// has fallen too far behind and is disconnected instead.
+func (c *wsClient) queue(data []byte) {
+	select {
+	case <-c.done:
+	case c.send <- data:
+	default:
+		wsSlowClientsClosed.Inc()
+		c.close()
+	}
+}
+
+// close stops the writer and closes the connection, which also ends the
+// read loop in wsHandler. Safe to call more than once.
+func (c *wsClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// encodeWS marshals msg once so it can be queued to many clients; callers
+// encode under g.mu because payloads may reference live game state.
+func encodeWS(msg WSMessage) []byte {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to encode %s message: %v", msg.Type, err)
+	}
+	return data
+}
+
+// parseChat validates a chat payload ({"player": ..., "text": ...}), stripping
+// control characters and enforcing chatMaxLength on the text. The older
+// "name" key is still accepted in place of "player".
+func parseChat(payload interface{}) (map[string]interface{}, bool) {
+	p, ok := payload.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	name, _ := p["player"].(string)
+	if name == "" {
+		name, _ = p["name"].(string)
+	}
+	text, _ := p["text"].(string)
+	name = strings.TrimSpace(stripControl(name))
+	text = strings.TrimSpace(stripControl(text))
+	if name == "" || text == "" || len([]rune(text)) > chatMaxLength || len([]rune(name)) > 32 {
+		return nil, false
+	}
+	return map[string]interface{}{"player": name, "text": text, "time": time.Now().UnixMilli()}, true
+}
+
+func stripControl(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func (g *OnlineGame) toJSON() map[string]interface{} {
+	state := map[string]interface{}{
+		"id": g.ID, "size": g.Size, "board": g.Board, "turn": g.Turn, "firstPlayer": g.FirstPlayer,
+		"player1": g.Player1, "player2": g.Player2,
+		"status": g.Status, "winner": g.Winner, "pattern": g.Pattern, "isTie": g.Status == "finished" && g.Winner == "",
+		"spectators": len(g.Spectators), "version": g.Version,
+	}
+	if g.Series != nil {
+		state["series"] = *g.Series
+	}
+	return state
+}
+
+func (g *OnlineGame) broadcast(msg WSMessage) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.broadcastLocked(msg)
+}
+
+// broadcastMoveLocked announces a move that didn't end the game: connections
+// subscribed to deltas get a small move_delta, the rest the full game_state.
+func (g *OnlineGame) broadcastMoveLocked(m Move) {
+	full := encodeWS(WSMessage{Type: "game_state", Payload: g.toJSON()})
+	delta := encodeWS(WSMessage{Type: "move_delta", Payload: map[string]interface{}{
+		"version": g.Version, "index": m.Index, "mark": m.Player, "turn": g.Turn, "status": g.Status,
+	}})
+	for _, clients := range [][]*wsClient{g.Conns, g.Spectators} {
+		for _, c := range clients {
+			if g.deltaConns[c] {
+				wsMessagesTotal.WithLabelValues("move_delta", "out").Inc()
+				c.queue(delta)
+			} else {
+				wsMessagesTotal.WithLabelValues("game_state", "out").Inc()
+				c.queue(full)
+			}
+		}
+	}
+}
+
+// broadcastLocked sends msg to every player and spectator; the caller must hold g.mu.
+func (g *OnlineGame) broadcastLocked(msg WSMessage) {
+	wsMessagesTotal.WithLabelValues(msg.Type, "out").Add(float64(len(g.Conns) + len(g.Spectators)))
+	data := encodeWS(msg)
+	for _, c := range g.Conns {
+		c.queue(data)
+	}
+	for _, c := range g.Spectators {
+		c.queue(data)
+	}
+}
+
+// seatMessages are the game messages that act for the "player" they name.
+var seatMessages = map[string]bool{"move": true, "resign": true, "takeback_request": true, "takeback_accept": true, "chat": true}
+
+// payloadPlayer returns the "player" a game message claims to come from.
+func payloadPlayer(msg WSMessage) string {
+	payload, _ := msg.Payload.(map[string]interface{})
+	player, _ := payload["player"].(string)
+	return player
+}
+
+func (g *OnlineGame) handleMessage(msg WSMessage) {
+	if msg.Type == "reaction" {
+		g.broadcast(msg)
+		return
+	}
+	if msg.Type == "chat" {
+		g.handleChat(msg)
+		return
+	}
+	if msg.Type == "takeback_request" || msg.Type == "takeback_accept" {
+		g.handleTakeback(msg)
+		return
+	}
+	if msg.Type == "resign" {
+		payload, _ := msg.Payload.(map[string]interface{})
+		player, _ := payload["player"].(string)
+		g.mu.Lock()
+		g.resignLocked(player)
+		g.mu.Unlock()
+		return
+	}
+	if msg.Type != "move" {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		wsMessagesTotal.WithLabelValues("move", "invalid").Inc()
+		return
+	}
+	index, ok := payload["index"].(float64)
+	if !ok {
+		wsMessagesTotal.WithLabelValues("move", "invalid").Inc()
+		return
+	}
+	player, ok := payload["player"].(string)
+	if !ok {
+		wsMessagesTotal.WithLabelValues("move", "invalid").Inc()
+		return
+	}
+	idx := int(index)
+	// Checked under g.mu, so a move re-sent after the game ended (e.g. both
+	// clients racing for the winning cell) is dropped here
+	if err := validateMove(g.Board, g.Status, g.Turn, player, g.Player1, g.Player2, idx); err != nil {
+		movesRejected.WithLabelValues(moveRejectReasons[err]).Inc()
+		return
+	}
+	g.applyMoveLocked(player, idx)
+}
+
+// bumpVersionLocked records a state change and wakes any long polls waiting
+// on it. The caller must hold g.mu.
+func (g *OnlineGame) bumpVersionLocked() {
+	g.Version++
+	if g.changed != nil {
+		close(g.changed)
+		g.changed = nil
+	}
+}
+
+// changedLocked returns a channel closed on the next version bump. The
+// caller must hold g.mu.
+func (g *OnlineGame) changedLocked() <-chan struct{} {
+	if g.changed == nil {
+		g.changed = make(chan struct{})
+	}
+	return g.changed
+}
+
+// applyMoveLocked plays a validated move for player at idx, then finishes the
+// game or passes the turn. The caller must hold g.mu.
+func (g *OnlineGame) applyMoveLocked(player string, idx int) {
+	g.Board[idx] = g.Turn
+	g.bumpVersionLocked()
+
+	// Record move with timestamp
+	moveTime := int64(0)
+	if !g.StartedAt.IsZero() {
+		moveTime = time.Since(g.StartedAt).Milliseconds()
+	}
+	g.Moves = append(g.Moves, Move{Index: idx, Player: g.Turn, Time: moveTime})
+	g.takeback = ""
+	g.saveMovesLocked(g.Moves[len(g.Moves)-1:], false)
+
+	if mark, pattern := checkWinSize(g.Board, g.Size); mark != "" {
+		g.Winner = player
+		g.Pattern = pattern
+		g.finishLocked("game_state")
+		return
+	}
+	if isBoardFull(g.Board) {
+		g.finishLocked("game_state")
+		return
+	}
+	if g.Turn == "X" {
+		g.Turn = "O"
+	} else {
+		g.Turn = "X"
+	}
+	g.resetTurnTimerLocked()
+	g.broadcastMoveLocked(g.Moves[len(g.Moves)-1])
+}
+
+// handleChat relays a chat line from one of the two players to everyone in
+// the game, stamped with the server time. Chat is never persisted.
+func (g *OnlineGame) handleChat(msg WSMessage) {
+	chat, ok := parseChat(msg.Payload)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !ok || (chat["player"] != g.Player1 && chat["player"] != g.Player2) {
+		wsMessagesTotal.WithLabelValues("chat", "dropped").Inc()
+		return
+	}
+	g.broadcastLocked(WSMessage{Type: "chat", Payload: chat})
+}
+
+// handleTakeback lets the player who just moved ask to undo that move with
+// takeback_request; if the opponent answers takeback_accept, the move is
+// popped and the turn handed back.
+func (g *OnlineGame) handleTakeback(msg WSMessage) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	payload, _ := msg.Payload.(map[string]interface{})
+	player, _ := payload["player"].(string)
+	if g.Status != "playing" || len(g.Moves) == 0 || player == "" {
+		return
+	}
+	turnPlayer, lastMover := g.Player1, g.Player2
+	if g.Turn == "O" {
+		turnPlayer, lastMover = g.Player2, g.Player1
+	}
+	switch msg.Type {
+	case "takeback_request":
+		if player != lastMover {
+			return
+		}
+		g.takeback = player
+		g.broadcastLocked(WSMessage{Type: "takeback_offer", Payload: map[string]string{"player": player}})
+	case "takeback_accept":
+		if player != turnPlayer || g.takeback != lastMover {
+			return
+		}
+		last := g.Moves[len(g.Moves)-1]
+		g.Moves = g.Moves[:len(g.Moves)-1]
+		g.Board[last.Index] = ""
+		g.Turn = last.Player
+		g.takeback = ""
+		g.bumpVersionLocked()
+		g.saveMovesLocked(g.Moves, true)
+		g.resetTurnTimerLocked()
+		g.broadcastLocked(WSMessage{Type: "game_state", Payload: g.toJSON()})
+	}
+}
+
+// resignLocked concedes the game for player, awarding it to the opponent with
+// pattern "resignation". The caller must hold g.mu.
+func (g *OnlineGame) resignLocked(player string) error {
+	if player == "" || (player != g.Player1 && player != g.Player2) {
+		return ErrNotPlayer
+	}
+	if g.Status != "playing" {
+		return ErrGameNotPlaying
+	}
+	g.Winner = g.Player1
+	if player == g.Player1 {
+		g.Winner = g.Player2
+	}
+	g.Pattern = "resignation"
+	g.finishLocked("game_state")
+	return nil
+}
+
+// finishLocked ends the game with the current Winner/Pattern (a tie when
+// Winner is empty), broadcasts the final state as msgType, and persists it.
+// The caller must hold g.mu.
+func (g *OnlineGame) finishLocked(msgType string) {
+	g.Status = "finished"
+	g.bumpVersionLocked()
+	if g.Series != nil {
+		series := g.Series.record(g.Winner, g.Player1, g.Player2)
+		g.Series = &series
+	}
+	if g.turnTimer != nil {
+		g.turnTimer.Stop()
+	}
+	mode := "online"
+	if g.demo != "" {
+		mode = "ai"
+	}
+	if !g.StartedAt.IsZero() {
+		gameDuration.WithLabelValues(mode).Observe(time.Since(g.StartedAt).Seconds())
+	}
+	movesPerGame.WithLabelValues(mode).Observe(float64(len(g.Moves)))
+	g.broadcastLocked(WSMessage{Type: msgType, Payload: g.toJSON()})
+	g.persistLocked(saveOnlineGameToDynamoDB)
+	result := GameResult{Player1: g.Player1, Player2: g.Player2, Winner: g.Winner, Pattern: g.Pattern, IsTie: g.Winner == "", Mode: mode, Difficulty: g.demo}
+	recordMetrics(result)
+	onlineGamesActive.Dec()
+	g.continueSeriesLocked()
+}
+
+// continueSeriesLocked starts the next game of a series that nobody has won
+// yet, with the first move swapped, and tells the players about the score in a
+// series_update. The caller must hold g.mu.
+func (g *OnlineGame) continueSeriesLocked() {
+	if g.Series == nil {
+		return
+	}
+	update := map[string]interface{}{"series": *g.Series}
+	if g.Series.Winner == "" && atGameCapacityLocked(g) {
+		gamesRejectedCapacity.Inc()
+		update["error"] = "SERVER_AT_CAPACITY"
+	} else if g.Series.Winner == "" {
+		firstPlayer := "X"
+		if g.FirstPlayer == "X" {
+			firstPlayer = "O"
+		}
+		next := newOnlineGame(g.Player1, firstPlayer, g.Size, false)
+		series := *g.Series
+		series.Game++
+		next.mu.Lock()
+		next.Series = &series
+		next.synthetic = g.synthetic
+		next.seatKeys = maps.Clone(g.seatKeys)
+		next.passwordHash = g.passwordHash
+		next.Player2 = g.Player2
+		next.Status = "playing"
+		next.StartedAt = time.Now()
+		next.resetTurnTimerLocked()
+		next.mu.Unlock()
+		g.RematchID = next.ID
+		update["nextGameId"] = next.ID
+		update["firstPlayer"] = firstPlayer
+	}
+	g.broadcastLocked(WSMessage{Type: "series_update", Payload: update})
+}
+
+// saveMovesLocked queues a live write of moves when PERSIST_MOVES_LIVE is
+// set; see saveLiveMoves. The caller must hold g.mu.
+func (g *OnlineGame) saveMovesLocked(moves []Move, replace bool) {
+	if !persistMovesLive || store == nil {
+		return
+	}
+	if g.savedAt == "" {
+		g.savedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	id, timestamp, player1, player2, size := g.ID, g.savedAt, g.Player1, g.Player2, g.Size
+	moves = append([]Move(nil), moves...)
+	g.persistLocked(func(*OnlineGame) {
+		saveLiveMoves(id, timestamp, player1, player2, size, moves, replace)
+	})
+}
+
+// persistLocked queues a DynamoDB write for the game. Writes run one at a
+// time in the order queued, so live moves can't land after the final save.
+// The caller must hold g.mu.
+func (g *OnlineGame) persistLocked(write func(*OnlineGame)) {
+	g.persistQ = append(g.persistQ, func() { write(g) })
+	if g.persisting {
+		return
+	}
+	g.persisting = true
+	pendingSaves.Add(1)
+	go func() {
+		defer pendingSaves.Done()
+		for {
+			g.mu.Lock()
+			if len(g.persistQ) == 0 {
+				g.persisting = false
+				g.mu.Unlock()
+				return
+			}
+			next := g.persistQ[0]
+			g.persistQ = g.persistQ[1:]
+			g.mu.Unlock()
+			// Wait for each write so the next one can't overtake it
+			done := make(chan struct{})
+			if queueSave("online game "+g.ID, func() {
+				defer close(done)
+				next()
+			}) {
+				<-done
+			}
+		}
+	}()
+}
+
+// resetTurnTimerLocked (re)starts the turn clock for the player to move.
+// The caller must hold g.mu.
+func (g *OnlineGame) resetTurnTimerLocked() {
+	if g.turnTimer != nil {
+		g.turnTimer.Stop()
+	}
+	// Demo games move on their own schedule
+	if turnTimeout <= 0 || g.demo != "" {
+		return
+	}
+	g.turnSeq++
+	seq := g.turnSeq
+	g.turnTimer = time.AfterFunc(turnTimeout, func() { g.forfeitTurn(seq) })
+}
+
+// forfeitTurn awards the game to the waiting player if the turn clock has not
+// been restarted since the timer with the given sequence number was set.
+func (g *OnlineGame) forfeitTurn(seq int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.Status != "playing" || g.turnSeq != seq {
+		return
+	}
+	g.Winner = g.Player2
+	if g.Turn == "O" {
+		g.Winner = g.Player1
+	}
+	g.Pattern = "timeout"
+	g.finishLocked("game_forfeit")
+}
+
+// checkWinSize returns the winning mark and pattern on a size x size board,
+// or empty strings if nobody has won. A win is a full row, column or diagonal
+// of one mark; patterns are named row1..rowN, col1..colN, diag1 and diag2.
+func checkWinSize(board []string, size int) (string, string) {
+	line := func(start, step int) string {
+		for i := 1; i < size; i++ {
+			if board[start+i*step] != board[start] {
+				return ""
+			}
+		}
+		return board[start]
+	}
+	for i := 0; i < size; i++ {
+		if mark := line(i*size, 1); mark != "" {
+			return mark, fmt.Sprintf("row%d", i+1)
+		}
+	}
+	for i := 0; i < size; i++ {
+		if mark := line(i, size); mark != "" {
+			return mark, fmt.Sprintf("col%d", i+1)
+		}
+	}
+	if mark := line(0, size+1); mark != "" {
+		return mark, "diag1"
+	}
+	if mark := line(size-1, size-1); mark != "" {
+		return mark, "diag2"
+	}
+	return "", ""
+}
+
+// checkWin is checkWinSize for the classic 3x3 board used by the AI opponent.
+func checkWin(board [9]string) (string, string) {
+	return checkWinSize(board[:], 3)
+}
+
+func isBoardFull(board []string) bool {
+	for _, c := range board {
+		if c == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// AI opponent
+type AIMoveRequest struct {
+	Board      [9]string `json:"board"`
+	Difficulty string    `json:"difficulty"` // easy, medium, hard
+	Player     string    `json:"player"`
+	AIMark     string    `json:"aiMark"` // defaults to "O"
+	// Seed makes the AI's random choices reproducible; a new one is issued
+	// when it is missing, and sending it back keeps the game replayable
+	Seed *int64 `json:"seed,omitempty"`
+}
+
+type AIMoveResponse struct {
+	Index   int       `json:"index"`
+	Board   [9]string `json:"board"`
+	Seed    int64     `json:"seed"`
+	Status  string    `json:"status"` // playing, finished
+	Winner  string    `json:"winner,omitempty"`
+	Pattern string    `json:"pattern,omitempty"`
+	IsTie   bool      `json:"isTie"`
+}
+
+func aiGameHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	var req AIMoveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_JSON", err.Error())
+		return
+	}
+	if req.Difficulty != "easy" && req.Difficulty != "medium" && req.Difficulty != "hard" {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_REQUEST", "difficulty must be easy, medium or hard")
+		return
+	}
+	if req.AIMark == "" {
+		req.AIMark = "O"
+	}
+	if req.AIMark != "X" && req.AIMark != "O" {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_REQUEST", "aiMark must be X or O")
+		return
+	}
+	if req.Player == "" {
+		req.Player = "Player"
+	}
+	player, err := validatePlayerName(req.Player)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_PLAYER_NAME", err.Error())
+		return
+	}
+	req.Player = player
+	for _, c := range req.Board {
+		if c != "" && c != "X" && c != "O" {
+			writeJSONError(w, http.StatusBadRequest, "INVALID_REQUEST", "board cells must be empty, X or O")
+			return
+		}
+	}
+	if err := validateAIBoard(req.Board, req.AIMark); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_BOARD", err.Error())
+		return
+	}
+
+	seed := newAISeed()
+	if req.Seed != nil {
+		seed = *req.Seed
+	}
+	resp := AIMoveResponse{Index: -1, Board: req.Board, Seed: seed, Status: "playing"}
+	if mark, _ := checkWin(req.Board); mark == "" && !isBoardFull(req.Board[:]) {
+		resp.Index = handleAIMove(req.Board, req.Difficulty, req.AIMark, aiRand(seed, req.Board))
+		resp.Board[resp.Index] = req.AIMark
+	}
+	if mark, pattern := checkWin(resp.Board); mark != "" {
+		resp.Status = "finished"
+		resp.Pattern = pattern
+		resp.Winner = req.Player
+		if mark == req.AIMark {
+			resp.Winner = "AI"
+		}
+	} else if isBoardFull(resp.Board[:]) {
+		resp.Status = "finished"
+		resp.IsTie = true
+	}
+	if resp.Status == "finished" {
+		// only the human counts against the throttle; every AI game has "AI"
+		if !allowSubmission(req.Player) {
+			writeJSONError(w, http.StatusTooManyRequests, "PLAYER_THROTTLED", "Too many game submissions for player")
+			return
+		}
+		result := GameResult{Player1: req.Player, Player2: "AI", Winner: resp.Winner, Pattern: resp.Pattern, IsTie: resp.IsTie, Mode: "ai", Difficulty: req.Difficulty}
+		ctx := context.WithoutCancel(r.Context())
+		queueSave(result.Mode+" game", func() { saveGameToDynamoDB(ctx, result) })
+		recordMetrics(result)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// validateAIBoard rejects boards no real game could reach: X moves first, so
+// X has as many marks as O or one more, and the AI may only be asked to move
+// on its own turn. A board the AI has already won is rejected so a finished
+// game can't be posted again to record another win.
+func validateAIBoard(board [9]string, aiMark string) error {
+	x, o := 0, 0
+	for _, c := range board {
+		switch c {
+		case "X":
+			x++
+		case "O":
+			o++
+		}
+	}
+	if x != o && x != o+1 {
+		return errors.New("board must have as many X marks as O marks, or one more")
+	}
+	toMove := "X"
+	if x > o {
+		toMove = "O"
+	}
+	mark, _ := checkWin(board)
+	switch {
+	case mark == aiMark:
+		return errors.New("the AI has already won this board")
+	case mark != "" && mark == toMove:
+		return errors.New("the winner must have made the last move")
+	case mark == "" && !isBoardFull(board[:]) && toMove != aiMark:
+		return errors.New("it is not the AI's turn")
+	}
+	return nil
+}
+
+// demoGameHandler starts a game the server plays against itself, one move
+// per interval, for spectators to watch on /api/game/ws.
+func demoGameHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	var req struct {
+		Difficulty string `json:"difficulty"`
+		IntervalMs int    `json:"intervalMs"`
+		Seed       *int64 `json:"seed"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_JSON", err.Error())
+		return
+	}
+	if req.Difficulty == "" {
+		req.Difficulty = "medium"
+	}
+	if req.Difficulty != "easy" && req.Difficulty != "medium" && req.Difficulty != "hard" {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_REQUEST", "difficulty must be easy, medium or hard")
+		return
+	}
+	interval := demoMoveInterval
+	if req.IntervalMs != 0 {
+		if req.IntervalMs < 100 || req.IntervalMs > 10000 {
+			writeJSONError(w, http.StatusBadRequest, "INVALID_REQUEST", "intervalMs must be between 100 and 10000")
+			return
+		}
+		interval = time.Duration(req.IntervalMs) * time.Millisecond
+	}
+	if atGameCapacity() {
+		gamesRejectedCapacity.Inc()
+		w.Header().Set("Retry-After", "30")
+		writeJSONError(w, http.StatusServiceUnavailable, "SERVER_AT_CAPACITY", "Too many active games, please try again shortly")
+		return
+	}
+
+	seed := newAISeed()
+	if req.Seed != nil {
+		seed = *req.Seed
+	}
+	game := newOnlineGame("AI-X", "X", 3, false)
+	game.mu.Lock()
+	game.demo = req.Difficulty
+	game.demoRand = rand.New(rand.NewSource(seed))
+	game.Player2 = "AI-O"
+	game.Status = "playing"
+	game.StartedAt = time.Now()
+	game.mu.Unlock()
+	go runDemo(game, interval)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"gameId": game.ID, "difficulty": req.Difficulty, "intervalMs": interval.Milliseconds(), "seed": seed})
+}
+
+// runDemo plays both sides of a demo game until it ends.
+func runDemo(g *OnlineGame, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		g.mu.Lock()
+		if g.Status != "playing" {
+			g.mu.Unlock()
+			return
+		}
+		var board [9]string
+		copy(board[:], g.Board)
+		player := g.Player1
+		if g.Turn == "O" {
+			player = g.Player2
+		}
+		g.applyMoveLocked(player, handleAIMove(board, g.demo, g.Turn, g.demoRand))
+		g.mu.Unlock()
+	}
+}
+
+// handleAIMove returns the AI's next move for a board that still has an empty cell.
+// Easy plays randomly, hard plays perfect minimax, medium mixes the two 50/50.
+// Every random choice, including which of several equally good moves to play,
+// comes from rng.
+func handleAIMove(board [9]string, difficulty, aiMark string, rng *rand.Rand) int {
+	start := time.Now()
+	defer func() {
+		aiMoveDuration.WithLabelValues(difficulty).Observe(time.Since(start).Seconds())
+		aiMovesTotal.WithLabelValues(difficulty).Inc()
+	}()
+	empty := make([]int, 0, 9)
+	for i, c := range board {
+		if c == "" {
+			empty = append(empty, i)
+		}
+	}
+	switch difficulty {
+	case "easy":
+		return empty[rng.Intn(len(empty))]
+	case "medium":
+		if rng.Intn(2) == 0 {
+			return empty[rng.Intn(len(empty))]
+		}
+	}
+	return bestAIMove(board, aiMark, rng)
+}
+
+// newAISeed issues a seed for a new AI game, kept below 2^53 so JavaScript
+// clients can send it back unchanged.
+func newAISeed() int64 {
+	return rand.Int63n(1 << 53)
+}
+
+// aiRand returns the random source for the AI's move on board in a game with
+// seed. Mixing in the board gives each position its own stream, so the same
+// seed and the same human moves reproduce every AI reply without the server
+// keeping state between /api/game/ai requests.
+func aiRand(seed int64, board [9]string) *rand.Rand {
+	h := fnv.New64a()
+	fmt.Fprint(h, seed, board)
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// bestAIMove picks among the moves with the best minimax score using rng.
+func bestAIMove(board [9]string, aiMark string, rng *rand.Rand) int {
+	human := "X"
+	if aiMark == "X" {
+		human = "O"
+	}
+	bestScore, best := -100, []int(nil)
+	for i := range board {
+		if board[i] != "" {
+			continue
+		}
+		board[i] = aiMark
+		score := minimax(board, 0, false, aiMark, human)
+		board[i] = ""
+		if score > bestScore {
+			bestScore, best = score, best[:0]
+		}
+		if score == bestScore {
+			best = append(best, i)
+		}
+	}
+	return best[rng.Intn(len(best))]
+}
+
+// minimax scores a board from the AI's point of view, preferring faster wins and slower losses.
+func minimax(board [9]string, depth int, maximizing bool, aiMark, human string) int {
+	if mark, _ := checkWin(board); mark == aiMark {
+		return 10 - depth
+	} else if mark == human {
+		return depth - 10
+	}
+	if isBoardFull(board[:]) {
+		return 0
+	}
+	best := 100
+	mark := human
+	if maximizing {
+		best, mark = -100, aiMark
+	}
+	for i := range board {
+		if board[i] != "" {
+			continue
+		}
+		board[i] = mark
+		score := minimax(board, depth+1, !maximizing, aiMark, human)
+		board[i] = ""
+		if maximizing && score > best || !maximizing && score < best {
+			best = score
+		}
+	}
+	return best
+}
+
+// AIDifficultyStats is how players fared against one AI level.
+type AIDifficultyStats struct {
+	Difficulty string  `json:"difficulty"`
+	Wins       int     `json:"wins"`
+	Losses     int     `json:"losses"`
+	Ties       int     `json:"ties"`
+	TotalGames int     `json:"totalGames"`
+	WinRate    float64 `json:"winRate"`
+}
+
+type AIStatsResponse struct {
+	Difficulties []AIDifficultyStats `json:"difficulties"`
+	UpdatedAt    string              `json:"updatedAt"`
+}
+
+// aiStatsHandler reports player wins, losses and ties against the AI per
+// difficulty. Games saved before difficulty was recorded count as "unknown".
+func aiStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	if !requireStore(w) {
+		return
+	}
+
+	byDifficulty := make(map[string]*AIDifficultyStats)
+	err := store.ScanGames(r.Context(), GameFilter{Mode: "ai"}, func(items []map[string]types.AttributeValue) error {
+		for _, item := range items {
+			// AI-vs-AI demo games have no human side to count
+			if !getBoolAttr(item, "demo") {
+				addAIGame(byDifficulty, item)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		requestLogger(r.Context()).Error("scan failed", "err", err)
+		writeDatabaseError(w, err)
+		return
+	}
+
+	resp := AIStatsResponse{Difficulties: make([]AIDifficultyStats, 0, len(byDifficulty)), UpdatedAt: time.Now().UTC().Format(time.RFC3339)}
+	for _, ds := range byDifficulty {
+		if ds.TotalGames > 0 {
+			ds.WinRate = float64(ds.Wins) / float64(ds.TotalGames) * 100
+		}
+		resp.Difficulties = append(resp.Difficulties, *ds)
+	}
+	sort.Slice(resp.Difficulties, func(i, j int) bool { return resp.Difficulties[i].Difficulty < resp.Difficulties[j].Difficulty })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// addAIGame counts one saved AI game from the player's side.
+func addAIGame(byDifficulty map[string]*AIDifficultyStats, item map[string]types.AttributeValue) {
+	difficulty := getStringAttr(item, "difficulty")
+	if difficulty == "" {
+		difficulty = "unknown"
+	}
+	ds, ok := byDifficulty[difficulty]
+	if !ok {
+		ds = &AIDifficultyStats{Difficulty: difficulty}
+		byDifficulty[difficulty] = ds
+	}
+	ds.TotalGames++
+	switch {
+	case getBoolAttr(item, "isTie"):
+		ds.Ties++
+	case getStringAttr(item, "winner") == "AI":
+		ds.Losses++
+	default:
+		ds.Wins++
+	}
+}
+
+// Leaderboard structures
+type PlayerStats struct {
+	Player      string  `json:"player"`
+	Wins        int     `json:"wins"`
+	Losses      int     `json:"losses"`
+	Ties        int     `json:"ties"`
+	TotalGames  int     `json:"totalGames"`
+	WinRate     float64 `json:"winRate"`
+	WinStreak   int     `json:"winStreak"`
+	BestPattern string  `json:"bestPattern,omitempty"`
+	Elo         int     `json:"elo"`
+}
+
+type LeaderboardResponse struct {
+	Players   []PlayerStats `json:"players"`
+	Mode      string        `json:"mode"`
+	Total     int           `json:"total"`
+	Limit     int           `json:"limit"`
+	Offset    int           `json:"offset"`
+	UpdatedAt string        `json:"updatedAt"`
+}
+
+type PlayerPatterns struct {
+	Player    string         `json:"player"`
+	Patterns  map[string]int `json:"patterns"`
+	Favorite  string         `json:"favorite,omitempty"`
+	LeastUsed string         `json:"leastUsed,omitempty"`
+}
+
+type PlayerStreaks struct {
+	Player        string `json:"player"`
+	CurrentStreak int    `json:"currentStreak"`
+	LongestStreak int    `json:"longestStreak"`
+	LastResult    string `json:"lastResult,omitempty"` // win, loss or tie
+}
+
+type RecentGame struct {
+	GameID    string `json:"gameId"`
+	Player1   string `json:"player1"`
+	Player2   string `json:"player2"`
+	Winner    string `json:"winner,omitempty"`
+	Pattern   string `json:"pattern,omitempty"`
+	IsTie     bool   `json:"isTie"`
+	Mode      string `json:"mode"`
+	Timestamp string `json:"timestamp"`
+	// FirstPlayer is the mark that moved first (X or O)
+	FirstPlayer string `json:"firstPlayer"`
+	MoveCount   int    `json:"moveCount"`
+}
+
+type StatsResponse struct {
+	TotalGames      int            `json:"totalGames"`
+	TotalWins       int            `json:"totalWins"`
+	TotalTies       int            `json:"totalTies"`
+	TopPatterns     map[string]int `json:"topPatterns"`
+	UpdatedAt       string         `json:"updatedAt"`
+	AvgMovesPerGame float64        `json:"avgMovesPerGame"`
+	XWinRate        float64        `json:"xWinRate"`
+	OWinRate        float64        `json:"oWinRate"`
+	TieRate         float64        `json:"tieRate"`
+	MostActiveHour  int            `json:"mostActiveHour"`
+	LongestStreak   int            `json:"longestStreak"`
+	StreakHolder    string         `json:"streakHolder"`
+	RangeFrom       string         `json:"rangeFrom,omitempty"`
+	RangeTo         string         `json:"rangeTo,omitempty"`
+
+	// First-mover rates follow the coin flip rather than the mark
+	FirstMoverWinRate          float64            `json:"firstMoverWinRate"`
+	SecondMoverWinRate         float64            `json:"secondMoverWinRate"`
+	FirstMoverWinRateByPattern map[string]float64 `json:"firstMoverWinRateByPattern"`
+}
+
+// parsePagination reads ?limit= (default 20, capped at 100) and ?offset=
+// (default 0), rejecting anything that isn't a non-negative integer.
+func parsePagination(r *http.Request) (limit, offset int, err error) {
+	limit = 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			return 0, 0, errors.New("Invalid limit")
+		}
+	}
+	if limit > 100 {
+		limit = 100
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, errors.New("Invalid offset")
+		}
+	}
+	return limit, offset, nil
+}
+
+func leaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_PARAMETER", err.Error())
+		return
+	}
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy != "" && sortBy != "wins" && sortBy != "elo" {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_PARAMETER", "Invalid sort")
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "online"
+	}
+	if mode != "online" && mode != "local" && mode != "all" {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_PARAMETER", "Invalid mode")
+		return
+	}
+	if !requireStore(w) {
+		return
+	}
+
+	// The rebuild may outlive this request when it refreshes a stale entry
+	ctx := context.WithoutCancel(r.Context())
+	key := fmt.Sprintf("leaderboard?limit=%d&offset=%d&sort=%s&mode=%s", limit, offset, sortBy, mode)
+	body, err := cachedJSON(key, func() (interface{}, error) {
+		return buildLeaderboard(ctx, mode, limit, offset, sortBy)
+	})
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// cacheEntry is a rendered JSON response, when it was built and how long
+// it stays fresh.
+type cacheEntry struct {
+	body    []byte
+	fetched time.Time
+	ttl     time.Duration
+}
+
+// cacheCall is an in-flight rebuild of a cache entry that callers can wait on.
+type cacheCall struct {
+	done chan struct{}
+	body []byte
+	err  error
+}
+
+// cachedJSON returns the JSON for key, building it at most once per cacheTTL.
+// Entries past their TTL are still served while a background rebuild runs;
+// entries older than twice the TTL count as misses.
+func cachedJSON(key string, build func() (interface{}, error)) ([]byte, error) {
+	return cachedJSONFor(key, cacheTTL, build)
+}
+
+// cachedJSONFor is cachedJSON with its own TTL, for responses that are
+// expensive enough to keep longer than the default.
+func cachedJSONFor(key string, ttl time.Duration, build func() (interface{}, error)) ([]byte, error) {
+	if ttl <= 0 {
+		return renderJSON(build)
+	}
+	responseCacheMu.RLock()
+	entry, ok := responseCache[key]
+	responseCacheMu.RUnlock()
+	if age := time.Since(entry.fetched); ok && age < 2*ttl {
+		cacheHits.Inc()
+		if age >= ttl {
+			go refreshCache(key, ttl, build)
+		}
+		return entry.body, nil
+	}
+	cacheMisses.Inc()
+	call := refreshCache(key, ttl, build)
+	<-call.done
+	return call.body, call.err
+}
+
+// refreshCache rebuilds key, or returns the rebuild already in flight so
+// concurrent misses only trigger one scan.
+func refreshCache(key string, ttl time.Duration, build func() (interface{}, error)) *cacheCall {
+	responseCacheMu.Lock()
+	if call, ok := cacheInflight[key]; ok {
+		responseCacheMu.Unlock()
+		return call
+	}
+	call := &cacheCall{done: make(chan struct{})}
+	cacheInflight[key] = call
+	responseCacheMu.Unlock()
+
+	call.body, call.err = renderJSON(build)
+
+	responseCacheMu.Lock()
+	delete(cacheInflight, key)
+	if call.err == nil {
+		now := time.Now()
+		for k, e := range responseCache {
+			if now.Sub(e.fetched) >= 2*e.ttl {
+				delete(responseCache, k)
+			}
+		}
+		responseCache[key] = cacheEntry{body: call.body, fetched: now, ttl: ttl}
+	}
+	responseCacheMu.Unlock()
+	close(call.done)
+	return call
+}
+
+func renderJSON(build func() (interface{}, error)) ([]byte, error) {
+	resp, err := build()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
+
+// buildLeaderboard aggregates player stats over the games of mode (online,
+// local, or all for both) and returns the requested page of the ranking.
+func buildLeaderboard(ctx context.Context, mode string, limit, offset int, sortBy string) (LeaderboardResponse, error) {
+	scanMode := mode
+	if mode == "all" {
+		scanMode = ""
+	}
+	items, err := scanGames(ctx, scanMode)
+	if err != nil {
+		return LeaderboardResponse{}, err
+	}
+	if mode == "all" {
+		// AI games have the computer as a player, so they stay off the leaderboard
+		human := items[:0]
+		for _, item := range items {
+			if getStringAttr(item, "mode") != "ai" {
+				human = append(human, item)
+			}
+		}
+		items = human
+	}
+
+	// Aggregate stats over the selected games
+	playerStats := make(map[string]*PlayerStats)
+	playerPatterns := make(map[string]map[string]int) // player -> pattern -> count
+	for _, item := range items {
+		p1 := getStringAttr(item, "player1")
+		p2 := getStringAttr(item, "player2")
+		winner := getStringAttr(item, "winner")
+		pattern := getStringAttr(item, "pattern")
+		isTie := getBoolAttr(item, "isTie")
+
+		ensurePlayer(playerStats, p1)
+		ensurePlayer(playerStats, p2)
+		if playerPatterns[p1] == nil {
+			playerPatterns[p1] = make(map[string]int)
+		}
+		if playerPatterns[p2] == nil {
+			playerPatterns[p2] = make(map[string]int)
+		}
+
+		if isTie {
+			playerStats[p1].Ties++
+			playerStats[p2].Ties++
+		} else if winner != "" {
+			playerStats[winner].Wins++
+			if isLinePattern(pattern) {
+				playerPatterns[winner][pattern]++
+			}
+			loser := p1
+			if winner == p1 {
+				loser = p2
+			}
+			playerStats[loser].Losses++
+		}
+		playerStats[p1].TotalGames++
+		playerStats[p2].TotalGames++
+	}
+	elo := computeElo(gameResultsByTime(items))
+
+	// Convert to slice, calculate win rates and best patterns
+	players := make([]PlayerStats, 0, len(playerStats))
+	for name, ps := range playerStats {
+		if ps.TotalGames > 0 {
+			ps.WinRate = float64(ps.Wins) / float64(ps.TotalGames) * 100
+		}
+		ps.BestPattern, _ = patternExtremes(playerPatterns[name])
+		// Get current streak from memory
+		if streak, ok := getWinStreak(name); ok {
+			ps.WinStreak = streak
+		}
+		ps.Elo = elo[name]
+		players = append(players, *ps)
+	}
+
+	if sortBy == "elo" {
+		sortPlayersByElo(players)
+	} else {
+		sortPlayersByWins(players)
+	}
+
+	// Page through the ranking
+	total := len(players)
+	start := min(offset, total)
+	players = players[start:min(start+limit, total)]
+
+	resp := LeaderboardResponse{
+		Players:   players,
+		Mode:      mode,
+		Total:     total,
+		Limit:     limit,
+		Offset:    offset,
+		UpdatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	return resp, nil
+}
+
+// leaderboardSubscriber is a live leaderboard connection; mu serializes writes.
+type leaderboardSubscriber struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+// send writes one leaderboard, already encoded as JSON.
+func (s *leaderboardSubscriber) send(body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return s.conn.WriteMessage(websocket.TextMessage, body)
+}
+
+// leaderboardWSHandler streams the top 20 leaderboard, sending the current
+// state on connect and a fresh one whenever an online game is saved. The
+// first state comes from the /api/leaderboard cache entry for the same page,
+// so connecting doesn't cost a scan of its own.
+func leaderboardWSHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	if !requireStore(w) {
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(wsMaxMessageBytes)
+	sub := subscribeLeaderboard(conn)
+	defer unsubscribeLeaderboard(sub)
+	ctx := context.WithoutCancel(r.Context())
+	body, err := cachedJSON("leaderboard?limit=20&offset=0&sort=&mode=online", func() (interface{}, error) {
+		return buildLeaderboard(ctx, "online", 20, 0, "")
+	})
+	if err == nil {
+		sub.send(body)
+	}
+	stopKeepAlive := keepAlive(conn, wsPongWait, wsPingPeriod)
+	defer stopKeepAlive()
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+func subscribeLeaderboard(conn *websocket.Conn) *leaderboardSubscriber {
+	sub := &leaderboardSubscriber{conn: conn}
+	leaderboardSubsMu.Lock()
+	leaderboardSubs[sub] = struct{}{}
+	leaderboardSubsMu.Unlock()
+	leaderboardSubscribers.Inc()
+	return sub
+}
+
+func unsubscribeLeaderboard(sub *leaderboardSubscriber) {
+	leaderboardSubsMu.Lock()
+	delete(leaderboardSubs, sub)
+	leaderboardSubsMu.Unlock()
+	leaderboardSubscribers.Dec()
+}
+
+// notifyLeaderboard schedules a push to live leaderboard subscribers. Bursts
+// of finished games coalesce into a single rebuild.
+func notifyLeaderboard() {
+	select {
+	case leaderboardUpdates <- struct{}{}:
+	default:
+	}
+}
+
+// runLeaderboardPublisher rebuilds the leaderboard for each notification and
+// pushes it to every subscriber.
+func runLeaderboardPublisher() {
+	for range leaderboardUpdates {
+		leaderboardSubsMu.Lock()
+		n := len(leaderboardSubs)
+		leaderboardSubsMu.Unlock()
+		if n == 0 {
+			continue
+		}
+		resp, err := buildLeaderboard(context.Background(), "online", 20, 0, "")
+		if err != nil {
+			continue
+		}
+		broadcastLeaderboard(resp)
+	}
+}
+
+func broadcastLeaderboard(resp LeaderboardResponse) {
+	leaderboardSubsMu.Lock()
+	subs := make([]*leaderboardSubscriber, 0, len(leaderboardSubs))
+	for sub := range leaderboardSubs {
+		subs = append(subs, sub)
+	}
+	leaderboardSubsMu.Unlock()
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	for _, sub := range subs {
+		if err := sub.send(body); err != nil {
+			sub.conn.Close()
+		}
+	}
+}
+
+// sortPlayersByWins orders players by wins, most first.
+func sortPlayersByWins(players []PlayerStats) {
+	sort.Slice(players, func(i, j int) bool { return players[i].Wins > players[j].Wins })
+}
+
+// sortPlayersByElo orders players by rating, highest first.
+func sortPlayersByElo(players []PlayerStats) {
+	sort.Slice(players, func(i, j int) bool { return players[i].Elo > players[j].Elo })
+}
+
+// sortGamesByTime orders games by timestamp, newest first.
+func sortGamesByTime(games []RecentGame) {
+	sort.Slice(games, func(i, j int) bool { return games[i].Timestamp > games[j].Timestamp })
+}
+
+// firstPlayerMark returns the mark that moved first: the saved firstPlayer,
+// else the mark of the first move, else X as before the coin flip existed.
+func firstPlayerMark(item map[string]types.AttributeValue) string {
+	if mark := getStringAttr(item, "firstPlayer"); mark != "" {
+		return mark
+	}
+	if moves := getMovesAttr(item, "moves"); len(moves) > 0 {
+		return moves[0].Player
+	}
+	return "X"
+}
+
+// firstMover returns the name of the player who moved first; player1 plays X.
+func firstMover(item map[string]types.AttributeValue) string {
+	if firstPlayerMark(item) == "O" {
+		return getStringAttr(item, "player2")
+	}
+	return getStringAttr(item, "player1")
+}
+
+// sortItemsByTime orders saved games by timestamp, newest first.
+func sortItemsByTime(items []map[string]types.AttributeValue) {
+	sort.Slice(items, func(i, j int) bool {
+		return getStringAttr(items[i], "timestamp") > getStringAttr(items[j], "timestamp")
+	})
+}
+
+// scanGames returns every finished game of mode (any mode when empty),
+// excluding synthetic test data.
+func scanGames(ctx context.Context, mode string) ([]map[string]types.AttributeValue, error) {
+	var items []map[string]types.AttributeValue
+	err := scanGamePages(ctx, mode, func(page []map[string]types.AttributeValue) error {
+		items = append(items, page...)
+		return nil
+	})
+	return items, err
+}
+
+// scanGamePages scans the table and calls fn with the finished, non-synthetic
+// games of mode (any mode when empty) in each page, stopping at the first error.
+func scanGamePages(ctx context.Context, mode string, fn func([]map[string]types.AttributeValue) error) error {
+	err := store.ScanGames(ctx, GameFilter{Mode: mode, SkipSynthetic: true}, func(page []map[string]types.AttributeValue) error {
+		items := make([]map[string]types.AttributeValue, 0, len(page))
+		for _, item := range page {
+			if !isUnfinished(item) {
+				items = append(items, item)
+			}
+		}
+		return fn(items)
+	})
+	if err != nil {
+		requestLogger(ctx).Error("scan failed", "err", err)
+	}
+	return err
+}
+
+const (
+	eloStart = 1200
+	eloK     = 32
+)
+
+// computeElo replays results in order with the standard ELO formula
+// (K=32, everyone starting at 1200) and returns each player's rating.
+func computeElo(results []GameResult) map[string]int {
+	ratings := make(map[string]float64)
+	rating := func(player string) float64 {
+		if r, ok := ratings[player]; ok {
+			return r
+		}
+		return eloStart
+	}
+	for _, result := range results {
+		r1, r2 := rating(result.Player1), rating(result.Player2)
+		expected1 := 1 / (1 + math.Pow(10, (r2-r1)/400))
+		score1 := 0.5
+		if !result.IsTie {
+			switch result.Winner {
+			case result.Player1:
+				score1 = 1
+			case result.Player2:
+				score1 = 0
+			default:
+				continue
+			}
+		}
+		ratings[result.Player1] = r1 + eloK*(score1-expected1)
+		ratings[result.Player2] = r2 + eloK*((1-score1)-(1-expected1))
+	}
+	elo := make(map[string]int, len(ratings))
+	for player, r := range ratings {
+		elo[player] = int(math.Round(r))
+	}
+	return elo
+}
+
+type EloRating struct {
+	Player string `json:"player"`
+	Elo    int    `json:"elo"`
+}
+
+type EloResponse struct {
+	Players   []EloRating `json:"players"`
+	UpdatedAt string      `json:"updatedAt"`
+}
+
+func eloHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	if !requireStore(w) {
+		return
+	}
+	items, err := scanGames(r.Context(), "online")
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	players := make([]EloRating, 0)
+	for player, elo := range computeElo(gameResultsByTime(items)) {
+		players = append(players, EloRating{Player: player, Elo: elo})
+	}
+	sort.Slice(players, func(i, j int) bool { return players[i].Elo > players[j].Elo })
+	resp := EloResponse{
+		Players:   players,
+		UpdatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parseTimeRange reads the optional ?from= and ?to= RFC3339 bounds. A zero
+// time means unbounded, except that to defaults to now when only from is set.
+func parseTimeRange(r *http.Request) (from, to time.Time, err error) {
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, errors.New("Invalid from date")
+		}
+		from = from.UTC()
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, errors.New("Invalid to date")
+		}
+		to = to.UTC()
+	} else if !from.IsZero() {
+		to = time.Now().UTC()
+	}
+	return from, to, nil
+}
+
+// inTimeRange reports whether the RFC3339 timestamp ts falls within
+// [from, to]. Games without a parseable timestamp only match an open range.
+func inTimeRange(ts string, from, to time.Time) bool {
+	if from.IsZero() && to.IsZero() {
+		return true
+	}
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return false
+	}
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || !t.After(to))
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_PARAMETER", err.Error())
+		return
+	}
+	if !requireStore(w) {
+		return
+	}
+
+	ctx := context.WithoutCancel(r.Context())
+	key := "stats?from=" + r.URL.Query().Get("from") + "&to=" + r.URL.Query().Get("to")
+	body, err := cachedJSON(key, func() (interface{}, error) {
+		return buildStats(ctx, from, to)
+	})
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// buildStats aggregates global stats over online games within [from, to].
+func buildStats(ctx context.Context, from, to time.Time) (StatsResponse, error) {
+	items, err := scanGames(ctx, "online")
+	if err != nil {
+		return StatsResponse{}, err
+	}
+
+	var totalGames, totalWins, totalTies, xWins, oWins, firstMoverWins, totalMoves int
+	patterns := make(map[string]int)
+	firstMoverPatterns := make(map[string]int)
+	hourCounts := make(map[int]int)
+	playerWinStreaks := make(map[string]int)
+	longestStreak, streakHolder := 0, ""
+
+	for _, item := range items {
+		ts := getStringAttr(item, "timestamp")
+		if !inTimeRange(ts, from, to) {
+			continue
+		}
+		p1 := getStringAttr(item, "player1")
+		totalGames++
+		if moves, ok := item["moves"].(*types.AttributeValueMemberL); ok {
+			totalMoves += len(moves.Value)
+		}
+
+		// Track hour of play
+		if len(ts) >= 13 {
+			hour := 0
+			fmt.Sscanf(ts[11:13], "%d", &hour)
+			hourCounts[hour]++
+		}
+
+		if getBoolAttr(item, "isTie") {
+			totalTies++
+		} else {
+			totalWins++
+			winner := getStringAttr(item, "winner")
+			pattern := getStringAttr(item, "pattern")
+			if isLinePattern(pattern) {
+				patterns[pattern]++
+			}
+			// player1 plays X
+			if winner == p1 {
+				xWins++
+			} else {
+				oWins++
+			}
+			if winner == firstMover(item) {
+				firstMoverWins++
+				if isLinePattern(pattern) {
+					firstMoverPatterns[pattern]++
+				}
+			}
+			// Track streaks
+			playerWinStreaks[winner]++
+			if playerWinStreaks[winner] > longestStreak {
+				longestStreak = playerWinStreaks[winner]
+				streakHolder = winner
+			}
+		}
+	}
+
+	// Find most active hour
+	mostActiveHour, maxHourCount := 0, 0
+	for h, c := range hourCounts {
+		if c > maxHourCount {
+			maxHourCount = c
+			mostActiveHour = h
+		}
+	}
+
+	// Calculate rates
+	var xRate, oRate, firstRate, secondRate, tieRate, avgMoves float64
+	if totalGames > 0 {
+		avgMoves = float64(totalMoves) / float64(totalGames)
+		xRate = float64(xWins) / float64(totalGames) * 100
+		oRate = float64(oWins) / float64(totalGames) * 100
+		firstRate = float64(firstMoverWins) / float64(totalGames) * 100
+		secondRate = float64(totalWins-firstMoverWins) / float64(totalGames) * 100
+		tieRate = float64(totalTies) / float64(totalGames) * 100
+	}
+	// Share of each pattern's wins that went to the player who moved first
+	firstByPattern := make(map[string]float64, len(patterns))
+	for pattern, wins := range patterns {
+		firstByPattern[pattern] = float64(firstMoverPatterns[pattern]) / float64(wins) * 100
+	}
+
+	resp := StatsResponse{
+		TotalGames:      totalGames,
+		TotalWins:       totalWins,
+		TotalTies:       totalTies,
+		TopPatterns:     patterns,
+		AvgMovesPerGame: avgMoves,
+		XWinRate:        xRate,
+		OWinRate:        oRate,
+		TieRate:         tieRate,
+		MostActiveHour:  mostActiveHour,
+		LongestStreak:   longestStreak,
+		StreakHolder:    streakHolder,
+		UpdatedAt:       time.Now().UTC().Format(time.RFC3339),
+
+		FirstMoverWinRate:          firstRate,
+		SecondMoverWinRate:         secondRate,
+		FirstMoverWinRateByPattern: firstByPattern,
+	}
+	if !from.IsZero() {
+		resp.RangeFrom = from.Format(time.RFC3339)
+	}
+	if !to.IsZero() {
+		resp.RangeTo = to.Format(time.RFC3339)
+	}
+	return resp, nil
+}
+
+// Heatmap counts the opening cell of finished 3x3 online games.
+type Heatmap struct {
+	Games      int        `json:"games"`
+	FirstMoves [9]int     `json:"firstMoves"`
+	WinRates   [9]float64 `json:"winRates"` // % of games the opener won, per opening cell
+	UpdatedAt  string     `json:"updatedAt"`
+}
+
+func heatmapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	if !requireStore(w) {
+		return
+	}
+
+	ctx := context.WithoutCancel(r.Context())
+	body, err := cachedJSON("heatmap", func() (interface{}, error) {
+		return buildHeatmap(ctx)
+	})
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// buildHeatmap tallies the first move of every finished online game on the
+// classic board and how often the player who made it went on to win.
+func buildHeatmap(ctx context.Context) (Heatmap, error) {
+	items, err := scanGames(ctx, "online")
+	if err != nil {
+		return Heatmap{}, err
+	}
+	var resp Heatmap
+	var wins [9]int
+	for _, item := range items {
+		if size := getIntAttr(item, "size"); size != 0 && size != 3 {
+			continue
+		}
+		moves := getMovesAttr(item, "moves")
+		if len(moves) == 0 || moves[0].Index < 0 || moves[0].Index > 8 {
+			continue
+		}
+		cell := moves[0].Index
+		resp.Games++
+		resp.FirstMoves[cell]++
+		if winner := getStringAttr(item, "winner"); winner != "" && winner == firstMover(item) {
+			wins[cell]++
+		}
+	}
+	for cell, n := range resp.FirstMoves {
+		if n > 0 {
+			resp.WinRates[cell] = float64(wins[cell]) / float64(n) * 100
+		}
+	}
+	resp.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	return resp, nil
+}
+
+// TieAnalysis compares where finished 3x3 online games opened when they
+// ended in a tie against when someone won.
+type TieAnalysis struct {
+	Ties        int        `json:"ties"`
+	Wins        int        `json:"wins"`
+	TieOpenings [9]int     `json:"tieOpenings"` // games per opening cell that ended in a tie
+	WinOpenings [9]int     `json:"winOpenings"` // games per opening cell that someone won
+	TieRates    [9]float64 `json:"tieRates"`    // % of games from each opening cell that tied
+	// Correlation is the Pearson correlation of tieOpenings and winOpenings:
+	// near 1 when ties open like wins, lower when some openings tie more.
+	Correlation float64 `json:"correlation"`
+	UpdatedAt   string  `json:"updatedAt"`
+}
+
+// tieAnalysisHandler serves /api/analysis/ties, cached for
+// analysisCacheTTL since it reads the moves of every online game.
+func tieAnalysisHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	if !requireStore(w) {
+		return
+	}
+
+	ctx := context.WithoutCancel(r.Context())
+	body, err := cachedJSONFor("analysis/ties", analysisCacheTTL, func() (interface{}, error) {
+		return buildTieAnalysis(ctx)
+	})
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// buildTieAnalysis tallies the opening cell of finished online games on the
+// classic board, split by whether the game was tied or won.
+func buildTieAnalysis(ctx context.Context) (TieAnalysis, error) {
+	items, err := scanGames(ctx, "online")
+	if err != nil {
+		return TieAnalysis{}, err
+	}
+	var resp TieAnalysis
+	for _, item := range items {
+		if size := getIntAttr(item, "size"); size != 0 && size != 3 {
+			continue
+		}
+		moves := getMovesAttr(item, "moves")
+		if len(moves) == 0 || moves[0].Index < 0 || moves[0].Index > 8 {
+			continue
+		}
+		cell := moves[0].Index
+		if getStringAttr(item, "winner") == "" {
+			resp.Ties++
+			resp.TieOpenings[cell]++
+		} else {
+			resp.Wins++
+			resp.WinOpenings[cell]++
+		}
+	}
+	for cell := range resp.TieOpenings {
+		if n := resp.TieOpenings[cell] + resp.WinOpenings[cell]; n > 0 {
+			resp.TieRates[cell] = float64(resp.TieOpenings[cell]) / float64(n) * 100
+		}
+	}
+	resp.Correlation = pearson(resp.TieOpenings[:], resp.WinOpenings[:])
+	resp.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	return resp, nil
+}
+
+// pearson returns the correlation coefficient of xs and ys, or 0 when
+// either series is constant.
+func pearson(xs, ys []int) float64 {
+	n := float64(len(xs))
+	var sumX, sumY float64
+	for i := range xs {
+		sumX += float64(xs[i])
+		sumY += float64(ys[i])
+	}
+	meanX, meanY := sumX/n, sumY/n
+	var cov, varX, varY float64
+	for i := range xs {
+		dx, dy := float64(xs[i])-meanX, float64(ys[i])-meanY
+		cov += dx * dy
+		varX += dx * dx
+		varY += dy * dy
+	}
+	if varX == 0 || varY == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(varX*varY)
+}
+
+// winPatterns are the eight lines a game on the classic board can be won with.
+var winPatterns = []string{"row1", "row2", "row3", "col1", "col2", "col3", "diag1", "diag2"}
+
+// patternsHandler serves how often each line has won online games, e.g.
+// {"row1": 12, ...}, without the rest of the /api/stats payload.
+func patternsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	if !requireStore(w) {
+		return
+	}
+
+	ctx := context.WithoutCancel(r.Context())
+	body, err := cachedJSON("patterns", func() (interface{}, error) {
+		return buildPatternCounts(ctx)
+	})
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// buildPatternCounts counts wins per pattern over 3x3 online games, listing
+// every pattern even when it has never won.
+func buildPatternCounts(ctx context.Context) (map[string]int, error) {
+	items, err := scanGames(ctx, "online")
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(winPatterns))
+	for _, p := range winPatterns {
+		counts[p] = 0
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(game.toJSON())
+	for _, item := range items {
+		if size := getIntAttr(item, "size"); size != 0 && size != 3 {
+			continue
+		}
+		pattern := getStringAttr(item, "pattern")
+		if _, ok := counts[pattern]; ok && getStringAttr(item, "winner") != "" {
+			counts[pattern]++
+		}
+	}
+	return counts, nil
 }
 
-func wsHandler(w http.ResponseWriter, r *http.Request) {
-	gameID := r.URL.Query().Get("id")
-	gamesMu.RLock()
-	game, exists := games[gameID]
-	gamesMu.RUnlock()
-	if !exists {
-		http.Error(w, "Game not found", http.StatusNotFound)
+func recentGamesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
 		return
 	}
-	conn, err := upgrader.Upgrade(w, r, nil)
+	if !requireStore(w) {
+		return
+	}
+
+	items, err := store.RecentGames(r.Context(), GameFilter{Mode: "online", SkipSynthetic: true}, 20)
 	if err != nil {
+		requestLogger(r.Context()).Error("recent games failed", "err", err)
+		writeDatabaseError(w, err)
 		return
 	}
-	wsConnectionsActive.Inc()
-	game.mu.Lock()
-	game.Conns = append(game.Conns, conn)
-	game.mu.Unlock()
-	conn.WriteJSON(WSMessage{Type: "game_state", Payload: game.toJSON()})
-	wsMessagesTotal.WithLabelValues("game_state", "out").Inc()
-	defer func() {
-		wsConnectionsActive.Dec()
-		conn.Close()
-		game.mu.Lock()
-		for i, c := range game.Conns {
-			if c == conn {
-				game.Conns = append(game.Conns[:i], game.Conns[i+1:]...)
-				break
-			}
-		}
-		game.mu.Unlock()
-	}()
-	for {
-		var msg WSMessage
-		if err := conn.ReadJSON(&msg); err != nil {
-			break
-		}
-		wsMessagesTotal.WithLabelValues(msg.Type, "in").Inc()
-		game.handleMessage(msg)
+	games := make([]RecentGame, 0, len(items))
+	for _, item := range items {
+		games = append(games, recentGameFromItem(item))
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(games)
 }
 
-func (g *OnlineGame) toJSON() map[string]interface{} {
-	return map[string]interface{}{
-		"id": g.ID, "board": g.Board, "turn": g.Turn, "firstPlayer": g.FirstPlayer,
-		"player1": g.Player1, "player2": g.Player2,
-		"status": g.Status, "winner": g.Winner, "pattern": g.Pattern,
+func recentGameFromItem(item map[string]types.AttributeValue) RecentGame {
+	return RecentGame{
+		GameID:      getStringAttr(item, "gameId"),
+		Player1:     getStringAttr(item, "player1"),
+		Player2:     getStringAttr(item, "player2"),
+		Winner:      getStringAttr(item, "winner"),
+		Pattern:     getStringAttr(item, "pattern"),
+		IsTie:       getBoolAttr(item, "isTie"),
+		Mode:        getStringAttr(item, "mode"),
+		Timestamp:   getStringAttr(item, "timestamp"),
+		FirstPlayer: firstPlayerMark(item),
+		MoveCount:   moveCount(item),
 	}
 }
 
-func (g *OnlineGame) broadcast(msg WSMessage) {
-	g.mu.Lock()
-	defer g.mu.Unlock()
-	wsMessagesTotal.WithLabelValues(msg.Type, "out").Add(float64(len(g.Conns)))
-	for _, conn := range g.Conns {
-		conn.WriteJSON(msg)
+// moveCount returns the stored moveCount, falling back to the length of the
+// moves list for games saved before it was written.
+func moveCount(item map[string]types.AttributeValue) int {
+	if n := getIntAttr(item, "moveCount"); n > 0 {
+		return int(n)
 	}
+	if moves, ok := item["moves"].(*types.AttributeValueMemberL); ok {
+		return len(moves.Value)
+	}
+	return 0
 }
 
-func (g *OnlineGame) handleMessage(msg WSMessage) {
-	if msg.Type == "reaction" {
-		g.broadcast(msg)
-		return
-	}
-	if msg.Type != "move" || g.Status != "playing" {
+func playerStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
 		return
 	}
-	payload, ok := msg.Payload.(map[string]interface{})
-	if !ok {
+	player := r.URL.Query().Get("player")
+	if player == "" {
+		writeJSONError(w, http.StatusBadRequest, "MISSING_PARAMETER", "player parameter required")
 		return
 	}
-	idx := int(payload["index"].(float64))
-	player := payload["player"].(string)
-	expectedPlayer := g.Player1
-	if g.Turn == "O" {
-		expectedPlayer = g.Player2
-	}
-	if player != expectedPlayer || idx < 0 || idx > 8 || g.Board[idx] != "" {
+	if !requireStore(w) {
 		return
 	}
-	g.Board[idx] = g.Turn
-
-	// Record move with timestamp
-	moveTime := int64(0)
-	if !g.StartedAt.IsZero() {
-		moveTime = time.Since(g.StartedAt).Milliseconds()
-	}
-	g.Moves = append(g.Moves, Move{Index: idx, Player: g.Turn, Time: moveTime})
 
-	wins := [][]int{{0, 1, 2}, {3, 4, 5}, {6, 7, 8}, {0, 3, 6}, {1, 4, 7}, {2, 5, 8}, {0, 4, 8}, {2, 4, 6}}
-	patterns := map[string]string{
-		"0,1,2": "row1", "3,4,5": "row2", "6,7,8": "row3",
-		"0,3,6": "col1", "1,4,7": "col2", "2,5,8": "col3",
-		"0,4,8": "diag1", "2,4,6": "diag2",
-	}
-	for _, w := range wins {
-		if g.Board[w[0]] != "" && g.Board[w[0]] == g.Board[w[1]] && g.Board[w[1]] == g.Board[w[2]] {
-			g.Status = "finished"
-			g.Winner = player
-			key := fmt.Sprintf("%d,%d,%d", w[0], w[1], w[2])
-			g.Pattern = patterns[key]
-			g.broadcast(WSMessage{Type: "game_state", Payload: g.toJSON()})
-			go saveOnlineGameToDynamoDB(g)
-			result := GameResult{Player1: g.Player1, Player2: g.Player2, Winner: g.Winner, Pattern: g.Pattern, Mode: "online"}
-			recordMetrics(result)
-			onlineGamesActive.Dec()
-			return
-		}
-	}
-	isFull := true
-	for _, c := range g.Board {
-		if c == "" {
-			isFull = false
-			break
+	stats := &PlayerStats{Player: player}
+	err := store.ScanGames(r.Context(), GameFilter{Player: player}, func(items []map[string]types.AttributeValue) error {
+		for _, item := range items {
+			if !isUnfinished(item) {
+				stats.record(item)
+			}
 		}
-	}
-	if isFull {
-		g.Status = "finished"
-		g.broadcast(WSMessage{Type: "game_state", Payload: g.toJSON()})
-		go saveOnlineGameToDynamoDB(g)
-		result := GameResult{Player1: g.Player1, Player2: g.Player2, IsTie: true, Mode: "online"}
-		recordMetrics(result)
-		onlineGamesActive.Dec()
+		return nil
+	})
+	if err != nil {
+		requestLogger(r.Context()).Error("scan failed", "err", err)
+		writeDatabaseError(w, err)
 		return
 	}
-	if g.Turn == "X" {
-		g.Turn = "O"
-	} else {
-		g.Turn = "X"
-	}
-	g.broadcast(WSMessage{Type: "game_state", Payload: g.toJSON()})
-}
+	stats.setWinRate()
 
-// Leaderboard structures
-type PlayerStats struct {
-	Player      string  `json:"player"`
-	Wins        int     `json:"wins"`
-	Losses      int     `json:"losses"`
-	Ties        int     `json:"ties"`
-	TotalGames  int     `json:"totalGames"`
-	WinRate     float64 `json:"winRate"`
-	WinStreak   int     `json:"winStreak"`
-	BestPattern string  `json:"bestPattern,omitempty"`
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
 }
 
-type LeaderboardResponse struct {
-	Players   []PlayerStats `json:"players"`
-	UpdatedAt string        `json:"updatedAt"`
+// record counts a finished game the player took part in.
+func (s *PlayerStats) record(item map[string]types.AttributeValue) {
+	s.TotalGames++
+	switch {
+	case getBoolAttr(item, "isTie"):
+		s.Ties++
+	case getStringAttr(item, "winner") == s.Player:
+		s.Wins++
+	default:
+		s.Losses++
+	}
 }
 
-type RecentGame struct {
-	GameID    string `json:"gameId"`
-	Player1   string `json:"player1"`
-	Player2   string `json:"player2"`
-	Winner    string `json:"winner,omitempty"`
-	Pattern   string `json:"pattern,omitempty"`
-	IsTie     bool   `json:"isTie"`
-	Mode      string `json:"mode"`
-	Timestamp string `json:"timestamp"`
+func (s *PlayerStats) setWinRate() {
+	if s.TotalGames > 0 {
+		s.WinRate = float64(s.Wins) / float64(s.TotalGames) * 100
+	}
 }
 
-type StatsResponse struct {
-	TotalGames      int            `json:"totalGames"`
-	TotalWins       int            `json:"totalWins"`
-	TotalTies       int            `json:"totalTies"`
-	TopPatterns     map[string]int `json:"topPatterns"`
-	UpdatedAt       string         `json:"updatedAt"`
-	AvgMovesPerGame float64        `json:"avgMovesPerGame"`
-	XWinRate        float64        `json:"xWinRate"`
-	OWinRate        float64        `json:"oWinRate"`
-	TieRate         float64        `json:"tieRate"`
-	MostActiveHour  int            `json:"mostActiveHour"`
-	LongestStreak   int            `json:"longestStreak"`
-	StreakHolder    string         `json:"streakHolder"`
-}
+// maxBulkPlayers caps how many players /api/players/stats accepts at once.
+const maxBulkPlayers = 10
 
-func leaderboardHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// bulkPlayerStatsHandler returns stats for several players, keyed by name,
+// from a single scan so comparison views don't scan once per player.
+func bulkPlayerStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	var req struct {
+		Players []string `json:"players"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_JSON", err.Error())
 		return
 	}
-	if dynamoClient == nil {
-		http.Error(w, "Database not available", http.StatusServiceUnavailable)
+	if len(req.Players) == 0 || len(req.Players) > maxBulkPlayers {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_REQUEST", fmt.Sprintf("players must list 1-%d names", maxBulkPlayers))
 		return
 	}
-
-	// Scan all online games and aggregate stats
-	playerStats := make(map[string]*PlayerStats)
-	playerPatterns := make(map[string]map[string]int) // player -> pattern -> count
-	var lastKey map[string]types.AttributeValue
-
-	for {
-		input := &dynamodb.ScanInput{
-			TableName:         aws.String(tableName),
-			ExclusiveStartKey: lastKey,
-		}
-		result, err := dynamoClient.Scan(context.Background(), input)
-		if err != nil {
-			log.Printf("Scan error: %v", err)
-			dynamoDBOps.WithLabelValues("Scan", "error").Inc()
-			http.Error(w, "Database error", http.StatusInternalServerError)
+	stats := make(map[string]*PlayerStats, len(req.Players))
+	for _, player := range req.Players {
+		if player == "" {
+			writeJSONError(w, http.StatusBadRequest, "INVALID_REQUEST", "player names must not be empty")
 			return
 		}
-		dynamoDBOps.WithLabelValues("Scan", "success").Inc()
-
-		for _, item := range result.Items {
-			mode := getStringAttr(item, "mode")
-			// Only count online games for leaderboard
-			if mode != "online" {
-				continue
-			}
-
-			p1 := getStringAttr(item, "player1")
-			p2 := getStringAttr(item, "player2")
-			winner := getStringAttr(item, "winner")
-			pattern := getStringAttr(item, "pattern")
-			isTie := getBoolAttr(item, "isTie")
+		stats[player] = &PlayerStats{Player: player}
+	}
+	if !requireStore(w) {
+		return
+	}
 
-			// Skip synthetic test data
-			if len(p1) >= 9 && p1[:9] == "Synthetic" {
+	err := store.ScanGames(r.Context(), GameFilter{}, func(items []map[string]types.AttributeValue) error {
+		for _, item := range items {
+			if isUnfinished(item) {
 				continue
 			}
-
-			ensurePlayer(playerStats, p1)
-			ensurePlayer(playerStats, p2)
-			if playerPatterns[p1] == nil {
-				playerPatterns[p1] = make(map[string]int)
-			}
-			if playerPatterns[p2] == nil {
-				playerPatterns[p2] = make(map[string]int)
+			player1, player2 := getStringAttr(item, "player1"), getStringAttr(item, "player2")
+			if s, ok := stats[player1]; ok {
+				s.record(item)
 			}
-
-			if isTie {
-				playerStats[p1].Ties++
-				playerStats[p2].Ties++
-			} else if winner != "" {
-				playerStats[winner].Wins++
-				if pattern != "" {
-					playerPatterns[winner][pattern]++
-				}
-				loser := p1
-				if winner == p1 {
-					loser = p2
-				}
-				playerStats[loser].Losses++
+			if s, ok := stats[player2]; ok && player2 != player1 {
+				s.record(item)
 			}
-			playerStats[p1].TotalGames++
-			playerStats[p2].TotalGames++
-		}
-
-		lastKey = result.LastEvaluatedKey
-		if lastKey == nil {
-			break
 		}
+		return nil
+	})
+	if err != nil {
+		requestLogger(r.Context()).Error("scan failed", "err", err)
+		writeDatabaseError(w, err)
+		return
+	}
+	for _, s := range stats {
+		s.setWinRate()
 	}
 
-	// Convert to slice, calculate win rates and best patterns
-	players := make([]PlayerStats, 0, len(playerStats))
-	for name, ps := range playerStats {
-		if ps.TotalGames > 0 {
-			ps.WinRate = float64(ps.Wins) / float64(ps.TotalGames) * 100
-		}
-		// Find best pattern
-		if patterns, ok := playerPatterns[name]; ok {
-			maxCount := 0
-			for p, c := range patterns {
-				if c > maxCount {
-					maxCount = c
-					ps.BestPattern = p
-				}
-			}
-		}
-		// Get current streak from memory
-		if streak, ok := winStreaks[name]; ok {
-			ps.WinStreak = streak
-		}
-		players = append(players, *ps)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// playerPatternsHandler returns how often a player has won with each line.
+func playerPatternsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	player := r.URL.Query().Get("player")
+	if player == "" {
+		writeJSONError(w, http.StatusBadRequest, "MISSING_PARAMETER", "player parameter required")
+		return
+	}
+	if !requireStore(w) {
+		return
 	}
 
-	// Sort by wins descending
-	for i := 0; i < len(players); i++ {
-		for j := i + 1; j < len(players); j++ {
-			if players[j].Wins > players[i].Wins {
-				players[i], players[j] = players[j], players[i]
+	resp := PlayerPatterns{Player: player, Patterns: make(map[string]int)}
+	filter := GameFilter{Mode: "online", Winner: player, SkipSynthetic: true}
+	err := store.ScanGames(r.Context(), filter, func(items []map[string]types.AttributeValue) error {
+		for _, item := range items {
+			if pattern := getStringAttr(item, "pattern"); isLinePattern(pattern) && !isUnfinished(item) {
+				resp.Patterns[pattern]++
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		requestLogger(r.Context()).Error("scan failed", "err", err)
+		writeDatabaseError(w, err)
+		return
 	}
+	resp.Favorite, resp.LeastUsed = patternExtremes(resp.Patterns)
 
-	// Limit to top 20
-	if len(players) > 20 {
-		players = players[:20]
-	}
-
-	resp := LeaderboardResponse{
-		Players:   players,
-		UpdatedAt: time.Now().UTC().Format(time.RFC3339),
-	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
-func statsHandler(w http.ResponseWriter, r *http.Request) {
+// playerStreaksHandler returns a player's current and longest win streaks,
+// rebuilt from their saved games so it survives restarts.
+func playerStreaksHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
 		return
 	}
-	if dynamoClient == nil {
-		http.Error(w, "Database not available", http.StatusServiceUnavailable)
+	player := r.URL.Query().Get("player")
+	if player == "" {
+		writeJSONError(w, http.StatusBadRequest, "MISSING_PARAMETER", "player parameter required")
 		return
 	}
-
-	var totalGames, totalWins, totalTies, xWins, oWins int
-	patterns := make(map[string]int)
-	hourCounts := make(map[int]int)
-	playerWinStreaks := make(map[string]int)
-	longestStreak, streakHolder := 0, ""
-	var lastKey map[string]types.AttributeValue
-
-	for {
-		input := &dynamodb.ScanInput{
-			TableName:         aws.String(tableName),
-			ExclusiveStartKey: lastKey,
-		}
-		result, err := dynamoClient.Scan(context.Background(), input)
-		if err != nil {
-			dynamoDBOps.WithLabelValues("Scan", "error").Inc()
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			return
-		}
-		dynamoDBOps.WithLabelValues("Scan", "success").Inc()
-
-		for _, item := range result.Items {
-			mode := getStringAttr(item, "mode")
-			if mode != "online" {
-				continue
-			}
-			p1 := getStringAttr(item, "player1")
-			if len(p1) >= 9 && p1[:9] == "Synthetic" {
-				continue
-			}
-			totalGames++
-
-			// Track hour of play
-			ts := getStringAttr(item, "timestamp")
-			if len(ts) >= 13 {
-				hour := 0
-				fmt.Sscanf(ts[11:13], "%d", &hour)
-				hourCounts[hour]++
-			}
-
-			if getBoolAttr(item, "isTie") {
-				totalTies++
-			} else {
-				totalWins++
-				winner := getStringAttr(item, "winner")
-				pattern := getStringAttr(item, "pattern")
-				if pattern != "" {
-					patterns[pattern]++
-				}
-				// X always goes first, so winner == p1 means X won
-				if winner == p1 {
-					xWins++
-				} else {
-					oWins++
-				}
-				// Track streaks
-				playerWinStreaks[winner]++
-				if playerWinStreaks[winner] > longestStreak {
-					longestStreak = playerWinStreaks[winner]
-					streakHolder = winner
-				}
-			}
-		}
-
-		lastKey = result.LastEvaluatedKey
-		if lastKey == nil {
-			break
-		}
+	if !requireStore(w) {
+		return
 	}
 
-	// Find most active hour
-	mostActiveHour, maxHourCount := 0, 0
-	for h, c := range hourCounts {
-		if c > maxHourCount {
-			maxHourCount = c
-			mostActiveHour = h
-		}
+	var items []map[string]types.AttributeValue
+	err := store.ScanGames(r.Context(), GameFilter{Player: player}, func(page []map[string]types.AttributeValue) error {
+		items = append(items, page...)
+		return nil
+	})
+	if err != nil {
+		requestLogger(r.Context()).Error("scan failed", "err", err)
+		writeDatabaseError(w, err)
+		return
 	}
 
-	// Calculate rates
-	var xRate, oRate, tieRate float64
-	if totalGames > 0 {
-		xRate = float64(xWins) / float64(totalGames) * 100
-		oRate = float64(oWins) / float64(totalGames) * 100
-		tieRate = float64(totalTies) / float64(totalGames) * 100
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(playerStreaks(player, gameResultsByTime(items)))
+}
+
+// playerStreaks replays results, oldest first, from player's point of view.
+func playerStreaks(player string, results []GameResult) PlayerStreaks {
+	streaks := PlayerStreaks{Player: player}
+	for _, result := range results {
+		switch {
+		case result.IsTie:
+			streaks.LastResult = "tie"
+			streaks.CurrentStreak = 0
+		case result.Winner == player:
+			streaks.LastResult = "win"
+			streaks.CurrentStreak++
+			streaks.LongestStreak = max(streaks.LongestStreak, streaks.CurrentStreak)
+		default:
+			streaks.LastResult = "loss"
+			streaks.CurrentStreak = 0
+		}
 	}
+	return streaks
+}
 
-	resp := StatsResponse{
-		TotalGames:     totalGames,
-		TotalWins:      totalWins,
-		TotalTies:      totalTies,
-		TopPatterns:    patterns,
-		XWinRate:       xRate,
-		OWinRate:       oRate,
-		TieRate:        tieRate,
-		MostActiveHour: mostActiveHour,
-		LongestStreak:  longestStreak,
-		StreakHolder:   streakHolder,
-		UpdatedAt:      time.Now().UTC().Format(time.RFC3339),
+// patternExtremes returns the most and least used patterns, breaking ties
+// alphabetically so results are stable.
+func patternExtremes(patterns map[string]int) (favorite, leastUsed string) {
+	for p, c := range patterns {
+		if favorite == "" || c > patterns[favorite] || (c == patterns[favorite] && p < favorite) {
+			favorite = p
+		}
+		if leastUsed == "" || c < patterns[leastUsed] || (c == patterns[leastUsed] && p < leastUsed) {
+			leastUsed = p
+		}
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	return favorite, leastUsed
 }
 
-func recentGamesHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// adminAuthorized checks the X-Admin-Token header against ADMIN_TOKEN,
+// writing the error response itself when the request is not allowed.
+func adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		writeJSONError(w, http.StatusForbidden, "FORBIDDEN", "Admin endpoints disabled")
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(adminToken)) != 1 {
+		writeJSONError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid admin token")
+		return false
 	}
-	if dynamoClient == nil {
-		http.Error(w, "Database not available", http.StatusServiceUnavailable)
+	return true
+}
+
+// playerHandler serves player stats on GET and erasure on DELETE.
+func playerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		deletePlayerHandler(w, r)
 		return
 	}
+	playerStatsHandler(w, r)
+}
 
-	input := &dynamodb.ScanInput{
-		TableName: aws.String(tableName),
-		Limit:     aws.Int32(100),
+// deletedPlayerName replaces an erased player's name in saved games.
+const deletedPlayerName = "deleted_user"
+
+// deletePlayerHandler erases a player by renaming them to deleted_user in
+// every saved game, keeping the games so opponents' records stay intact.
+func deletePlayerHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
 	}
-	result, err := dynamoClient.Scan(context.Background(), input)
-	if err != nil {
-		dynamoDBOps.WithLabelValues("Scan", "error").Inc()
-		http.Error(w, "Database error", http.StatusInternalServerError)
+	player := r.URL.Query().Get("player")
+	if player == "" {
+		writeJSONError(w, http.StatusBadRequest, "MISSING_PARAMETER", "player parameter required")
 		return
 	}
-	dynamoDBOps.WithLabelValues("Scan", "success").Inc()
-
-	games := make([]RecentGame, 0)
-	for _, item := range result.Items {
-		mode := getStringAttr(item, "mode")
-		if mode != "online" {
-			continue
-		}
-		p1 := getStringAttr(item, "player1")
-		if len(p1) >= 9 && p1[:9] == "Synthetic" {
-			continue
-		}
-		games = append(games, RecentGame{
-			GameID:    getStringAttr(item, "gameId"),
-			Player1:   p1,
-			Player2:   getStringAttr(item, "player2"),
-			Winner:    getStringAttr(item, "winner"),
-			Pattern:   getStringAttr(item, "pattern"),
-			IsTie:     getBoolAttr(item, "isTie"),
-			Mode:      mode,
-			Timestamp: getStringAttr(item, "timestamp"),
-		})
+	if !requireStore(w) {
+		return
 	}
 
-	// Sort by timestamp descending
-	for i := 0; i < len(games); i++ {
-		for j := i + 1; j < len(games); j++ {
-			if games[j].Timestamp > games[i].Timestamp {
-				games[i], games[j] = games[j], games[i]
+	affected := 0
+	var anonymizeErr error
+	err := store.ScanGames(r.Context(), GameFilter{Player: player}, func(items []map[string]types.AttributeValue) error {
+		for _, item := range items {
+			if err := anonymizePlayer(r.Context(), item, player); err != nil {
+				requestLogger(r.Context()).Error("failed to anonymize game", "gameId", getStringAttr(item, "gameId"), "err", err)
+				anonymizeErr = err
+				return err
 			}
+			affected++
 		}
+		return nil
+	})
+	if anonymizeErr != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DATABASE_ERROR", fmt.Sprintf("Database error after %d games", affected))
+		return
 	}
-
-	if len(games) > 20 {
-		games = games[:20]
+	if err != nil {
+		requestLogger(r.Context()).Error("scan failed", "err", err)
+		writeDatabaseError(w, err)
+		return
 	}
 
+	winStreaksMu.Lock()
+	delete(winStreaks, player)
+	winStreakGauge.DeleteLabelValues(player)
+	winStreaksMu.Unlock()
+	responseCacheMu.Lock()
+	responseCache = make(map[string]cacheEntry)
+	responseCacheMu.Unlock()
+	requestLogger(r.Context()).Info("player data anonymized", "games", affected)
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(games)
+	json.NewEncoder(w).Encode(map[string]int{"affected": affected})
 }
 
-func playerStatsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// purgeHandler deletes every saved game with a player whose name starts with
+// prefix, e.g. /api/admin/purge?prefix=Synthetic to clear test data.
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
 		return
 	}
-	player := r.URL.Query().Get("player")
-	if player == "" {
-		http.Error(w, "player parameter required", http.StatusBadRequest)
+	if !adminAuthorized(w, r) {
 		return
 	}
-	if dynamoClient == nil {
-		http.Error(w, "Database not available", http.StatusServiceUnavailable)
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		writeJSONError(w, http.StatusBadRequest, "MISSING_PARAMETER", "prefix parameter required")
+		return
+	}
+	if !requireStore(w) {
 		return
 	}
 
-	stats := &PlayerStats{Player: player}
-	var lastKey map[string]types.AttributeValue
-
-	for {
-		input := &dynamodb.ScanInput{
-			TableName:         aws.String(tableName),
-			ExclusiveStartKey: lastKey,
-			FilterExpression:  aws.String("player1 = :p OR player2 = :p"),
-			ExpressionAttributeValues: map[string]types.AttributeValue{
-				":p": &types.AttributeValueMemberS{Value: player},
-			},
-		}
-		result, err := dynamoClient.Scan(context.Background(), input)
-		if err != nil {
-			dynamoDBOps.WithLabelValues("Scan", "error").Inc()
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			return
-		}
-		dynamoDBOps.WithLabelValues("Scan", "success").Inc()
-
-		for _, item := range result.Items {
-			stats.TotalGames++
-			if getBoolAttr(item, "isTie") {
-				stats.Ties++
-			} else {
-				winner := getStringAttr(item, "winner")
-				if winner == player {
-					stats.Wins++
-				} else {
-					stats.Losses++
-				}
+	deleted := 0
+	var deleteErr error
+	err := store.ScanGames(r.Context(), GameFilter{PlayerPrefix: prefix}, func(items []map[string]types.AttributeValue) error {
+		for _, item := range items {
+			if err := store.DeleteGame(r.Context(), getStringAttr(item, "gameId"), getStringAttr(item, "timestamp")); err != nil {
+				requestLogger(r.Context()).Error("failed to delete game", "gameId", getStringAttr(item, "gameId"), "err", err)
+				deleteErr = err
+				return err
 			}
+			deleted++
 		}
-
-		lastKey = result.LastEvaluatedKey
-		if lastKey == nil {
-			break
-		}
+		return nil
+	})
+	if deleteErr != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DATABASE_ERROR", fmt.Sprintf("Database error after %d games", deleted))
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("scan failed", "err", err)
+		writeDatabaseError(w, err)
+		return
 	}
 
-	if stats.TotalGames > 0 {
-		stats.WinRate = float64(stats.Wins) / float64(stats.TotalGames) * 100
+	winStreaksMu.Lock()
+	for player := range winStreaks {
+		if strings.HasPrefix(player, prefix) {
+			delete(winStreaks, player)
+			winStreakGauge.DeleteLabelValues(player)
+		}
 	}
+	winStreaksMu.Unlock()
+	responseCacheMu.Lock()
+	responseCache = make(map[string]cacheEntry)
+	responseCacheMu.Unlock()
+	requestLogger(r.Context()).Info("games purged", "prefix", prefix, "games", deleted)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(stats)
+	json.NewEncoder(w).Encode(map[string]int{"deleted": deleted})
+}
+
+// anonymizePlayer renames player to deletedPlayerName in one saved game.
+func anonymizePlayer(ctx context.Context, item map[string]types.AttributeValue, player string) error {
+	set := make(map[string]types.AttributeValue)
+	for _, attr := range []string{"player1", "player2", "winner", "seriesWinner"} {
+		if getStringAttr(item, attr) == player {
+			set[attr] = &types.AttributeValueMemberS{Value: deletedPlayerName}
+		}
+	}
+	return store.UpdateGame(ctx, getStringAttr(item, "gameId"), getStringAttr(item, "timestamp"), set)
 }
 
 func getStringAttr(item map[string]types.AttributeValue, key string) string {
@@ -953,47 +5041,120 @@ type GameReplay struct {
 	IsTie     bool   `json:"isTie"`
 	Timestamp string `json:"timestamp"`
 	Duration  int64  `json:"duration"`
+	Size      int64  `json:"size"`
 	Moves     []Move `json:"moves"`
+	// FirstPlayer is the mark that moved first (X or O)
+	FirstPlayer string `json:"firstPlayer"`
+	// Result is "win" or "tie" for finished games, otherwise the saved status
+	Result      string `json:"result"`
+	WinningLine []int  `json:"winningLine,omitempty"`
+	MoveTiming
+}
+
+// isLinePattern reports whether pattern names a winning line, as opposed to
+// "resignation" or "timeout", which record how a game ended without one and
+// are left out of pattern counts.
+func isLinePattern(pattern string) bool {
+	return pattern != "" && pattern != "resignation" && pattern != "timeout"
+}
+
+// winningLine maps a pattern name from checkWinSize back to the board indices
+// it covers, or nil for patterns without a line such as "timeout".
+func winningLine(pattern string, size int) []int {
+	var start, step, n int
+	switch {
+	case pattern == "diag1":
+		start, step = 0, size+1
+	case pattern == "diag2":
+		start, step = size-1, size-1
+	case strings.HasPrefix(pattern, "row"):
+		if _, err := fmt.Sscanf(pattern, "row%d", &n); err != nil || n < 1 || n > size {
+			return nil
+		}
+		start, step = (n-1)*size, 1
+	case strings.HasPrefix(pattern, "col"):
+		if _, err := fmt.Sscanf(pattern, "col%d", &n); err != nil || n < 1 || n > size {
+			return nil
+		}
+		start, step = n-1, size
+	default:
+		return nil
+	}
+	line := make([]int, size)
+	for i := range line {
+		line[i] = start + i*step
+	}
+	return line
+}
+
+// MoveTiming summarizes think time, the gap before each move (the first
+// measured from game start). PlayerAvgMs is keyed by player name.
+type MoveTiming struct {
+	AvgMoveTimeMs float64            `json:"avgMoveTimeMs"`
+	SlowestMoveMs int64              `json:"slowestMoveMs"`
+	FastestMoveMs int64              `json:"fastestMoveMs"`
+	PlayerAvgMs   map[string]float64 `json:"playerAvgMoveTimeMs"`
+}
+
+// moveTiming computes think times from moves, attributing X moves to player1
+// and O moves to player2.
+func moveTiming(moves []Move, player1, player2 string) MoveTiming {
+	timing := MoveTiming{PlayerAvgMs: make(map[string]float64)}
+	if len(moves) == 0 {
+		return timing
+	}
+	var total, prev int64
+	sums := make(map[string]int64)
+	counts := make(map[string]int)
+	for i, m := range moves {
+		d := m.Time - prev
+		prev = m.Time
+		total += d
+		if i == 0 || d > timing.SlowestMoveMs {
+			timing.SlowestMoveMs = d
+		}
+		if i == 0 || d < timing.FastestMoveMs {
+			timing.FastestMoveMs = d
+		}
+		player := player1
+		if m.Player == "O" {
+			player = player2
+		}
+		sums[player] += d
+		counts[player]++
+	}
+	timing.AvgMoveTimeMs = float64(total) / float64(len(moves))
+	for player, sum := range sums {
+		timing.PlayerAvgMs[player] = float64(sum) / float64(counts[player])
+	}
+	return timing
 }
 
 func gameReplayHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
 		return
 	}
 	gameID := r.URL.Query().Get("id")
 	if gameID == "" {
-		http.Error(w, "id parameter required", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "MISSING_PARAMETER", "id parameter required")
 		return
 	}
-	if dynamoClient == nil {
-		http.Error(w, "Database not available", http.StatusServiceUnavailable)
+	if !requireStore(w) {
 		return
 	}
 
-	// Query by gameId
-	input := &dynamodb.QueryInput{
-		TableName:              aws.String(tableName),
-		KeyConditionExpression: aws.String("gameId = :gid"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":gid": &types.AttributeValueMemberS{Value: gameID},
-		},
-		Limit: aws.Int32(1),
-	}
-	result, err := dynamoClient.Query(context.Background(), input)
+	item, err := store.QueryGame(r.Context(), gameID)
 	if err != nil {
-		dynamoDBOps.WithLabelValues("Query", "error").Inc()
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		requestLogger(r.Context()).Error("query failed", "err", err)
+		writeDatabaseError(w, err)
 		return
 	}
-	dynamoDBOps.WithLabelValues("Query", "success").Inc()
-
-	if len(result.Items) == 0 {
-		http.Error(w, "Game not found", http.StatusNotFound)
+	if item == nil {
+		writeGameError(w, ErrGameNotFound)
 		return
 	}
 
-	item := result.Items[0]
 	replay := GameReplay{
 		GameID:    getStringAttr(item, "gameId"),
 		Player1:   getStringAttr(item, "player1"),
@@ -1003,72 +5164,253 @@ func gameReplayHandler(w http.ResponseWriter, r *http.Request) {
 		IsTie:     getBoolAttr(item, "isTie"),
 		Timestamp: getStringAttr(item, "timestamp"),
 		Duration:  getIntAttr(item, "duration"),
+		Size:      getIntAttr(item, "size"),
 		Moves:     getMovesAttr(item, "moves"),
 	}
+	replay.FirstPlayer = firstPlayerMark(item)
+	if replay.Size == 0 {
+		replay.Size = 3 // saved before board sizes were configurable
+	}
+	replay.MoveTiming = moveTiming(replay.Moves, replay.Player1, replay.Player2)
+	switch {
+	case isUnfinished(item):
+		replay.Result = getStringAttr(item, "status")
+	case replay.IsTie:
+		replay.Result = "tie"
+	default:
+		replay.Result = "win"
+		replay.WinningLine = winningLine(replay.Pattern, int(replay.Size))
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(replay)
 }
 
+// replaysHandler lists the newest finished online games won with a given
+// pattern, e.g. /api/replays?pattern=diag1&limit=20.
+func replaysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	pattern := r.URL.Query().Get("pattern")
+	if pattern == "" {
+		writeJSONError(w, http.StatusBadRequest, "MISSING_PARAMETER", "pattern parameter required")
+		return
+	}
+	// The eight lines of the classic 3x3 board
+	if winningLine(pattern, 3) == nil {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_PARAMETER", "Invalid pattern")
+		return
+	}
+	limit, _, err := parsePagination(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_PARAMETER", err.Error())
+		return
+	}
+	if !requireStore(w) {
+		return
+	}
+
+	ctx := context.WithoutCancel(r.Context())
+	key := fmt.Sprintf("replays?pattern=%s&limit=%d", pattern, limit)
+	body, err := cachedJSON(key, func() (interface{}, error) {
+		return buildReplayList(ctx, pattern, limit)
+	})
+	if err != nil {
+		writeDatabaseError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// buildReplayList returns up to limit finished online games won with pattern,
+// newest first.
+func buildReplayList(ctx context.Context, pattern string, limit int) ([]RecentGame, error) {
+	var items []map[string]types.AttributeValue
+	filter := GameFilter{Mode: "online", Pattern: pattern, SkipSynthetic: true}
+	err := store.ScanGames(ctx, filter, func(page []map[string]types.AttributeValue) error {
+		for _, item := range page {
+			if !isUnfinished(item) {
+				items = append(items, item)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortItemsByTime(items)
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	replays := make([]RecentGame, 0, len(items))
+	for _, item := range items {
+		replays = append(replays, recentGameFromItem(item))
+	}
+	return replays, nil
+}
+
 func playerGamesHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
 		return
 	}
 	player := r.URL.Query().Get("player")
 	if player == "" {
-		http.Error(w, "player parameter required", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "MISSING_PARAMETER", "player parameter required")
 		return
 	}
-	if dynamoClient == nil {
-		http.Error(w, "Database not available", http.StatusServiceUnavailable)
+	if !requireStore(w) {
 		return
 	}
 
-	input := &dynamodb.ScanInput{
-		TableName:        aws.String(tableName),
-		FilterExpression: aws.String("(player1 = :p OR player2 = :p) AND #m = :online"),
-		ExpressionAttributeNames: map[string]string{
-			"#m": "mode",
-		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":p":      &types.AttributeValueMemberS{Value: player},
-			":online": &types.AttributeValueMemberS{Value: "online"},
-		},
-	}
-	result, err := dynamoClient.Scan(context.Background(), input)
+	games := make([]RecentGame, 0)
+	err := store.ScanGames(r.Context(), GameFilter{Mode: "online", Player: player}, func(items []map[string]types.AttributeValue) error {
+		for _, item := range items {
+			games = append(games, recentGameFromItem(item))
+		}
+		return nil
+	})
 	if err != nil {
-		dynamoDBOps.WithLabelValues("Scan", "error").Inc()
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		requestLogger(r.Context()).Error("scan failed", "err", err)
+		writeDatabaseError(w, err)
 		return
 	}
-	dynamoDBOps.WithLabelValues("Scan", "success").Inc()
 
-	games := make([]RecentGame, 0)
-	for _, item := range result.Items {
-		games = append(games, RecentGame{
-			GameID:    getStringAttr(item, "gameId"),
-			Player1:   getStringAttr(item, "player1"),
-			Player2:   getStringAttr(item, "player2"),
-			Winner:    getStringAttr(item, "winner"),
-			Pattern:   getStringAttr(item, "pattern"),
-			IsTie:     getBoolAttr(item, "isTie"),
-			Mode:      "online",
-			Timestamp: getStringAttr(item, "timestamp"),
-		})
+	sortGamesByTime(games)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(games)
+}
+
+// ExportedGame is one row of /api/export.
+type ExportedGame struct {
+	GameID    string `json:"gameId"`
+	Timestamp string `json:"timestamp"`
+	Player1   string `json:"player1"`
+	Player2   string `json:"player2"`
+	Winner    string `json:"winner"`
+	Pattern   string `json:"pattern"`
+	IsTie     bool   `json:"isTie"`
+	Duration  int64  `json:"duration"`
+	MoveCount int    `json:"moveCount"`
+}
+
+var exportColumns = []string{"gameId", "timestamp", "player1", "player2", "winner", "pattern", "isTie", "duration", "moveCount"}
+
+func (e ExportedGame) csvRecord() []string {
+	return []string{
+		e.GameID, e.Timestamp, e.Player1, e.Player2, e.Winner, e.Pattern,
+		strconv.FormatBool(e.IsTie), strconv.FormatInt(e.Duration, 10), strconv.Itoa(e.MoveCount),
 	}
+}
 
-	// Sort by timestamp descending
-	for i := 0; i < len(games); i++ {
-		for j := i + 1; j < len(games); j++ {
-			if games[j].Timestamp > games[i].Timestamp {
-				games[i], games[j] = games[j], games[i]
-			}
+func exportedGameFromItem(item map[string]types.AttributeValue) ExportedGame {
+	return ExportedGame{
+		GameID:    getStringAttr(item, "gameId"),
+		Timestamp: getStringAttr(item, "timestamp"),
+		Player1:   getStringAttr(item, "player1"),
+		Player2:   getStringAttr(item, "player2"),
+		Winner:    getStringAttr(item, "winner"),
+		Pattern:   getStringAttr(item, "pattern"),
+		IsTie:     getBoolAttr(item, "isTie"),
+		Duration:  getIntAttr(item, "duration"),
+		MoveCount: moveCount(item),
+	}
+}
+
+// exportHandler streams every online game as CSV (default) or a JSON array,
+// writing each scan page as it arrives. Errors after the first page can only
+// be logged, since the status line has already been sent.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		writeJSONError(w, http.StatusBadRequest, "INVALID_PARAMETER", "format must be csv or json")
+		return
+	}
+	if !requireStore(w) {
+		return
+	}
+
+	started := false
+	start := func() {
+		if started {
+			return
+		}
+		started = true
+		if format == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", "attachment; filename=games.json")
+		} else {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", "attachment; filename=games.csv")
+		}
+	}
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(games)
+	var err error
+	if format == "json" {
+		rows := 0
+		err = scanGamePages(r.Context(), "online", func(items []map[string]types.AttributeValue) error {
+			start()
+			for _, item := range items {
+				sep := ","
+				if rows == 0 {
+					sep = "["
+				}
+				line, err := json.Marshal(exportedGameFromItem(item))
+				if err != nil {
+					return err
+				}
+				if _, err := fmt.Fprintf(w, "%s\n%s", sep, line); err != nil {
+					return err
+				}
+				rows++
+			}
+			flush()
+			return nil
+		})
+		if started {
+			if rows == 0 {
+				w.Write([]byte("["))
+			}
+			w.Write([]byte("\n]\n"))
+		}
+	} else {
+		cw := csv.NewWriter(w)
+		err = scanGamePages(r.Context(), "online", func(items []map[string]types.AttributeValue) error {
+			if !started {
+				start()
+				cw.Write(exportColumns)
+			}
+			for _, item := range items {
+				cw.Write(exportedGameFromItem(item).csvRecord())
+			}
+			cw.Flush()
+			flush()
+			return cw.Error()
+		})
+	}
+	if err != nil {
+		if !started {
+			writeDatabaseError(w, err)
+			return
+		}
+		requestLogger(r.Context()).Error("export aborted", "err", err)
+	}
 }
 
 func getIntAttr(item map[string]types.AttributeValue, key string) int64 {
@@ -1104,30 +5446,250 @@ func getMovesAttr(item map[string]types.AttributeValue, key string) []Move {
 	return moves
 }
 
+// versionHandler reports which build is running.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"version":   Version,
+		"gitCommit": GitCommit,
+		"buildTime": BuildTime,
+		"goVersion": runtime.Version(),
+	})
+}
+
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("ok"))
 }
 
+// readyHandler reports whether DynamoDB is reachable and the startup warmup
+// has finished. Unlike /healthz it can fail, taking the pod out of the Service
+// without restarting it.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if warmupState() == "warming" {
+		writeJSONError(w, http.StatusServiceUnavailable, "NOT_READY", "Warming up win streaks")
+		return
+	}
+	if err := checkReady(); err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "NOT_READY", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// HealthDetail is the /api/health/detail response.
+type HealthDetail struct {
+	DynamoDB          string `json:"dynamodb"` // up, down or disabled
+	ActiveGames       int    `json:"activeGames"`
+	ActiveConnections int    `json:"activeConnections"`
+	UptimeSeconds     int64  `json:"uptimeSeconds"`
+	Warmup            string `json:"warmup"` // warming, done, timed_out or failed
+}
+
+// healthDetailHandler reports subsystem status for the status page. It always
+// answers 200; /healthz and /readyz remain the probes.
+func healthDetailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	detail := HealthDetail{
+		DynamoDB:          "disabled",
+		ActiveGames:       int(gaugeValue(onlineGamesActive)),
+		ActiveConnections: int(gaugeValue(wsConnectionsActive)),
+		UptimeSeconds:     int64(time.Since(startedAt).Seconds()),
+		Warmup:            warmupState(),
+	}
+	if store != nil {
+		detail.DynamoDB = "up"
+		if checkReady() != nil {
+			detail.DynamoDB = "down"
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
+
+// gaugeValue reads the current value of g.
+func gaugeValue(g prometheus.Gauge) float64 {
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		return 0
+	}
+	return m.GetGauge().GetValue()
+}
+
+// checkReady pings the game store (DescribeTable on DynamoDB), reusing the last result
+// for readyCacheTTL so frequent probes don't hammer DynamoDB.
+func checkReady() error {
+	if store == nil {
+		return errors.New("DynamoDB not configured")
+	}
+	readyMu.Lock()
+	defer readyMu.Unlock()
+	if time.Since(readyCheckedAt) < readyCacheTTL {
+		return readyErr
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := store.Ping(ctx); err != nil {
+		log.Printf("Readiness check failed: %v", err)
+		readyErr = errors.New("DynamoDB unreachable")
+	} else {
+		readyErr = nil
+		// The table may have been created or access granted since startup
+		setDynamoReady(true, "")
+	}
+	readyCheckedAt = time.Now()
+	return readyErr
+}
+
 func main() {
+	// Log JSON for Fluent Bit; this also routes the standard log package
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
 	initDynamoDB()
+	if d, err := time.ParseDuration(os.Getenv("WIN_STREAK_LOOKBACK")); err == nil && d >= 0 {
+		winStreakLookback = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("WIN_STREAK_LOAD_TIMEOUT")); err == nil && d > 0 {
+		winStreakLoadTimeout = d
+	}
+	setWarmup("warming")
+	initArchiver()
+	go runArchiver()
+	go runJanitor()
+	go runLeaderboardPublisher()
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8081"
 	}
-	http.HandleFunc("/api/game", metricsMiddleware("/api/game", corsMiddleware(gameHandler)))
-	http.HandleFunc("/api/game/create", metricsMiddleware("/api/game/create", corsMiddleware(createGameHandler)))
-	http.HandleFunc("/api/game/join", metricsMiddleware("/api/game/join", corsMiddleware(joinGameHandler)))
+	if d, err := time.ParseDuration(os.Getenv("PLAYER_SUBMIT_INTERVAL")); err == nil {
+		submitInterval = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("TURN_TIMEOUT")); err == nil {
+		turnTimeout = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("DEMO_MOVE_INTERVAL")); err == nil && d > 0 {
+		demoMoveInterval = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("GAME_RETENTION")); err == nil && d >= 0 {
+		gameRetention = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("CACHE_TTL")); err == nil {
+		cacheTTL = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("ANALYSIS_CACHE_TTL")); err == nil {
+		analysisCacheTTL = d
+	}
+	if v, err := strconv.Atoi(os.Getenv("DYNAMODB_WRITE_WORKERS")); err == nil && v > 0 {
+		saveWorkers = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("DYNAMODB_WRITE_QUEUE_SIZE")); err == nil && v >= 0 {
+		saveQueueSize = v
+	}
+	if d, err := time.ParseDuration(os.Getenv("DYNAMODB_WRITE_QUEUE_TIMEOUT")); err == nil && d >= 0 {
+		saveQueueTimeout = d
+	}
+	startSaveWorkers()
+	if v, err := strconv.ParseInt(os.Getenv("WS_MAX_MESSAGE_BYTES"), 10, 64); err == nil && v > 0 {
+		wsMaxMessageBytes = v
+	}
+	if v, err := strconv.ParseFloat(os.Getenv("RATE_LIMIT_RPS"), 64); err == nil {
+		rateLimitRPS = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("RATE_LIMIT_BURST")); err == nil && v > 0 {
+		rateLimitBurst = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("MAX_ACTIVE_GAMES")); err == nil && v > 0 {
+		maxActiveGames = v
+	}
+	allowedOrigins = parseOrigins(os.Getenv("ALLOWED_ORIGINS"))
+	wsAllowAllOrigins = os.Getenv("WS_ALLOW_ALL_ORIGINS") == "true"
+	http.HandleFunc("/api/game", metricsMiddleware("/api/game", corsMiddleware(rateLimitMiddleware("/api/game", rateLimitRPS, rateLimitBurst, gameHandler))))
+	http.HandleFunc("/api/game/demo", metricsMiddleware("/api/game/demo", corsMiddleware(rateLimitMiddleware("/api/game/demo", rateLimitRPS, rateLimitBurst, demoGameHandler))))
+	http.HandleFunc("/api/game/create", metricsMiddleware("/api/game/create", corsMiddleware(rateLimitMiddleware("/api/game/create", rateLimitRPS, rateLimitBurst, createGameHandler))))
+	http.HandleFunc("/api/game/join", metricsMiddleware("/api/game/join", corsMiddleware(rateLimitMiddleware("/api/game/join", rateLimitRPS, rateLimitBurst, joinGameHandler))))
+	http.HandleFunc("/api/game/leave", metricsMiddleware("/api/game/leave", corsMiddleware(rateLimitMiddleware("/api/game/leave", rateLimitRPS, rateLimitBurst, leaveGameHandler))))
+	http.HandleFunc("/api/game/move", metricsMiddleware("/api/game/move", corsMiddleware(rateLimitMiddleware("/api/game/move", rateLimitRPS, rateLimitBurst, moveHandler))))
 	http.HandleFunc("/api/game/get", metricsMiddleware("/api/game/get", corsMiddleware(getGameHandler)))
+	http.HandleFunc("/api/game/rematch", metricsMiddleware("/api/game/rematch", corsMiddleware(rateLimitMiddleware("/api/game/rematch", rateLimitRPS, rateLimitBurst, rematchHandler))))
+	http.HandleFunc("/api/game/ai", metricsMiddleware("/api/game/ai", corsMiddleware(rateLimitMiddleware("/api/game/ai", rateLimitRPS, rateLimitBurst, aiGameHandler))))
 	http.HandleFunc("/api/game/ws", wsHandler)
+	http.HandleFunc("/api/ai-stats", metricsMiddleware("/api/ai-stats", corsMiddleware(aiStatsHandler)))
 	http.HandleFunc("/api/leaderboard", metricsMiddleware("/api/leaderboard", corsMiddleware(leaderboardHandler)))
+	http.HandleFunc("/api/leaderboard/ws", leaderboardWSHandler)
+	http.HandleFunc("/api/elo", metricsMiddleware("/api/elo", corsMiddleware(eloHandler)))
 	http.HandleFunc("/api/stats", metricsMiddleware("/api/stats", corsMiddleware(statsHandler)))
+	http.HandleFunc("/api/patterns", metricsMiddleware("/api/patterns", corsMiddleware(patternsHandler)))
+	http.HandleFunc("/api/health/detail", metricsMiddleware("/api/health/detail", corsMiddleware(healthDetailHandler)))
+	http.HandleFunc("/api/version", metricsMiddleware("/api/version", corsMiddleware(versionHandler)))
+	http.HandleFunc("/api/heatmap", metricsMiddleware("/api/heatmap", corsMiddleware(heatmapHandler)))
+	http.HandleFunc("/api/analysis/ties", metricsMiddleware("/api/analysis/ties", corsMiddleware(tieAnalysisHandler)))
 	http.HandleFunc("/api/recent", metricsMiddleware("/api/recent", corsMiddleware(recentGamesHandler)))
-	http.HandleFunc("/api/player", metricsMiddleware("/api/player", corsMiddleware(playerStatsHandler)))
+	http.HandleFunc("/api/player", metricsMiddleware("/api/player", corsMiddleware(playerHandler)))
+	http.HandleFunc("/api/player/patterns", metricsMiddleware("/api/player/patterns", corsMiddleware(playerPatternsHandler)))
+	http.HandleFunc("/api/player/streaks", metricsMiddleware("/api/player/streaks", corsMiddleware(playerStreaksHandler)))
+	http.HandleFunc("/api/players/stats", metricsMiddleware("/api/players/stats", corsMiddleware(bulkPlayerStatsHandler)))
 	http.HandleFunc("/api/player/games", metricsMiddleware("/api/player/games", corsMiddleware(playerGamesHandler)))
+	http.HandleFunc("/api/export", metricsMiddleware("/api/export", corsMiddleware(exportHandler)))
 	http.HandleFunc("/api/replay", metricsMiddleware("/api/replay", corsMiddleware(gameReplayHandler)))
-	http.HandleFunc("/healthz", metricsMiddleware("/healthz", healthHandler))
-	http.Handle("/metrics", promhttp.Handler())
-	log.Printf("Backend starting on :%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	http.HandleFunc("/api/admin/purge", metricsMiddleware("/api/admin/purge", corsMiddleware(purgeHandler)))
+	http.HandleFunc("/api/debug/games", metricsMiddleware("/api/debug/games", corsMiddleware(debugGamesHandler)))
+	http.HandleFunc("/api/replays", metricsMiddleware("/api/replays", corsMiddleware(replaysHandler)))
+	// Ops endpoints share the API port unless METRICS_PORT gives them their
+	// own listener, e.g. one that is only reachable inside the cluster
+	opsMux := http.DefaultServeMux
+	metricsPort := os.Getenv("METRICS_PORT")
+	if metricsPort != "" {
+		opsMux = http.NewServeMux()
+	}
+	opsMux.HandleFunc("/healthz", metricsMiddleware("/healthz", healthHandler))
+	opsMux.HandleFunc("/readyz", metricsMiddleware("/readyz", readyHandler))
+	opsMux.Handle("/metrics", promhttp.Handler())
+	servers := []*http.Server{{Addr: ":" + port, Handler: requestIDMiddleware(http.DefaultServeMux)}}
+	if metricsPort != "" {
+		servers = append(servers, &http.Server{Addr: os.Getenv("METRICS_BIND_ADDR") + ":" + metricsPort, Handler: opsMux})
+	}
+	for _, srv := range servers {
+		go func() {
+			log.Printf("Backend %s (%s) starting on %s", Version, GitCommit, srv.Addr)
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+	go warmUp()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	<-stop
+	log.Println("Shutting down, draining connections")
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	// Stop taking requests first so no game is created or saved after the
+	// final writes below
+	close(shuttingDown)
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("HTTP shutdown: %v", err)
+		}
+	}
+	shutdownGames(ctx)
+	// Shutdown doesn't wait for hijacked connections, so drain WebSockets here
+	drained := make(chan struct{})
+	go func() {
+		wsDrain.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		log.Println("All connections drained")
+	case <-ctx.Done():
+		log.Println("Timed out waiting for WebSocket connections to drain")
+	}
 }
@@ -2,14 +2,29 @@ package main
 
 import (
 	"bytes"
+	"container/list"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func resetMetrics() {
@@ -19,9 +34,24 @@ func resetMetrics() {
 	tiesTotal.Reset()
 	winStreakGauge.Reset()
 	dynamoDBOps.Reset()
+	dynamoDBRetries.Reset()
+	wsMessagesTotal.Reset()
 	httpRequestsTotal.Reset()
+	httpResponsesTotal.Reset()
 	httpRequestDuration.Reset()
+	rateLimitedTotal.Reset()
+	gameDuration.Reset()
+	dynamoDBOpDuration.Reset()
+	movesPerGame.Reset()
+	movesRejected.Reset()
+	joinAttempts.Reset()
+	aiMoveDuration.Reset()
+	aiMovesTotal.Reset()
 	winStreaks = make(map[string]int)
+	lastSubmit = make(map[string]time.Time)
+	idempotencyKeys.Init()
+	idempotencyIndex = make(map[string]*list.Element)
+	responseCache = make(map[string]cacheEntry)
 }
 
 func TestGameHandler_Win(t *testing.T) {
@@ -48,10 +78,10 @@ func TestGameHandler_Win(t *testing.T) {
 	}
 
 	// Verify metrics
-	if got := testutil.ToFloat64(gamesTotal.WithLabelValues("win", "local")); got != 1 {
+	if got := testutil.ToFloat64(gamesTotal.WithLabelValues("win", "local", "none")); got != 1 {
 		t.Errorf("expected games_total{result=win,mode=local} = 1, got %f", got)
 	}
-	if got := testutil.ToFloat64(winsTotal.WithLabelValues("Alice", "row1", "local")); got != 1 {
+	if got := testutil.ToFloat64(winsTotal.WithLabelValues("Alice", "row1", "local", "none")); got != 1 {
 		t.Errorf("expected wins_total{player=Alice,pattern=row1,mode=local} = 1, got %f", got)
 	}
 	if got := testutil.ToFloat64(playerGamesTotal.WithLabelValues("Alice", "local")); got != 1 {
@@ -83,10 +113,10 @@ func TestGameHandler_Tie(t *testing.T) {
 		t.Errorf("expected status 200, got %d", w.Code)
 	}
 
-	if got := testutil.ToFloat64(gamesTotal.WithLabelValues("tie", "local")); got != 1 {
+	if got := testutil.ToFloat64(gamesTotal.WithLabelValues("tie", "local", "none")); got != 1 {
 		t.Errorf("expected games_total{result=tie,mode=local} = 1, got %f", got)
 	}
-	if got := testutil.ToFloat64(tiesTotal.WithLabelValues("local")); got != 1 {
+	if got := testutil.ToFloat64(tiesTotal.WithLabelValues("local", "none")); got != 1 {
 		t.Errorf("expected ties_total{mode=local} = 1, got %f", got)
 	}
 }
@@ -154,6 +184,49 @@ func TestGameHandler_InvalidJSON(t *testing.T) {
 	}
 }
 
+func TestReadyHandler_NoDB(t *testing.T) {
+	w := httptest.NewRecorder()
+	readyHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 when DB unavailable, got %d", w.Code)
+	}
+}
+
+func TestReadyHandler_Warmup(t *testing.T) {
+	useMemoryStore(t)
+	readyMu.Lock()
+	readyCheckedAt = time.Time{}
+	readyMu.Unlock()
+	defer setWarmup("done")
+	ready := func() int {
+		w := httptest.NewRecorder()
+		readyHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w.Code
+	}
+	detail := func() HealthDetail {
+		w := httptest.NewRecorder()
+		healthDetailHandler(w, httptest.NewRequest(http.MethodGet, "/api/health/detail", nil))
+		var d HealthDetail
+		json.NewDecoder(w.Body).Decode(&d)
+		return d
+	}
+
+	setWarmup("warming")
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 while warming up, got %d", code)
+	}
+	if d := detail(); d.Warmup != "warming" {
+		t.Errorf("expected warmup warming, got %q", d.Warmup)
+	}
+	warmUp()
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("expected 200 once warmed up, got %d", code)
+	}
+	if d := detail(); d.Warmup != "done" {
+		t.Errorf("expected warmup done, got %q", d.Warmup)
+	}
+}
+
 func TestHealthHandler(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
 	w := httptest.NewRecorder()
@@ -180,11 +253,58 @@ func TestCORSMiddleware(t *testing.T) {
 	if w.Header().Get("Access-Control-Allow-Origin") != "*" {
 		t.Error("expected CORS header")
 	}
+	if got := w.Header().Get("Access-Control-Allow-Headers"); got != "Content-Type, Idempotency-Key, X-Request-ID" {
+		t.Errorf("expected the Idempotency-Key and X-Request-ID request headers to be allowed, got %q", got)
+	}
 	if w.Code != http.StatusOK {
 		t.Errorf("expected status 200 for OPTIONS, got %d", w.Code)
 	}
 }
 
+func TestCORSMiddleware_AllowedOrigins(t *testing.T) {
+	allowedOrigins = parseOrigins("https://a.example, https://b.example")
+	defer func() { allowedOrigins = nil }()
+	handler := corsMiddleware(func(w http.ResponseWriter, r *http.Request) {})
+
+	for origin, want := range map[string]string{"https://b.example": "https://b.example", "https://evil.example": ""} {
+		req := httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+		req.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != want {
+			t.Errorf("origin %s: expected Allow-Origin %q, got %q", origin, want, got)
+		}
+		if w.Header().Get("Vary") != "Origin" {
+			t.Errorf("origin %s: expected Vary: Origin", origin)
+		}
+	}
+}
+
+func TestCheckWSOrigin(t *testing.T) {
+	check := func(origin string) bool {
+		req := httptest.NewRequest(http.MethodGet, "http://game.example/api/game/ws", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		return checkWSOrigin(req)
+	}
+	if !check("") || !check("https://game.example") || check("https://evil.example") {
+		t.Error("expected same-origin and Origin-less upgrades only without ALLOWED_ORIGINS")
+	}
+
+	allowedOrigins = parseOrigins("https://a.example")
+	defer func() { allowedOrigins = nil }()
+	if !check("https://a.example") || check("https://game.example") {
+		t.Error("expected only ALLOWED_ORIGINS to be accepted when set")
+	}
+
+	wsAllowAllOrigins = true
+	defer func() { wsAllowAllOrigins = false }()
+	if !check("https://evil.example") {
+		t.Error("expected WS_ALLOW_ALL_ORIGINS to accept any origin")
+	}
+}
+
 func TestMetricsMiddleware(t *testing.T) {
 	resetMetrics()
 
@@ -199,6 +319,177 @@ func TestMetricsMiddleware(t *testing.T) {
 	if got := testutil.ToFloat64(httpRequestsTotal.WithLabelValues("GET", "/test", "OK")); got != 1 {
 		t.Errorf("expected http_requests_total = 1, got %f", got)
 	}
+	if got := testutil.ToFloat64(httpResponsesTotal.WithLabelValues("2xx")); got != 1 {
+		t.Errorf("expected 1 2xx response, got %f", got)
+	}
+
+	notFound := metricsMiddleware("/test", http.NotFound)
+	notFound(httptest.NewRecorder(), req)
+	if got := testutil.ToFloat64(httpResponsesTotal.WithLabelValues("4xx")); got != 1 {
+		t.Errorf("expected 1 4xx response, got %f", got)
+	}
+}
+
+func TestGameHandler_IdempotencyKey(t *testing.T) {
+	resetMetrics()
+	post := func(key string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/game", strings.NewReader(`{"player1":"Alice","player2":"Bob","winner":"Alice","pattern":"row1"}`))
+		req.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		gameHandler(w, req)
+		return w.Code
+	}
+	for i := 0; i < 2; i++ {
+		if code := post("retry-1"); code != http.StatusOK {
+			t.Fatalf("attempt %d: expected 200, got %d", i+1, code)
+		}
+	}
+	if got := testutil.ToFloat64(gamesTotal.WithLabelValues("win", "local", "none")); got != 1 {
+		t.Errorf("expected a retried game to be recorded once, got %v", got)
+	}
+	post("retry-2")
+	if got := testutil.ToFloat64(gamesTotal.WithLabelValues("win", "local", "none")); got != 2 {
+		t.Errorf("expected a new key to be recorded, got %v", got)
+	}
+}
+
+func TestGameHandler_InvalidMoves(t *testing.T) {
+	resetMetrics()
+	for name, moves := range map[string]string{
+		"out of range":  `[{"index":9,"player":"X","time":0}]`,
+		"occupied":      `[{"index":0,"player":"X","time":0},{"index":0,"player":"O","time":500}]`,
+		"same player":   `[{"index":0,"player":"X","time":0},{"index":1,"player":"X","time":500}]`,
+		"bad mark":      `[{"index":0,"player":"Z","time":0}]`,
+		"time reversed": `[{"index":0,"player":"X","time":900},{"index":1,"player":"O","time":500}]`,
+	} {
+		body := `{"player1":"Alice","player2":"Bob","winner":"Alice","pattern":"row1","moves":` + moves + `}`
+		req := httptest.NewRequest(http.MethodPost, "/api/game", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		gameHandler(w, req)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "INVALID_MOVES") {
+			t.Errorf("%s: expected 400 INVALID_MOVES, got %d %s", name, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestQueueSave_DropsWhenFull(t *testing.T) {
+	startSaveWorkers()
+	pendingSaves.Wait()
+	// A queue nobody reads stays full
+	oldQueue, oldTimeout := saveQueue, saveQueueTimeout
+	saveQueue, saveQueueTimeout = make(chan func()), 10*time.Millisecond
+	defer func() { saveQueue, saveQueueTimeout = oldQueue, oldTimeout }()
+
+	before := testutil.ToFloat64(dynamoWritesDropped)
+	if queueSave("test", func() { t.Error("dropped save ran") }) {
+		t.Fatal("expected the save to be dropped")
+	}
+	if got := testutil.ToFloat64(dynamoWritesDropped) - before; got != 1 {
+		t.Errorf("expected one dropped write, got %v", got)
+	}
+	if got := testutil.ToFloat64(writeQueueDepth); got != 0 {
+		t.Errorf("expected an empty queue, got depth %v", got)
+	}
+	// Nothing is left for shutdown to wait on
+	pendingSaves.Wait()
+}
+
+func TestQueueSave_RunsSave(t *testing.T) {
+	ran := make(chan struct{})
+	if !queueSave("test", func() { close(ran) }) {
+		t.Fatal("expected the save to be queued")
+	}
+	select {
+	case <-ran:
+	case <-time.After(2 * time.Second):
+		t.Fatal("queued save never ran")
+	}
+}
+
+func TestSaveGameToDynamoDB_LocalMovesReplay(t *testing.T) {
+	fake := useMemoryStore(t)
+	moves := []Move{{0, "X", 0}, {3, "O", 800}, {1, "X", 1500}, {4, "O", 2100}, {2, "X", 3000}}
+	saveGameToDynamoDB(context.Background(), GameResult{Player1: "Alice", Player2: "Bob", Winner: "Alice", Pattern: "row1", Mode: "local", Moves: moves})
+	if len(fake.items) != 1 {
+		t.Fatalf("expected 1 saved item, got %d", len(fake.items))
+	}
+	id := getStringAttr(fake.items[0], "gameId")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/replay?id="+id, nil)
+	w := httptest.NewRecorder()
+	gameReplayHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var replay GameReplay
+	json.NewDecoder(w.Body).Decode(&replay)
+	if len(replay.Moves) != len(moves) || replay.Moves[4] != moves[4] {
+		t.Errorf("expected the recorded moves, got %+v", replay.Moves)
+	}
+	if replay.Duration != 3000 || replay.Size != 3 || replay.Result != "win" {
+		t.Errorf("expected duration 3000, size 3, result win; got %d, %d, %q", replay.Duration, replay.Size, replay.Result)
+	}
+}
+
+func TestArchiveItem_KeepsEveryAttribute(t *testing.T) {
+	item := savedGame("g1", "2024-01-01T00:00:00Z", "Alice", "Bob", "Alice", "row1")
+	item["seriesId"] = &types.AttributeValueMemberS{Value: "s1"}
+	item["synthetic"] = &types.AttributeValueMemberBOOL{Value: true}
+	item["ttl"] = &types.AttributeValueMemberN{Value: "1735689600"}
+	item["moves"] = &types.AttributeValueMemberL{Value: movesToAttr([]Move{{Index: 4, Player: "X", Time: 1200}})}
+
+	body, err := json.Marshal(archiveItem(item))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	json.Unmarshal(body, &got)
+	if len(got) != len(item) {
+		t.Errorf("expected %d attributes, got %d: %s", len(item), len(got), body)
+	}
+	if got["seriesId"] != "s1" || got["synthetic"] != true || got["ttl"] != float64(1735689600) {
+		t.Errorf("unexpected archived attributes %s", body)
+	}
+	moves, _ := got["moves"].([]interface{})
+	if move, _ := moves[0].(map[string]interface{}); len(moves) != 1 || move["index"] != float64(4) || move["player"] != "X" {
+		t.Errorf("unexpected archived moves %v", got["moves"])
+	}
+}
+
+func TestSetExpiry(t *testing.T) {
+	old := gameRetention
+	t.Cleanup(func() { gameRetention = old })
+
+	gameRetention = 24 * time.Hour
+	item := map[string]types.AttributeValue{}
+	setExpiry(item)
+	ttl := getIntAttr(item, "ttl")
+	if want := time.Now().Add(24 * time.Hour).Unix(); ttl < want-5 || ttl > want {
+		t.Errorf("expected ttl near %d, got %d", want, ttl)
+	}
+
+	gameRetention = 0
+	item = map[string]types.AttributeValue{}
+	setExpiry(item)
+	if _, ok := item["ttl"]; ok {
+		t.Error("expected no ttl when retention is disabled")
+	}
+}
+
+func TestSyntheticGamesHiddenByFlag(t *testing.T) {
+	useMemoryStore(t)
+	saveGameToDynamoDB(context.Background(), GameResult{Player1: "Synthetics", Player2: "Bob", Winner: "Synthetics", Pattern: "row1", Mode: "online"})
+	saveGameToDynamoDB(context.Background(), GameResult{Player1: "MonitorA", Player2: "MonitorB", Winner: "MonitorA", Pattern: "row1", Mode: "online", Synthetic: true})
+
+	w := httptest.NewRecorder()
+	recentGamesHandler(w, httptest.NewRequest(http.MethodGet, "/api/recent", nil))
+	var recent []RecentGame
+	if err := json.Unmarshal(w.Body.Bytes(), &recent); err != nil {
+		t.Fatalf("decoding recent games %q: %v", w.Body.String(), err)
+	}
+	if len(recent) != 1 || recent[0].Player1 != "Synthetics" {
+		t.Errorf("expected only the real player's game, got %+v", recent)
+	}
 }
 
 func TestAllWinningPatterns(t *testing.T) {
@@ -215,7 +506,7 @@ func TestAllWinningPatterns(t *testing.T) {
 		if w.Code != http.StatusOK {
 			t.Errorf("pattern %s: expected status 200, got %d", pattern, w.Code)
 		}
-		if got := testutil.ToFloat64(winsTotal.WithLabelValues("A", pattern, "local")); got != 1 {
+		if got := testutil.ToFloat64(winsTotal.WithLabelValues("A", pattern, "local", "none")); got != 1 {
 			t.Errorf("pattern %s: expected wins_total = 1, got %f", pattern, got)
 		}
 	}
@@ -241,6 +532,70 @@ func TestLeaderboardHandler_InvalidMethod(t *testing.T) {
 	}
 }
 
+func TestLeaderboardHandler_InvalidPagination(t *testing.T) {
+	for _, query := range []string{"limit=-1", "limit=abc", "offset=-5", "offset=1.5"} {
+		w := httptest.NewRecorder()
+		leaderboardHandler(w, httptest.NewRequest(http.MethodGet, "/api/leaderboard?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestParsePagination(t *testing.T) {
+	tests := []struct {
+		query         string
+		limit, offset int
+	}{
+		{"", 20, 0},
+		{"limit=5&offset=10", 5, 10},
+		{"limit=500", 100, 0},
+		{"limit=0", 0, 0},
+	}
+	for _, tt := range tests {
+		limit, offset, err := parsePagination(httptest.NewRequest(http.MethodGet, "/api/leaderboard?"+tt.query, nil))
+		if err != nil || limit != tt.limit || offset != tt.offset {
+			t.Errorf("%q: expected %d/%d, got %d/%d (%v)", tt.query, tt.limit, tt.offset, limit, offset, err)
+		}
+	}
+}
+
+func TestStatsHandler_InvalidRange(t *testing.T) {
+	for _, query := range []string{"from=yesterday", "to=2024-13-01T00:00:00Z"} {
+		w := httptest.NewRecorder()
+		statsHandler(w, httptest.NewRequest(http.MethodGet, "/api/stats?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestInTimeRange(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/stats?from=2024-01-01T00:00:00Z&to=2024-01-31T23:59:59Z", nil)
+	from, to, err := parseTimeRange(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests := map[string]bool{
+		"2024-01-15T12:00:00Z": true,
+		"2024-01-01T00:00:00Z": true,
+		"2023-12-31T23:59:59Z": false,
+		"2024-02-01T00:00:00Z": false,
+		"":                     false,
+	}
+	for ts, want := range tests {
+		if got := inTimeRange(ts, from, to); got != want {
+			t.Errorf("inTimeRange(%q) = %v, want %v", ts, got, want)
+		}
+	}
+
+	// Only from: to defaults to now
+	from, to, _ = parseTimeRange(httptest.NewRequest(http.MethodGet, "/api/stats?from=2024-01-01T00:00:00Z", nil))
+	if to.IsZero() || time.Since(to) > time.Minute {
+		t.Errorf("expected to to default to now, got %v", to)
+	}
+}
+
 func TestStatsHandler_InvalidMethod(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/api/stats", nil)
 	w := httptest.NewRecorder()
@@ -271,6 +626,139 @@ func TestPlayerStatsHandler_MissingPlayer(t *testing.T) {
 	}
 }
 
+func TestBulkPlayerStatsHandler(t *testing.T) {
+	useMemoryStore(t,
+		savedGame("g1", "2024-01-01T00:00:00Z", "Alice", "Bob", "Alice", "row1"),
+		savedGame("g2", "2024-01-02T00:00:00Z", "Bob", "Carol", "Bob", "col1"),
+		savedGame("g3", "2024-01-03T00:00:00Z", "Alice", "Carol", "", ""),
+	)
+	req := httptest.NewRequest(http.MethodPost, "/api/players/stats", strings.NewReader(`{"players":["Alice","Bob","Dave"]}`))
+	w := httptest.NewRecorder()
+	bulkPlayerStatsHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var stats map[string]PlayerStats
+	json.NewDecoder(w.Body).Decode(&stats)
+	if len(stats) != 3 {
+		t.Fatalf("expected 3 players, got %+v", stats)
+	}
+	if a := stats["Alice"]; a.Wins != 1 || a.Ties != 1 || a.TotalGames != 2 || a.WinRate != 50 {
+		t.Errorf("unexpected Alice stats: %+v", a)
+	}
+	if b := stats["Bob"]; b.Wins != 1 || b.Losses != 1 || b.TotalGames != 2 {
+		t.Errorf("unexpected Bob stats: %+v", b)
+	}
+	if d := stats["Dave"]; d.Player != "Dave" || d.TotalGames != 0 {
+		t.Errorf("expected empty stats for Dave, got %+v", d)
+	}
+}
+
+func TestBulkPlayerStatsHandler_TooManyPlayers(t *testing.T) {
+	names := make([]string, maxBulkPlayers+1)
+	for i := range names {
+		names[i] = fmt.Sprintf("p%d", i)
+	}
+	body, _ := json.Marshal(map[string][]string{"players": names})
+	req := httptest.NewRequest(http.MethodPost, "/api/players/stats", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	bulkPlayerStatsHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	old := GitCommit
+	GitCommit = "abc1234"
+	t.Cleanup(func() { GitCommit = old })
+
+	w := httptest.NewRecorder()
+	versionHandler(w, httptest.NewRequest(http.MethodGet, "/api/version", nil))
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp["gitCommit"] != "abc1234" || resp["version"] != Version || resp["goVersion"] != runtime.Version() {
+		t.Errorf("unexpected version info %v", resp)
+	}
+}
+
+func TestHealthDetailHandler(t *testing.T) {
+	get := func() HealthDetail {
+		w := httptest.NewRecorder()
+		healthDetailHandler(w, httptest.NewRequest(http.MethodGet, "/api/health/detail", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		var detail HealthDetail
+		json.NewDecoder(w.Body).Decode(&detail)
+		return detail
+	}
+	if d := get(); d.DynamoDB != "disabled" {
+		t.Errorf("expected dynamodb disabled without a store, got %q", d.DynamoDB)
+	}
+
+	useMemoryStore(t)
+	readyMu.Lock()
+	readyCheckedAt = time.Time{}
+	readyMu.Unlock()
+	onlineGamesActive.Set(3)
+	wsConnectionsActive.Set(5)
+	defer onlineGamesActive.Set(0)
+	defer wsConnectionsActive.Set(0)
+	d := get()
+	if d.DynamoDB != "up" || d.ActiveGames != 3 || d.ActiveConnections != 5 || d.UptimeSeconds < 0 {
+		t.Errorf("unexpected health detail %+v", d)
+	}
+}
+
+func TestCheckDynamoTable_MissingTable(t *testing.T) {
+	fake := useMemoryStore(t)
+	fake.pingErr = &types.ResourceNotFoundException{}
+	defer setDynamoReady(true, "")
+
+	checkDynamoTable("games")
+	w := httptest.NewRecorder()
+	recentGamesHandler(w, httptest.NewRequest(http.MethodGet, "/api/recent", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+	var body map[string]APIError
+	json.NewDecoder(w.Body).Decode(&body)
+	if body["error"].Code != "DATABASE_UNAVAILABLE" || body["error"].Message != "DynamoDB table games does not exist" {
+		t.Errorf("unexpected error %+v", body)
+	}
+
+	// Once the table exists the readiness probe brings reads back
+	fake.pingErr = nil
+	readyMu.Lock()
+	readyCheckedAt = time.Time{}
+	readyMu.Unlock()
+	if err := checkReady(); err != nil {
+		t.Fatalf("expected ready, got %v", err)
+	}
+	w = httptest.NewRecorder()
+	recentGamesHandler(w, httptest.NewRequest(http.MethodGet, "/api/recent", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 after recovery, got %d", w.Code)
+	}
+}
+
+func TestTableErrorReason(t *testing.T) {
+	denied := &smithyError{code: "AccessDeniedException"}
+	if got := tableErrorReason("games", fmt.Errorf("describe: %w", denied)); got != "Access denied to DynamoDB table games" {
+		t.Errorf("unexpected reason %q", got)
+	}
+	if got := tableErrorReason("games", errors.New("dial tcp: timeout")); got != "DynamoDB table games is unreachable" {
+		t.Errorf("unexpected reason %q", got)
+	}
+}
+
+// smithyError mimics an AWS API error carrying an error code.
+type smithyError struct{ code string }
+
+func (e *smithyError) Error() string     { return e.code }
+func (e *smithyError) ErrorCode() string { return e.code }
+
 func TestGetStringAttr(t *testing.T) {
 	// Test with missing key - returns empty string
 	item := make(map[string]types.AttributeValue)
@@ -290,3 +778,3295 @@ func TestEnsurePlayer(t *testing.T) {
 		t.Errorf("expected player name Alice, got %s", stats["Alice"].Player)
 	}
 }
+
+func TestGameHandler_PlayerSubmitThrottle(t *testing.T) {
+	resetMetrics()
+	submitInterval = time.Minute
+	defer func() { submitInterval = 0 }()
+
+	post := func(p1, p2 string) int {
+		game := GameResult{Player1: p1, Player2: p2, Winner: p1, Pattern: "row1", Mode: "local"}
+		body, _ := json.Marshal(game)
+		req := httptest.NewRequest(http.MethodPost, "/api/game", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		gameHandler(w, req)
+		return w.Code
+	}
+
+	if code := post("Alice", "Bob"); code != http.StatusOK {
+		t.Fatalf("expected first submission to succeed, got %d", code)
+	}
+	if code := post(" alice ", "Carol"); code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 for repeat player, got %d", code)
+	}
+	if code := post("Dave", "Erin"); code != http.StatusOK {
+		t.Errorf("expected unrelated players to be allowed, got %d", code)
+	}
+	if got := testutil.ToFloat64(playerGamesTotal.WithLabelValues("Carol", "local")); got != 0 {
+		t.Errorf("expected throttled game not to be recorded, got %f", got)
+	}
+}
+
+func TestParseChat(t *testing.T) {
+	chat, ok := parseChat(map[string]interface{}{"player": "Alice", "text": "gg\x07 wp\n"})
+	if !ok {
+		t.Fatal("expected valid chat message")
+	}
+	if chat["text"] != "gg wp" {
+		t.Errorf("expected control characters stripped, got %q", chat["text"])
+	}
+	if chat["player"] != "Alice" {
+		t.Errorf("expected player Alice, got %v", chat["player"])
+	}
+	if legacy, _ := parseChat(map[string]interface{}{"name": "Bob", "text": "hi"}); legacy["player"] != "Bob" {
+		t.Errorf("expected legacy name key to be accepted, got %v", legacy)
+	}
+
+	invalid := []interface{}{
+		nil,
+		"hello",
+		map[string]interface{}{"player": "Alice"},
+		map[string]interface{}{"player": "", "text": "hi"},
+		map[string]interface{}{"player": "Alice", "text": strings.Repeat("a", chatMaxLength+1)},
+	}
+	for i, p := range invalid {
+		if _, ok := parseChat(p); ok {
+			t.Errorf("case %d: expected chat payload to be rejected", i)
+		}
+	}
+}
+
+func TestGameNotFound_Consistent(t *testing.T) {
+	joinBody, _ := json.Marshal(map[string]string{"gameId": "missing", "player2": "Bob"})
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+		req     *http.Request
+	}{
+		{"get", getGameHandler, httptest.NewRequest(http.MethodGet, "/api/game/get?id=missing", nil)},
+		{"join", joinGameHandler, httptest.NewRequest(http.MethodPost, "/api/game/join", bytes.NewReader(joinBody))},
+		{"ws", wsHandler, httptest.NewRequest(http.MethodGet, "/api/game/ws?id=missing", nil)},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		tc.handler(w, tc.req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", tc.name, w.Code)
+		}
+		var body map[string]APIError
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body["error"].Code != "GAME_NOT_FOUND" {
+			t.Errorf("%s: expected GAME_NOT_FOUND error body, got %v (%v)", tc.name, body, err)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: expected JSON content type, got %q", tc.name, ct)
+		}
+	}
+}
+
+func TestLookupGame(t *testing.T) {
+	gamesMu.Lock()
+	games["lookup1"] = &OnlineGame{ID: "lookup1", Status: "waiting"}
+	gamesMu.Unlock()
+	defer func() {
+		gamesMu.Lock()
+		delete(games, "lookup1")
+		gamesMu.Unlock()
+	}()
+
+	if g, err := lookupGame("lookup1"); err != nil || g.ID != "lookup1" {
+		t.Errorf("expected game lookup1, got %v, %v", g, err)
+	}
+	if _, err := lookupGame("nope"); !errors.Is(err, ErrGameNotFound) {
+		t.Errorf("expected ErrGameNotFound, got %v", err)
+	}
+}
+
+func TestHandleAIMove_HardBlocksAndWins(t *testing.T) {
+	// X threatens row1; O must block at 2
+	board := [9]string{"X", "X", "", "", "O", "", "", "", ""}
+	if got := handleAIMove(board, "hard", "O", rand.New(rand.NewSource(1))); got != 2 {
+		t.Errorf("expected AI to block at 2, got %d", got)
+	}
+	// O can win on col2 at 7
+	board = [9]string{"X", "O", "X", "", "O", "", "X", "", ""}
+	if got := handleAIMove(board, "hard", "O", rand.New(rand.NewSource(1))); got != 7 {
+		t.Errorf("expected AI to win at 7, got %d", got)
+	}
+}
+
+func TestHandleAIMove_HardNeverLoses(t *testing.T) {
+	var board [9]string
+	turn := "X"
+	for !isBoardFull(board[:]) {
+		if mark, _ := checkWin(board); mark != "" {
+			break
+		}
+		board[handleAIMove(board, "hard", turn, rand.New(rand.NewSource(1)))] = turn
+		if turn == "X" {
+			turn = "O"
+		} else {
+			turn = "X"
+		}
+	}
+	if mark, _ := checkWin(board); mark != "" {
+		t.Errorf("expected perfect play to tie, %s won", mark)
+	}
+}
+
+func TestHandleAIMove_EasyPicksEmptyCell(t *testing.T) {
+	board := [9]string{"X", "O", "X", "O", "X", "O", "O", "X", ""}
+	for i := 0; i < 10; i++ {
+		if got := handleAIMove(board, "easy", "O", rand.New(rand.NewSource(1))); got != 8 {
+			t.Fatalf("expected only empty cell 8, got %d", got)
+		}
+	}
+}
+
+func TestHandleAIMove_Metrics(t *testing.T) {
+	resetMetrics()
+	var board [9]string
+	handleAIMove(board, "hard", "X", rand.New(rand.NewSource(1)))
+	handleAIMove(board, "easy", "X", rand.New(rand.NewSource(1)))
+	handleAIMove(board, "easy", "X", rand.New(rand.NewSource(1)))
+	if got := testutil.ToFloat64(aiMovesTotal.WithLabelValues("easy")); got != 2 {
+		t.Errorf("expected 2 easy AI moves, got %v", got)
+	}
+	if n := testutil.CollectAndCount(aiMoveDuration, "tictactoe_ai_move_duration_seconds"); n != 2 {
+		t.Errorf("expected a duration series per difficulty, got %d", n)
+	}
+}
+
+func TestAIGameHandler_RecordsAIMode(t *testing.T) {
+	resetMetrics()
+	body, _ := json.Marshal(AIMoveRequest{Board: [9]string{"X", "X", "", "O", "O", "", "X", "", ""}, Difficulty: "hard", Player: "Alice"})
+	req := httptest.NewRequest(http.MethodPost, "/api/game/ai", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	aiGameHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var resp AIMoveResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Index != 5 || resp.Winner != "AI" || resp.Pattern != "row2" || resp.Status != "finished" {
+		t.Errorf("expected AI to win with row2 at 5, got %+v", resp)
+	}
+	if got := testutil.ToFloat64(winsTotal.WithLabelValues("AI", "row2", "ai", "hard")); got != 1 {
+		t.Errorf("expected wins_total{player=AI,pattern=row2,mode=ai} = 1, got %f", got)
+	}
+}
+
+func TestAIGameHandler_PlayerSubmitThrottle(t *testing.T) {
+	resetMetrics()
+	submitInterval = time.Minute
+	defer func() { submitInterval = 0 }()
+
+	post := func(player string) int {
+		body, _ := json.Marshal(AIMoveRequest{Board: [9]string{"X", "X", "", "O", "O", "", "X", "", ""}, Difficulty: "hard", Player: player})
+		w := httptest.NewRecorder()
+		aiGameHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/ai", bytes.NewReader(body)))
+		return w.Code
+	}
+
+	if code := post("Alice"); code != http.StatusOK {
+		t.Fatalf("expected first finished game to be recorded, got %d", code)
+	}
+	if code := post("alice"); code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 for repeat player, got %d", code)
+	}
+	if code := post("Bob"); code != http.StatusOK {
+		t.Errorf("expected another player to be allowed, got %d", code)
+	}
+	if got := testutil.ToFloat64(winsTotal.WithLabelValues("AI", "row2", "ai", "hard")); got != 2 {
+		t.Errorf("expected the throttled game not to be recorded, got %v AI wins", got)
+	}
+}
+
+func TestAIGameHandler_SeedReplaysGame(t *testing.T) {
+	resetMetrics()
+	// play plays the human's moves, always the first empty cell, against the
+	// AI and returns the AI's replies
+	play := func(seed *int64) (int64, []int) {
+		var board [9]string
+		var replies []int
+		for {
+			for i, c := range board {
+				if c == "" {
+					board[i] = "X"
+					break
+				}
+			}
+			if mark, _ := checkWin(board); mark != "" || isBoardFull(board[:]) {
+				return *seed, replies
+			}
+			body, _ := json.Marshal(AIMoveRequest{Board: board, Difficulty: "medium", Player: "Alice", Seed: seed})
+			w := httptest.NewRecorder()
+			aiGameHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/ai", bytes.NewReader(body)))
+			var resp AIMoveResponse
+			json.NewDecoder(w.Body).Decode(&resp)
+			if seed == nil {
+				seed = &resp.Seed
+			} else if resp.Seed != *seed {
+				t.Fatalf("expected seed %d back, got %d", *seed, resp.Seed)
+			}
+			if resp.Status == "finished" {
+				return *seed, append(replies, resp.Index)
+			}
+			board = resp.Board
+			replies = append(replies, resp.Index)
+		}
+	}
+
+	seed, first := play(nil)
+	for i := 0; i < 5; i++ {
+		if _, again := play(&seed); !slices.Equal(again, first) {
+			t.Fatalf("expected seed %d to replay AI moves %v, got %v", seed, first, again)
+		}
+	}
+}
+
+func TestAIGameHandler_InvalidDifficulty(t *testing.T) {
+	body, _ := json.Marshal(AIMoveRequest{Difficulty: "impossible"})
+	req := httptest.NewRequest(http.MethodPost, "/api/game/ai", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	aiGameHandler(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", w.Code)
+	}
+}
+
+func TestAIGameHandler_RejectsUnreachableBoards(t *testing.T) {
+	resetMetrics()
+	tests := []struct {
+		name  string
+		board [9]string
+	}{
+		{"too many X", [9]string{"X", "X", "X", "", "", "", "", "", ""}},
+		{"O ahead", [9]string{"O", "", "", "", "", "", "", "", ""}},
+		{"AI already won", [9]string{"O", "O", "O", "X", "X", "", "X", "", ""}},
+		{"player's turn", [9]string{"X", "O", "", "", "", "", "", "", ""}},
+		{"winner did not move last", [9]string{"X", "X", "X", "O", "O", "O", "", "", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(AIMoveRequest{Board: tt.board, Difficulty: "easy", Player: "Alice"})
+			w := httptest.NewRecorder()
+			aiGameHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/ai", bytes.NewReader(body)))
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "INVALID_BOARD") {
+				t.Errorf("expected 400 INVALID_BOARD, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+	if got := testutil.ToFloat64(winsTotal.WithLabelValues("AI", "row1", "ai", "easy")); got != 0 {
+		t.Errorf("expected no AI win to be recorded, got %v", got)
+	}
+
+	// the player's winning move is still recorded
+	body, _ := json.Marshal(AIMoveRequest{Board: [9]string{"X", "X", "X", "O", "O", "", "", "", ""}, Difficulty: "easy", Player: "Alice"})
+	w := httptest.NewRecorder()
+	aiGameHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/ai", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the player's win to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := testutil.ToFloat64(winsTotal.WithLabelValues("Alice", "row1", "ai", "easy")); got != 1 {
+		t.Errorf("expected Alice's win to be recorded, got %v", got)
+	}
+}
+
+func TestHandleMessage_ConcurrentMoves(t *testing.T) {
+	resetMetrics()
+	game := &OnlineGame{ID: "race1", Size: 3, Board: make([]string, 9), Turn: "X", FirstPlayer: "X", Player1: "Alice", Player2: "Bob", Status: "playing", StartedAt: time.Now()}
+
+	finished := func() bool {
+		game.mu.Lock()
+		defer game.mu.Unlock()
+		return game.Status == "finished"
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		for _, player := range []string{"Alice", "Bob"} {
+			wg.Add(1)
+			go func(player string) {
+				defer wg.Done()
+				for !finished() {
+					for idx := 0; idx < 9; idx++ {
+						game.handleMessage(WSMessage{Type: "move", Payload: map[string]interface{}{"index": float64(idx), "player": player}})
+					}
+				}
+			}(player)
+		}
+	}
+	wg.Wait()
+
+	game.mu.Lock()
+	defer game.mu.Unlock()
+	filled := 0
+	for _, c := range game.Board {
+		if c != "" {
+			filled++
+		}
+	}
+	if filled != len(game.Moves) {
+		t.Errorf("expected %d moves for %d filled cells", len(game.Moves), filled)
+	}
+	if game.Status != "finished" {
+		t.Errorf("expected game to finish, got status %s", game.Status)
+	}
+}
+
+// TestHandleMessage_ConcurrentMovesWithConnections races moves from both
+// players while real connections (one subscribed to deltas) receive every
+// broadcast; run with -race.
+func TestHandleMessage_ConcurrentMovesWithConnections(t *testing.T) {
+	resetMetrics()
+	game := &OnlineGame{ID: "race2", Size: 3, Board: make([]string, 9), Turn: "O", FirstPlayer: "O", Player1: "Alice", Player2: "Bob", Status: "playing", StartedAt: time.Now()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := newWSClient(conn)
+		defer client.close()
+		game.mu.Lock()
+		game.Conns = append(game.Conns, client)
+		if r.URL.Query().Get("delta") == "true" {
+			if game.deltaConns == nil {
+				game.deltaConns = make(map[*wsClient]bool)
+			}
+			game.deltaConns[client] = true
+		}
+		game.mu.Unlock()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	// Each client reports the board of the first finished game_state it sees
+	results := make(chan []string, 3)
+	for _, query := range []string{"", "", "?delta=true"} {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+query, nil)
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		defer conn.Close()
+		go func() {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				var msg struct {
+					Type    string `json:"type"`
+					Payload struct {
+						Status string   `json:"status"`
+						Board  []string `json:"board"`
+					} `json:"payload"`
+				}
+				if err := conn.ReadJSON(&msg); err != nil {
+					results <- nil
+					return
+				}
+				if msg.Type == "game_state" && msg.Payload.Status == "finished" {
+					results <- msg.Payload.Board
+					return
+				}
+			}
+		}()
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		game.mu.Lock()
+		n := len(game.Conns)
+		game.mu.Unlock()
+		if n == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 connections, got %d", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	finished := func() bool {
+		game.mu.Lock()
+		defer game.mu.Unlock()
+		return game.Status == "finished"
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		player := []string{"Alice", "Bob"}[i%2]
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for !finished() {
+				for _, idx := range r.Perm(9) {
+					game.handleMessage(WSMessage{Type: "move", Payload: map[string]interface{}{"index": float64(idx), "player": player}})
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+
+	game.mu.Lock()
+	board := append([]string(nil), game.Board...)
+	moves := append([]Move(nil), game.Moves...)
+	winner, pattern := game.Winner, game.Pattern
+	game.mu.Unlock()
+
+	seen := make(map[int]bool)
+	for i, m := range moves {
+		if seen[m.Index] {
+			t.Errorf("cell %d marked twice", m.Index)
+		}
+		seen[m.Index] = true
+		if board[m.Index] != m.Player {
+			t.Errorf("move %d put %s on cell %d but the board has %q", i, m.Player, m.Index, board[m.Index])
+		}
+		if want := []string{"O", "X"}[i%2]; m.Player != want {
+			t.Errorf("move %d by %s, expected %s", i, m.Player, want)
+		}
+	}
+	filled := 0
+	for _, c := range board {
+		if c != "" {
+			filled++
+		}
+	}
+	if filled != len(moves) {
+		t.Errorf("expected %d moves for %d filled cells", len(moves), filled)
+	}
+	mark, wantPattern := checkWinSize(board, 3)
+	switch {
+	case mark == "":
+		if winner != "" || filled != 9 {
+			t.Errorf("expected a full-board tie, got winner %q with %d cells", winner, filled)
+		}
+	case mark != moves[len(moves)-1].Player:
+		t.Errorf("expected the last move to win, got %s winning after %s moved", mark, moves[len(moves)-1].Player)
+	case (mark == "X") != (winner == "Alice") || pattern != wantPattern:
+		t.Errorf("expected %s to win with %s, got %q with %s", mark, wantPattern, winner, pattern)
+	}
+	for i := 0; i < 3; i++ {
+		got := <-results
+		if strings.Join(got, ",") != strings.Join(board, ",") {
+			t.Errorf("client saw final board %v, expected %v", got, board)
+		}
+	}
+}
+
+func TestBroadcast_SlowClientDoesNotBlock(t *testing.T) {
+	serverConns := make(chan *websocket.Conn, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		serverConns <- conn
+	}))
+	defer srv.Close()
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		return conn
+	}
+	fast, stuck := dial(), dial()
+	defer fast.Close()
+	defer stuck.Close()
+	fastClient := newWSClient(<-serverConns)
+	defer fastClient.close()
+	// No writer goroutine, so nothing ever drains this client's buffer
+	stuckClient := &wsClient{conn: <-serverConns, send: make(chan []byte, wsSendBuffer), done: make(chan struct{})}
+
+	before := testutil.ToFloat64(wsSlowClientsClosed)
+	game := &OnlineGame{ID: "slow1", Conns: []*wsClient{fastClient}, Spectators: []*wsClient{stuckClient}}
+	n := wsSendBuffer + 1
+	// Read each message before the next broadcast so the fast client never falls behind
+	read := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			game.broadcast(WSMessage{Type: "reaction", Payload: i})
+			<-read
+		}
+	}()
+	fast.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for i := 0; i < n; i++ {
+		var msg WSMessage
+		if err := fast.ReadJSON(&msg); err != nil {
+			t.Fatalf("fast client missed message %d: %v", i, err)
+		}
+		read <- struct{}{}
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("broadcast blocked on a stuck client")
+	}
+	select {
+	case <-stuckClient.done:
+	default:
+		t.Error("expected the stuck client to be closed")
+	}
+	if got := testutil.ToFloat64(wsSlowClientsClosed) - before; got != 1 {
+		t.Errorf("expected one slow client closed, got %v", got)
+	}
+}
+
+func TestWSHandler_MalformedMove(t *testing.T) {
+	resetMetrics()
+	game := &OnlineGame{ID: "badmove", Size: 3, Board: make([]string, 9), Turn: "X", Player1: "Alice", Player2: "Bob", Status: "playing"}
+	gamesMu.Lock()
+	games[game.ID] = game
+	gamesMu.Unlock()
+	defer func() {
+		gamesMu.Lock()
+		delete(games, game.ID)
+		gamesMu.Unlock()
+	}()
+
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?id=badmove", nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	var state WSMessage
+	conn.ReadJSON(&state)
+
+	for _, raw := range []string{
+		`{"type":"move","payload":{}}`,
+		`{"type":"move","payload":{"index":"zero","player":"Alice"}}`,
+		`{"type":"move","payload":{"index":0,"player":7}}`,
+		`{"type":"move","payload":"nope"}`,
+	} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(raw)); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	// A valid move still goes through on the same connection afterwards
+	conn.WriteJSON(WSMessage{Type: "move", Payload: map[string]interface{}{"index": 4, "player": "Alice"}})
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.ReadJSON(&state); err != nil {
+		t.Fatalf("expected game_state after valid move, got %v", err)
+	}
+	if got := testutil.ToFloat64(wsMessagesTotal.WithLabelValues("move", "invalid")); got != 4 {
+		t.Errorf("expected 4 invalid move messages, got %f", got)
+	}
+}
+
+func TestMoveHandler(t *testing.T) {
+	resetMetrics()
+	game := &OnlineGame{ID: "httpmove", Size: 3, Board: make([]string, 9), Turn: "X", Player1: "Alice", Player2: "Bob", Status: "playing",
+		seatKeys: map[string]string{"Alice": "alice-key", "Bob": "bob-key"}}
+	gamesMu.Lock()
+	games[game.ID] = game
+	gamesMu.Unlock()
+	defer func() {
+		gamesMu.Lock()
+		delete(games, game.ID)
+		gamesMu.Unlock()
+	}()
+
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?id=httpmove", nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	var msg WSMessage
+	conn.ReadJSON(&msg)
+
+	keys := map[string]string{"Alice": "alice-key", "Bob": "bob-key"}
+	moveWithKey := func(player, key string, index int) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{"gameId": "httpmove", "player": player, "playerKey": key, "index": index})
+		w := httptest.NewRecorder()
+		moveHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/move", bytes.NewReader(body)))
+		return w
+	}
+	move := func(player string, index int) *httptest.ResponseRecorder {
+		return moveWithKey(player, keys[player], index)
+	}
+	// Neither a wrong key nor the opponent's key can move for Alice
+	for _, key := range []string{"", "wrong", "bob-key"} {
+		if w := moveWithKey("Alice", key, 4); w.Code != http.StatusForbidden {
+			t.Errorf("expected 403 for Alice with key %q, got %d", key, w.Code)
+		}
+	}
+	w := move("Alice", 4)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var state map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&state)
+	if board, _ := state["board"].([]interface{}); len(board) != 9 || board[4] != "X" || state["turn"] != "O" {
+		t.Errorf("unexpected state after move %v", state)
+	}
+	// The WebSocket client hears about the HTTP move
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("expected a broadcast for the HTTP move: %v", err)
+	}
+
+	for _, tc := range []struct {
+		player string
+		index  int
+		reason string
+	}{
+		{"Alice", 0, "not this player's turn"},
+		{"Bob", 4, "cell already taken"},
+		{"Bob", 9, "cell index out of range"},
+	} {
+		w := move(tc.player, tc.index)
+		var body map[string]APIError
+		json.NewDecoder(w.Body).Decode(&body)
+		if w.Code != http.StatusConflict || body["error"].Code != "ILLEGAL_MOVE" || body["error"].Message != tc.reason {
+			t.Errorf("%s at %d: expected 409 %q, got %d %+v", tc.player, tc.index, tc.reason, w.Code, body)
+		}
+	}
+	if got := testutil.ToFloat64(movesRejected.WithLabelValues("wrong_turn")); got != 1 {
+		t.Errorf("expected 1 wrong_turn rejection, got %v", got)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{"gameId": "nope", "player": "Alice", "index": 0})
+	w = httptest.NewRecorder()
+	moveHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/move", bytes.NewReader(body)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown game, got %d", w.Code)
+	}
+}
+
+func TestGetGameHandler_LongPoll(t *testing.T) {
+	game := &OnlineGame{ID: "poll1", Size: 3, Board: make([]string, 9), Turn: "X", Player1: "Alice", Player2: "Bob", Status: "playing"}
+	gamesMu.Lock()
+	games[game.ID] = game
+	gamesMu.Unlock()
+	defer func() {
+		gamesMu.Lock()
+		delete(games, game.ID)
+		gamesMu.Unlock()
+	}()
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		getGameHandler(w, httptest.NewRequest(http.MethodGet, "/api/game/get?id=poll1"+query, nil))
+		return w
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- get("&waitForVersion=0&timeout=5") }()
+	select {
+	case <-done:
+		t.Fatal("expected the poll to wait for a new version")
+	case <-time.After(50 * time.Millisecond):
+	}
+	game.mu.Lock()
+	game.applyMoveLocked("Alice", 4)
+	game.mu.Unlock()
+	select {
+	case w := <-done:
+		var state map[string]interface{}
+		json.NewDecoder(w.Body).Decode(&state)
+		if w.Code != http.StatusOK || state["version"] != float64(1) {
+			t.Errorf("expected version 1 after the move, got %d %v", w.Code, state)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("poll was not woken by the move")
+	}
+
+	// A version the game hasn't reached returns the current state on timeout
+	if w := get("&waitForVersion=7&timeout=0"); w.Code != http.StatusOK {
+		t.Errorf("expected 200 on timeout, got %d", w.Code)
+	}
+	if w := get("&waitForVersion=-1"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a negative version, got %d", w.Code)
+	}
+	if w := get("&waitForVersion=1&timeout=soon"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad timeout, got %d", w.Code)
+	}
+}
+
+func TestGameResultsByTime_RestoresStreaks(t *testing.T) {
+	resetMetrics()
+	game := func(ts, winner string, tie bool) map[string]types.AttributeValue {
+		item := map[string]types.AttributeValue{
+			"timestamp": &types.AttributeValueMemberS{Value: ts},
+			"player1":   &types.AttributeValueMemberS{Value: "Alice"},
+			"player2":   &types.AttributeValueMemberS{Value: "Bob"},
+			"isTie":     &types.AttributeValueMemberBOOL{Value: tie},
+		}
+		if winner != "" {
+			item["winner"] = &types.AttributeValueMemberS{Value: winner}
+		}
+		return item
+	}
+	// Scan order is arbitrary; Bob's win happened first, then Alice won twice
+	items := []map[string]types.AttributeValue{
+		game("2024-01-01T10:02:00Z", "Alice", false),
+		game("2024-01-01T10:00:00Z", "Bob", false),
+		game("2024-01-01T10:03:00Z", "Alice", false),
+	}
+	for _, result := range gameResultsByTime(items) {
+		updateWinStreaks(result)
+	}
+
+	if got := testutil.ToFloat64(winStreakGauge.WithLabelValues("Alice")); got != 2 {
+		t.Errorf("expected Alice streak = 2, got %f", got)
+	}
+	if streak, _ := getWinStreak("Bob"); streak != 0 {
+		t.Errorf("expected Bob streak = 0, got %d", streak)
+	}
+}
+
+func TestRematchHandler(t *testing.T) {
+	old := &OnlineGame{ID: "rm1", Size: 3, Board: make([]string, 9), FirstPlayer: "X", Player1: "Alice", Player2: "Bob", Status: "finished",
+		seatKeys: map[string]string{"Alice": "alice-key", "Bob": "bob-key"}}
+	gamesMu.Lock()
+	games[old.ID] = old
+	gamesMu.Unlock()
+
+	body, _ := json.Marshal(map[string]string{"gameId": "rm1", "player": "Bob"})
+	w := httptest.NewRecorder()
+	rematchHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/rematch", bytes.NewReader(body)))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 without a player key, got %d", w.Code)
+	}
+
+	rematch := func() map[string]interface{} {
+		body, _ := json.Marshal(map[string]string{"gameId": "rm1", "player": "Bob", "playerKey": "bob-key"})
+		w := httptest.NewRecorder()
+		rematchHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/rematch", bytes.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+		var state map[string]interface{}
+		json.NewDecoder(w.Body).Decode(&state)
+		return state
+	}
+	first := rematch()
+	if first["firstPlayer"] != "O" || first["player1"] != "Alice" || first["status"] != "waiting" {
+		t.Errorf("unexpected rematch state: %v", first)
+	}
+	if second := rematch(); second["id"] != first["id"] {
+		t.Errorf("expected repeated rematch to return %v, got %v", first["id"], second["id"])
+	}
+}
+
+func TestRematchHandler_StartsOnlyWithBothPlayers(t *testing.T) {
+	client := func() *wsClient { return &wsClient{send: make(chan []byte, 8), done: make(chan struct{})} }
+	alice := client()
+	for _, tc := range []struct {
+		id          string
+		playerConns map[string]*wsClient
+		want        string
+	}{
+		// Alice in two tabs plus a stranger is not Bob
+		{"rmboth1", map[string]*wsClient{"Alice": alice}, "waiting"},
+		{"rmboth2", map[string]*wsClient{"Alice": alice, "Bob": client()}, "playing"},
+	} {
+		old := &OnlineGame{ID: tc.id, Size: 3, Board: make([]string, 9), FirstPlayer: "X", Player1: "Alice", Player2: "Bob", Status: "finished",
+			Conns: []*wsClient{alice, client(), client()}, playerConns: tc.playerConns, seatKeys: map[string]string{"Alice": "alice-key"}}
+		gamesMu.Lock()
+		games[old.ID] = old
+		gamesMu.Unlock()
+
+		body, _ := json.Marshal(map[string]string{"gameId": tc.id, "player": "Alice", "playerKey": "alice-key"})
+		w := httptest.NewRecorder()
+		rematchHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/rematch", bytes.NewReader(body)))
+		var state map[string]interface{}
+		json.NewDecoder(w.Body).Decode(&state)
+		if w.Code != http.StatusOK || state["status"] != tc.want {
+			t.Errorf("%s: expected a %s rematch, got %d %v", tc.id, tc.want, w.Code, state["status"])
+		}
+		if game, err := lookupGame(old.RematchID); err == nil {
+			game.mu.Lock()
+			if game.turnTimer != nil {
+				game.turnTimer.Stop()
+			}
+			game.mu.Unlock()
+		}
+	}
+}
+
+func TestRematchHandler_AtCapacity(t *testing.T) {
+	expireWaitingGames(time.Now().Add(-waitingGameTTL))
+	defer func(n int) { maxActiveGames = n }(maxActiveGames)
+	gamesMu.Lock()
+	games["rmcap1"] = &OnlineGame{ID: "rmcap1", Player1: "Carol", Player2: "Dave", Status: "playing"}
+	games["rmcap2"] = &OnlineGame{ID: "rmcap2", Size: 3, Board: make([]string, 9), FirstPlayer: "X", Player1: "Alice", Player2: "Bob", Status: "finished",
+		seatKeys: map[string]string{"Alice": "alice-key"}}
+	gamesMu.Unlock()
+	defer func() {
+		gamesMu.Lock()
+		delete(games, "rmcap1")
+		delete(games, "rmcap2")
+		gamesMu.Unlock()
+	}()
+	maxActiveGames = activeGameCount()
+	before := testutil.ToFloat64(gamesRejectedCapacity)
+
+	body, _ := json.Marshal(map[string]string{"gameId": "rmcap2", "player": "Alice", "playerKey": "alice-key"})
+	w := httptest.NewRecorder()
+	rematchHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/rematch", bytes.NewReader(body)))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After at capacity, got %d", w.Code)
+	}
+	if got := testutil.ToFloat64(gamesRejectedCapacity) - before; got != 1 {
+		t.Errorf("expected 1 rejection counted, got %v", got)
+	}
+}
+
+func TestRematchHandler_NotFinished(t *testing.T) {
+	gamesMu.Lock()
+	games["rm2"] = &OnlineGame{ID: "rm2", Player1: "Alice", Player2: "Bob", Status: "playing", seatKeys: map[string]string{"Alice": "alice-key"}}
+	gamesMu.Unlock()
+	body, _ := json.Marshal(map[string]string{"gameId": "rm2", "player": "Alice", "playerKey": "alice-key"})
+	w := httptest.NewRecorder()
+	rematchHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/rematch", bytes.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", w.Code)
+	}
+}
+
+func TestRematchHandler_PrivateGame(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	old := &OnlineGame{ID: "rm3", Size: 3, Board: make([]string, 9), FirstPlayer: "X", Player1: "Alice", Player2: "Bob", Status: "finished",
+		passwordHash: hash, seatKeys: map[string]string{"Alice": "alice-key", "Bob": "bob-key"}}
+	gamesMu.Lock()
+	games[old.ID] = old
+	gamesMu.Unlock()
+	rematch := func(password string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"gameId": "rm3", "player": "Alice", "playerKey": "alice-key", "password": password})
+		w := httptest.NewRecorder()
+		rematchHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/rematch", bytes.NewReader(body)))
+		return w
+	}
+	if w := rematch("guess"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a wrong password, got %d", w.Code)
+	}
+	w := rematch("secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var state map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&state)
+	next, err := lookupGame(state["id"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.mu.Lock()
+	defer next.mu.Unlock()
+	if next.passwordHash == nil || !next.seatAuthorizedLocked("Bob", "bob-key") {
+		t.Error("expected the rematch to stay private with the same player keys")
+	}
+}
+
+func TestWSHandler_SpectatorReadOnly(t *testing.T) {
+	resetMetrics()
+	game := &OnlineGame{ID: "spec1", Size: 3, Board: make([]string, 9), Turn: "X", Player1: "Alice", Player2: "Bob", Status: "playing"}
+	gamesMu.Lock()
+	games[game.ID] = game
+	gamesMu.Unlock()
+
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "?id=spec1"
+	player, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer player.Close()
+	spectator, _, err := websocket.DefaultDialer.Dial(url+"&spectator=true", nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer spectator.Close()
+
+	var msg WSMessage
+	player.ReadJSON(&msg)
+	spectator.ReadJSON(&msg)
+	if got := msg.Payload.(map[string]interface{})["spectators"]; got != float64(1) {
+		t.Errorf("expected spectator count 1, got %v", got)
+	}
+
+	// Spectator impersonating Alice is ignored; Alice's own move is broadcast to the spectator
+	spectator.WriteJSON(WSMessage{Type: "move", Payload: map[string]interface{}{"index": 0, "player": "Alice"}})
+	player.WriteJSON(WSMessage{Type: "move", Payload: map[string]interface{}{"index": 4, "player": "Alice"}})
+	spectator.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := spectator.ReadJSON(&msg); err != nil {
+		t.Fatalf("expected spectator to receive game_state, got %v", err)
+	}
+	board := msg.Payload.(map[string]interface{})["board"].([]interface{})
+	if board[0] != "" || board[4] != "X" {
+		t.Errorf("expected only Alice's move at 4, got board %v", board)
+	}
+	if got := testutil.ToFloat64(onlineSpectatorsActive); got != 1 {
+		t.Errorf("expected 1 active spectator, got %f", got)
+	}
+}
+
+func TestTurnTimeout_ForfeitsGame(t *testing.T) {
+	resetMetrics()
+	old := turnTimeout
+	turnTimeout = 20 * time.Millisecond
+	defer func() { turnTimeout = old }()
+
+	gamesMu.Lock()
+	games["tt1"] = &OnlineGame{ID: "tt1", Size: 3, Board: make([]string, 9), Turn: "O", FirstPlayer: "O", Player1: "Alice", Status: "waiting"}
+	gamesMu.Unlock()
+	body, _ := json.Marshal(map[string]string{"gameId": "tt1", "player2": "Bob"})
+	w := httptest.NewRecorder()
+	joinGameHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/join", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	game, _ := lookupGame("tt1")
+	deadline := time.Now().Add(time.Second)
+	for {
+		game.mu.Lock()
+		status, winner, pattern := game.Status, game.Winner, game.Pattern
+		game.mu.Unlock()
+		if status == "finished" {
+			if winner != "Alice" || pattern != "timeout" {
+				t.Errorf("expected Alice to win by timeout, got winner=%q pattern=%q", winner, pattern)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected game to be forfeited")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(winsTotal.WithLabelValues("Alice", "timeout", "online", "none")); got != 1 {
+		t.Errorf("expected 1 timeout win for Alice, got %v", got)
+	}
+}
+
+func TestSnapshotGames(t *testing.T) {
+	game := newOnlineGame("Alice", "X", 3, false)
+	snapshot := snapshotGames()
+	found := false
+	for i, g := range snapshot {
+		if g == game {
+			found = true
+			snapshot[i] = nil
+		}
+	}
+	if !found {
+		t.Fatalf("expected game %s in the snapshot", game.ID)
+	}
+	// The snapshot is a copy; changing it leaves the map alone
+	if g, err := lookupGame(game.ID); err != nil || g != game {
+		t.Errorf("expected game %s to still be registered, got %v", game.ID, err)
+	}
+}
+
+func TestExpireWaitingGames(t *testing.T) {
+	stale := &OnlineGame{ID: "exp1", Player1: "Alice", Status: "waiting", CreatedAt: time.Now().Add(-time.Hour)}
+	fresh := &OnlineGame{ID: "exp2", Player1: "Alice", Status: "waiting", CreatedAt: time.Now()}
+	playing := &OnlineGame{ID: "exp3", Player1: "Alice", Player2: "Bob", Status: "playing", CreatedAt: time.Now().Add(-time.Hour)}
+	gamesMu.Lock()
+	for _, g := range []*OnlineGame{stale, fresh, playing} {
+		games[g.ID] = g
+	}
+	gamesMu.Unlock()
+	before := testutil.ToFloat64(onlineGamesExpired)
+	abandoned := testutil.ToFloat64(onlineGamesAbandoned)
+
+	n := expireWaitingGames(time.Now().Add(-waitingGameTTL))
+	if n < 1 {
+		t.Errorf("expected at least 1 expired game, got %d", n)
+	}
+	if _, err := lookupGame("exp1"); !errors.Is(err, ErrGameNotFound) {
+		t.Errorf("expected stale waiting game to be removed, got %v", err)
+	}
+	for _, id := range []string{"exp2", "exp3"} {
+		if _, err := lookupGame(id); err != nil {
+			t.Errorf("expected game %s to be kept, got %v", id, err)
+		}
+	}
+	if got := testutil.ToFloat64(onlineGamesExpired) - before; got != float64(n) {
+		t.Errorf("expected expired counter to increase by %d, got %v", n, got)
+	}
+	if got := testutil.ToFloat64(onlineGamesAbandoned) - abandoned; got != float64(n) {
+		t.Errorf("expected abandoned counter to increase by %d, got %v", n, got)
+	}
+}
+
+func TestKeepAlive_ClosesWithoutPong(t *testing.T) {
+	closed := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		stop := keepAlive(conn, 100*time.Millisecond, 20*time.Millisecond)
+		defer stop()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	// Swallow pings without answering, like a connection dropped by the load balancer
+	conn.SetPingHandler(func(string) error { return nil })
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected server to drop the connection without pongs")
+	}
+}
+
+func syntheticRecentGames(n int) []RecentGame {
+	games := make([]RecentGame, n)
+	for i := range games {
+		games[i] = RecentGame{GameID: fmt.Sprint(i), Timestamp: time.Unix(int64(rand.Intn(1e9)), 0).UTC().Format(time.RFC3339)}
+	}
+	return games
+}
+
+func TestSortGamesByTime(t *testing.T) {
+	games := syntheticRecentGames(1000)
+	sortGamesByTime(games)
+	for i := 1; i < len(games); i++ {
+		if games[i].Timestamp > games[i-1].Timestamp {
+			t.Fatalf("games not sorted newest first at %d: %s after %s", i, games[i].Timestamp, games[i-1].Timestamp)
+		}
+	}
+}
+
+// bubbleSortGames is the nested-loop sort the handlers used before, kept as a baseline
+func bubbleSortGames(games []RecentGame) {
+	for i := 0; i < len(games); i++ {
+		for j := i + 1; j < len(games); j++ {
+			if games[j].Timestamp > games[i].Timestamp {
+				games[i], games[j] = games[j], games[i]
+			}
+		}
+	}
+}
+
+func BenchmarkSortGamesByTime(b *testing.B) {
+	games := syntheticRecentGames(10000)
+	work := make([]RecentGame, len(games))
+	b.Run("sort.Slice", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			copy(work, games)
+			sortGamesByTime(work)
+		}
+	})
+	b.Run("bubble", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			copy(work, games)
+			bubbleSortGames(work)
+		}
+	})
+}
+
+func BenchmarkSortPlayersByWins(b *testing.B) {
+	players := make([]PlayerStats, 10000)
+	for i := range players {
+		players[i] = PlayerStats{Player: fmt.Sprint(i), Wins: rand.Intn(1000)}
+	}
+	work := make([]PlayerStats, len(players))
+	for i := 0; i < b.N; i++ {
+		copy(work, players)
+		sortPlayersByWins(work)
+	}
+}
+
+func TestComputeElo(t *testing.T) {
+	elo := computeElo([]GameResult{
+		{Player1: "Alice", Player2: "Bob", Winner: "Alice"},
+		{Player1: "Alice", Player2: "Carol", IsTie: true},
+	})
+	// Even match: winner gains K/2. Alice (1216) then ties Carol (1200): expected ~0.523
+	if elo["Alice"] != 1215 || elo["Bob"] != 1184 || elo["Carol"] != 1201 {
+		t.Errorf("unexpected ratings: %v", elo)
+	}
+}
+
+func TestLeaderboardHandler_InvalidSort(t *testing.T) {
+	w := httptest.NewRecorder()
+	leaderboardHandler(w, httptest.NewRequest(http.MethodGet, "/api/leaderboard?sort=losses", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", w.Code)
+	}
+}
+
+func TestCachedJSON_SingleScanUnderLoad(t *testing.T) {
+	resetMetrics()
+	var mu sync.Mutex
+	builds := 0
+	build := func() (interface{}, error) {
+		mu.Lock()
+		builds++
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		return map[string]int{"totalGames": 1}, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, err := cachedJSON("test?load", build)
+			if err != nil || string(body) != `{"totalGames":1}` {
+				t.Errorf("unexpected response %q, %v", body, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if builds != 1 {
+		t.Errorf("expected 1 build for concurrent misses, got %d", builds)
+	}
+	before := testutil.ToFloat64(cacheHits)
+	cachedJSON("test?load", build)
+	if builds != 1 || testutil.ToFloat64(cacheHits)-before != 1 {
+		t.Errorf("expected fresh entry to be served from cache, builds=%d", builds)
+	}
+}
+
+func TestCachedJSON_ErrorsNotCached(t *testing.T) {
+	resetMetrics()
+	fail := func() (interface{}, error) { return nil, errors.New("scan failed") }
+	if _, err := cachedJSON("test?error", fail); err == nil {
+		t.Fatal("expected build error")
+	}
+	body, err := cachedJSON("test?error", func() (interface{}, error) { return []int{1}, nil })
+	if err != nil || string(body) != "[1]" {
+		t.Errorf("expected retry after error, got %q, %v", body, err)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	resetMetrics()
+	handler := rateLimitMiddleware("/api/game/create", 1, 2, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	request := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/game/create", nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+	for i := 0; i < 2; i++ {
+		if w := request("10.0.0.1"); w.Code != http.StatusOK {
+			t.Fatalf("request %d within burst: expected 200, got %d", i, w.Code)
+		}
+	}
+	w := request("10.0.0.1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected 429 with Retry-After 1, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := request("10.0.0.2"); w.Code != http.StatusOK {
+		t.Errorf("expected other client to be allowed, got %d", w.Code)
+	}
+	if got := testutil.ToFloat64(rateLimitedTotal.WithLabelValues("/api/game/create")); got != 1 {
+		t.Errorf("expected 1 rate limited request, got %v", got)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.9:5555"
+	if got := clientIP(req); got != "10.0.0.9" {
+		t.Errorf("expected remote address, got %q", got)
+	}
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.7")
+	if got := clientIP(req); got != "203.0.113.7" {
+		t.Errorf("expected last forwarded hop, got %q", got)
+	}
+}
+
+func TestValidatePlayerName(t *testing.T) {
+	tests := []struct {
+		name, want string
+		ok         bool
+	}{
+		{"Alice", "Alice", true},
+		{"  Bob  ", "Bob", true},
+		{"", "", false},
+		{"   ", "", false},
+		{strings.Repeat("a", 32), strings.Repeat("a", 32), true},
+		{strings.Repeat("a", 33), "", false},
+		{"Eve\x00", "", false},
+		{"Mal\nlory", "", false},
+	}
+	for _, tt := range tests {
+		got, err := validatePlayerName(tt.name)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("validatePlayerName(%q) = %q, %v; want %q, ok=%v", tt.name, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestWritePaths_RejectInvalidNames(t *testing.T) {
+	resetMetrics()
+	long := strings.Repeat("x", 100)
+	requests := []struct {
+		handler http.HandlerFunc
+		body    interface{}
+	}{
+		{gameHandler, GameResult{Player1: long, Player2: "Bob", Winner: long}},
+		{gameHandler, GameResult{Player1: "Alice", Player2: "Bob", Winner: "Mallory"}},
+		{createGameHandler, map[string]string{"player1": "bad\x07name"}},
+		{joinGameHandler, map[string]string{"gameId": "any", "player2": long}},
+		{aiGameHandler, AIMoveRequest{Difficulty: "easy", Player: long}},
+	}
+	for i, req := range requests {
+		body, _ := json.Marshal(req.body)
+		w := httptest.NewRecorder()
+		req.handler(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("request %d: expected status 400, got %d", i, w.Code)
+		}
+	}
+	if got := testutil.CollectAndCount(playerGamesTotal); got != 0 {
+		t.Errorf("expected no player metrics recorded, got %d series", got)
+	}
+}
+
+func TestHandleMessage_Takeback(t *testing.T) {
+	game := &OnlineGame{ID: "tb1", Size: 3, Board: make([]string, 9), Turn: "X", FirstPlayer: "X", Player1: "Alice", Player2: "Bob", Status: "playing"}
+	send := func(typ, player string, extra map[string]interface{}) {
+		payload := map[string]interface{}{"player": player}
+		for k, v := range extra {
+			payload[k] = v
+		}
+		game.handleMessage(WSMessage{Type: typ, Payload: payload})
+	}
+
+	send("takeback_request", "Bob", nil) // nothing to take back yet
+	send("move", "Alice", map[string]interface{}{"index": float64(4)})
+	send("takeback_accept", "Bob", nil) // no pending request
+	if len(game.Moves) != 1 {
+		t.Fatalf("expected accept without request to be ignored, got %d moves", len(game.Moves))
+	}
+	send("takeback_request", "Bob", nil) // only the player who just moved may ask
+	send("takeback_request", "Alice", nil)
+	send("takeback_accept", "Alice", nil) // requester can't accept their own request
+	if len(game.Moves) != 1 {
+		t.Fatalf("expected self-accept to be ignored, got %d moves", len(game.Moves))
+	}
+	send("takeback_accept", "Bob", nil)
+	if len(game.Moves) != 0 || game.Board[4] != "" || game.Turn != "X" {
+		t.Errorf("expected move undone with X to play, got moves=%v board=%v turn=%s", game.Moves, game.Board, game.Turn)
+	}
+}
+
+func TestCheckWinSize(t *testing.T) {
+	board := func(size int, cells ...int) []string {
+		b := make([]string, size*size)
+		for _, c := range cells {
+			b[c] = "X"
+		}
+		return b
+	}
+	tests := []struct {
+		size    int
+		cells   []int
+		pattern string
+	}{
+		{4, []int{4, 5, 6, 7}, "row2"},
+		{4, []int{3, 7, 11, 15}, "col4"},
+		{4, []int{0, 5, 10, 15}, "diag1"},
+		{4, []int{3, 6, 9, 12}, "diag2"},
+		{5, []int{20, 21, 22, 23, 24}, "row5"},
+		{4, []int{0, 1, 2}, ""},
+		{5, []int{0, 6, 12, 18}, ""},
+	}
+	for _, tt := range tests {
+		if _, pattern := checkWinSize(board(tt.size, tt.cells...), tt.size); pattern != tt.pattern {
+			t.Errorf("size %d cells %v: expected %q, got %q", tt.size, tt.cells, tt.pattern, pattern)
+		}
+	}
+}
+
+func TestCreateGameHandler_Size(t *testing.T) {
+	create := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		createGameHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/create", strings.NewReader(body)))
+		return w
+	}
+	for _, body := range []string{`{"player1":"Alice","size":2}`, `{"player1":"Alice","size":6}`} {
+		if w := create(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", body, w.Code)
+		}
+	}
+	w := create(`{"player1":"Alice","size":4}`)
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	game, err := lookupGame(resp["gameId"])
+	if err != nil {
+		t.Fatalf("expected game to be created: %v", err)
+	}
+	if game.Size != 4 || len(game.Board) != 16 {
+		t.Errorf("expected 4x4 board, got size %d with %d cells", game.Size, len(game.Board))
+	}
+}
+
+func TestCoinFlip_Seeded(t *testing.T) {
+	defer func(r *rand.Rand) { firstPlayerRand = r }(firstPlayerRand)
+	flip := func(seed int64) string {
+		firstPlayerRand = rand.New(rand.NewSource(seed))
+		return coinFlip()
+	}
+	seen := make(map[string]bool)
+	for seed := int64(1); seed <= 20; seed++ {
+		first := flip(seed)
+		if again := flip(seed); again != first {
+			t.Fatalf("seed %d: expected the same first player, got %s then %s", seed, first, again)
+		}
+		seen[first] = true
+	}
+	if !seen["X"] || !seen["O"] {
+		t.Errorf("expected both X and O to be reachable, got %v", seen)
+	}
+
+	firstPlayerRand = rand.New(rand.NewSource(1))
+	want := coinFlip()
+	firstPlayerRand = rand.New(rand.NewSource(1))
+	w := httptest.NewRecorder()
+	createGameHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/create", strings.NewReader(`{"player1":"Alice"}`)))
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp["firstPlayer"] != want {
+		t.Errorf("expected seeded first player %s, got %s", want, resp["firstPlayer"])
+	}
+}
+
+func TestCreateGameHandler_MaxActiveGames(t *testing.T) {
+	expireWaitingGames(time.Now().Add(-waitingGameTTL))
+	defer func(n int) { maxActiveGames = n }(maxActiveGames)
+	maxActiveGames = activeGameCount() + 1
+	create := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		createGameHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/create", strings.NewReader(`{"player1":"Alice"}`)))
+		return w
+	}
+	// An abandoned waiting game fills the last slot but is expired on demand
+	stale := &OnlineGame{ID: "cap1", Player1: "Alice", Status: "waiting", CreatedAt: time.Now().Add(-time.Hour)}
+	gamesMu.Lock()
+	games[stale.ID] = stale
+	gamesMu.Unlock()
+	before := testutil.ToFloat64(gamesRejectedCapacity)
+
+	if w := create(); w.Code != http.StatusOK {
+		t.Fatalf("expected stale game to be expired to make room, got status %d", w.Code)
+	}
+	w := create()
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 at capacity, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After header")
+	}
+	if got := testutil.ToFloat64(gamesRejectedCapacity) - before; got != 1 {
+		t.Errorf("expected 1 rejection counted, got %v", got)
+	}
+}
+
+func TestLeaderboardWSHandler_ServesCachedSnapshot(t *testing.T) {
+	useMemoryStore(t, savedGame("g1", "2024-01-01T00:00:00Z", "Alice", "Bob", "Alice", "row1"))
+	w := httptest.NewRecorder()
+	leaderboardHandler(w, httptest.NewRequest(http.MethodGet, "/api/leaderboard", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	leaderboardWSHandler(w, httptest.NewRequest(http.MethodPost, "/api/leaderboard/ws", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for POST, got %d", w.Code)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(leaderboardWSHandler))
+	defer srv.Close()
+	before := testutil.ToFloat64(cacheHits)
+	subscribers := testutil.ToFloat64(leaderboardSubscribers)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var resp LeaderboardResponse
+	if err := conn.ReadJSON(&resp); err != nil || len(resp.Players) != 2 {
+		t.Fatalf("expected the leaderboard snapshot, got %+v (%v)", resp, err)
+	}
+	if got := testutil.ToFloat64(cacheHits) - before; got != 1 {
+		t.Errorf("expected the snapshot to come from the /api/leaderboard cache, got %v hits", got)
+	}
+	// Wait for the handler to unsubscribe so later tests see a settled gauge
+	conn.Close()
+	for deadline := time.Now().Add(time.Second); testutil.ToFloat64(leaderboardSubscribers) != subscribers && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBroadcastLeaderboard(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sub := subscribeLeaderboard(conn)
+		defer unsubscribeLeaderboard(sub)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+	before := testutil.ToFloat64(leaderboardSubscribers)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(leaderboardSubscribers) != before+1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected subscriber to be registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	broadcastLeaderboard(LeaderboardResponse{Players: []PlayerStats{{Player: "Alice", Wins: 3}}, Total: 1})
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var resp LeaderboardResponse
+	if err := conn.ReadJSON(&resp); err != nil {
+		t.Fatalf("expected leaderboard push, got %v", err)
+	}
+	if resp.Total != 1 || resp.Players[0].Player != "Alice" {
+		t.Errorf("unexpected leaderboard: %+v", resp)
+	}
+}
+
+func TestHandleMessage_ChatFromPlayersOnly(t *testing.T) {
+	resetMetrics()
+	game := &OnlineGame{ID: "chat1", Size: 3, Board: make([]string, 9), Turn: "X", Player1: "Alice", Player2: "Bob", Status: "playing"}
+	game.handleMessage(WSMessage{Type: "chat", Payload: map[string]interface{}{"player": "Alice", "text": "gl hf"}})
+	game.handleMessage(WSMessage{Type: "chat", Payload: map[string]interface{}{"player": "Mallory", "text": "spam"}})
+	game.handleMessage(WSMessage{Type: "chat", Payload: map[string]interface{}{"player": "Bob", "text": strings.Repeat("a", chatMaxLength+1)}})
+	if got := testutil.ToFloat64(wsMessagesTotal.WithLabelValues("chat", "dropped")); got != 2 {
+		t.Errorf("expected 2 dropped chat messages, got %v", got)
+	}
+}
+
+func TestGameEndpoints_RejectWrongMethod(t *testing.T) {
+	gamesMu.Lock()
+	games["method1"] = &OnlineGame{ID: "method1", Size: 3, Board: make([]string, 9), Status: "waiting"}
+	gamesMu.Unlock()
+	for name, handler := range map[string]http.HandlerFunc{"get": getGameHandler, "ws": wsHandler} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/?id=method1", nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: expected status 405, got %d", name, w.Code)
+		}
+	}
+}
+
+func TestShutdownGames(t *testing.T) {
+	playing := &OnlineGame{ID: "sd1", Size: 3, Board: make([]string, 9), Turn: "X", Player1: "Alice", Player2: "Bob", Status: "playing"}
+	gamesMu.Lock()
+	games[playing.ID] = playing
+	gamesMu.Unlock()
+
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?id=sd1", nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	var msg WSMessage
+	conn.ReadJSON(&msg) // initial game_state
+
+	shutdownGames(context.Background())
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "server_shutdown" {
+		t.Errorf("expected server_shutdown message, got %+v (%v)", msg, err)
+	}
+	// Interrupted games must not accept moves afterwards
+	playing.handleMessage(WSMessage{Type: "move", Payload: map[string]interface{}{"index": float64(0), "player": "Alice"}})
+	playing.mu.Lock()
+	defer playing.mu.Unlock()
+	if playing.Status != "interrupted" || playing.Board[0] != "" {
+		t.Errorf("expected interrupted game with untouched board, got %q %v", playing.Status, playing.Board)
+	}
+}
+
+func TestGameResultsByTime_SkipsInterrupted(t *testing.T) {
+	items := []map[string]types.AttributeValue{
+		{"player1": &types.AttributeValueMemberS{Value: "Alice"}, "player2": &types.AttributeValueMemberS{Value: "Bob"}, "status": &types.AttributeValueMemberS{Value: "interrupted"}},
+		{"player1": &types.AttributeValueMemberS{Value: "Alice"}, "player2": &types.AttributeValueMemberS{Value: "Bob"}, "winner": &types.AttributeValueMemberS{Value: "Alice"}},
+	}
+	if results := gameResultsByTime(items); len(results) != 1 || results[0].Winner != "Alice" {
+		t.Errorf("expected only the finished game, got %+v", results)
+	}
+}
+
+func TestPersistLocked_RunsInOrder(t *testing.T) {
+	g := &OnlineGame{ID: "pq1"}
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		g.mu.Lock()
+		g.persistLocked(func(*OnlineGame) {
+			defer wg.Done()
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		})
+		g.mu.Unlock()
+	}
+	wg.Wait()
+	for i, n := range order {
+		if n != i {
+			t.Fatalf("writes ran out of order: %v", order)
+		}
+	}
+}
+
+func TestIsUnfinished(t *testing.T) {
+	for status, want := range map[string]bool{"": false, "playing": true, "interrupted": true} {
+		item := map[string]types.AttributeValue{}
+		if status != "" {
+			item["status"] = &types.AttributeValueMemberS{Value: status}
+		}
+		if got := isUnfinished(item); got != want {
+			t.Errorf("isUnfinished(status=%q) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestExportHandler_InvalidFormat(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/export?format=xml", nil)
+	w := httptest.NewRecorder()
+	exportHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestExportHandler_FlushesThroughMetricsMiddleware(t *testing.T) {
+	useMemoryStore(t, savedGame("g1", "2024-01-01T00:00:00Z", "Alice", "Bob", "Alice", "row1"))
+	w := httptest.NewRecorder()
+	metricsMiddleware("/api/export", exportHandler)(w, httptest.NewRequest(http.MethodGet, "/api/export", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "g1") {
+		t.Fatalf("expected the export, got %d: %s", w.Code, w.Body.String())
+	}
+	if !w.Flushed {
+		t.Error("expected the export to flush through metricsMiddleware")
+	}
+}
+
+func TestExportedGameFromItem(t *testing.T) {
+	item := map[string]types.AttributeValue{
+		"gameId":   &types.AttributeValueMemberS{Value: "g1"},
+		"player1":  &types.AttributeValueMemberS{Value: "Alice"},
+		"player2":  &types.AttributeValueMemberS{Value: "Bob"},
+		"winner":   &types.AttributeValueMemberS{Value: "Alice"},
+		"duration": &types.AttributeValueMemberN{Value: "4200"},
+		"moves":    &types.AttributeValueMemberL{Value: movesToAttr([]Move{{Index: 0}, {Index: 4}, {Index: 1}})},
+	}
+	got := strings.Join(exportedGameFromItem(item).csvRecord(), ",")
+	if want := "g1,,Alice,Bob,Alice,,false,4200,3"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestMoveTiming(t *testing.T) {
+	moves := []Move{{Index: 4, Player: "X", Time: 1000}, {Index: 0, Player: "O", Time: 4000}, {Index: 8, Player: "X", Time: 4500}}
+	timing := moveTiming(moves, "Alice", "Bob")
+	if timing.AvgMoveTimeMs != 1500 || timing.SlowestMoveMs != 3000 || timing.FastestMoveMs != 500 {
+		t.Errorf("unexpected timing %+v", timing)
+	}
+	if timing.PlayerAvgMs["Alice"] != 750 || timing.PlayerAvgMs["Bob"] != 3000 {
+		t.Errorf("unexpected per-player averages %v", timing.PlayerAvgMs)
+	}
+	if empty := moveTiming(nil, "Alice", "Bob"); empty.AvgMoveTimeMs != 0 || len(empty.PlayerAvgMs) != 0 {
+		t.Errorf("expected zero timing for no moves, got %+v", empty)
+	}
+}
+
+func TestLeaveGameHandler(t *testing.T) {
+	resetMetrics()
+	gamesMu.Lock()
+	games["lv1"] = &OnlineGame{ID: "lv1", Size: 3, Board: make([]string, 9), Turn: "X", Player1: "Alice", Player2: "Bob", Status: "playing",
+		seatKeys: map[string]string{"Alice": "alice-key", "Bob": "bob-key"}}
+	gamesMu.Unlock()
+
+	leave := func(player, key string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"gameId": "lv1", "player": player, "playerKey": key})
+		w := httptest.NewRecorder()
+		leaveGameHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/leave", bytes.NewReader(body)))
+		return w
+	}
+	if w := leave("Mallory", ""); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a non-player, got %d", w.Code)
+	}
+	// Knowing the game ID isn't enough to forfeit someone else's seat
+	if w := leave("Bob", ""); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without a key, got %d", w.Code)
+	}
+	if w := leave("Bob", "alice-key"); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 with the opponent's key, got %d", w.Code)
+	}
+	if w := leave("Bob", "bob-key"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	game, _ := lookupGame("lv1")
+	game.mu.Lock()
+	if game.Status != "finished" || game.Winner != "Alice" || game.Pattern != "resignation" {
+		t.Errorf("expected Alice to win by resignation, got %q %q %q", game.Status, game.Winner, game.Pattern)
+	}
+	game.mu.Unlock()
+	if w := leave("Bob", "bob-key"); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 resigning a finished game, got %d", w.Code)
+	}
+	if got := testutil.ToFloat64(winsTotal.WithLabelValues("Alice", "resignation", "online", "none")); got != 1 {
+		t.Errorf("expected 1 resignation win for Alice, got %v", got)
+	}
+}
+
+func TestFinishLocked_ObservesGameHistograms(t *testing.T) {
+	resetMetrics()
+	game := &OnlineGame{ID: "gd1", Size: 3, Board: make([]string, 9), Player1: "Alice", Player2: "Bob", Status: "playing", StartedAt: time.Now().Add(-42 * time.Second)}
+	game.mu.Lock()
+	game.Winner, game.Pattern = "Alice", "row1"
+	game.finishLocked("game_state")
+	game.mu.Unlock()
+	if n := testutil.CollectAndCount(gameDuration, "tictactoe_game_duration_seconds"); n != 1 {
+		t.Errorf("expected one duration series, got %d", n)
+	}
+	if n := testutil.CollectAndCount(movesPerGame, "tictactoe_moves_per_game"); n != 1 {
+		t.Errorf("expected one moves-per-game series, got %d", n)
+	}
+}
+
+func TestJoinGameHandler_ByRoomCode(t *testing.T) {
+	body, _ := json.Marshal(map[string]interface{}{"player1": "Alice", "roomCode": true})
+	w := httptest.NewRecorder()
+	createGameHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/create", bytes.NewReader(body)))
+	var created map[string]string
+	json.NewDecoder(w.Body).Decode(&created)
+	code := created["code"]
+	if len(code) != 4 || strings.ContainsAny(code, "O0I1") {
+		t.Fatalf("expected a 4-character unambiguous room code, got %q", code)
+	}
+
+	body, _ = json.Marshal(map[string]string{"code": strings.ToLower(code), "player2": "Bob"})
+	w = httptest.NewRecorder()
+	joinGameHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/join", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 joining by code, got %d", w.Code)
+	}
+	if _, err := lookupGameByCode(code); !errors.Is(err, ErrGameNotFound) {
+		t.Errorf("expected room code to be released once the game started, got %v", err)
+	}
+}
+
+func TestJoinGameHandler_CountsAttempts(t *testing.T) {
+	resetMetrics()
+	game := newOnlineGame("Alice", "X", 3, false)
+	join := func(body string) int {
+		w := httptest.NewRecorder()
+		joinGameHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/join", strings.NewReader(body)))
+		return w.Code
+	}
+	abandoned := testutil.ToFloat64(onlineGamesAbandoned)
+	lobbyWaitSamples := func() uint64 {
+		var m dto.Metric
+		lobbyWait.Write(&m)
+		return m.GetHistogram().GetSampleCount()
+	}
+	waits := lobbyWaitSamples()
+	join(`{"gameId":"` + game.ID + `","player2":"Bob"}`)
+	if got := testutil.ToFloat64(onlineGamesAbandoned); got != abandoned {
+		t.Errorf("expected a join not to count as abandoned, got %v -> %v", abandoned, got)
+	}
+	join(`{"gameId":"` + game.ID + `","player2":"Carol"}`)
+	if got := lobbyWaitSamples() - waits; got != 1 {
+		t.Errorf("expected only the successful join to observe lobby wait, got %d", got)
+	}
+	join(`{"gameId":"nope","player2":"Carol"}`)
+	join(`{"gameId":`)
+	for result, want := range map[string]float64{"ok": 1, "already_started": 1, "not_found": 1, "bad_request": 1} {
+		if got := testutil.ToFloat64(joinAttempts.WithLabelValues(result)); got != want {
+			t.Errorf("expected %v %s join attempts, got %v", want, result, got)
+		}
+	}
+}
+
+func TestSeries_BestOfThree(t *testing.T) {
+	mem := useMemoryStore(t)
+	w := httptest.NewRecorder()
+	createGameHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/create", strings.NewReader(`{"player1":"Alice","bestOf":3}`)))
+	var created map[string]string
+	json.NewDecoder(w.Body).Decode(&created)
+	if created["seriesId"] == "" {
+		t.Fatalf("expected a seriesId, got %v", created)
+	}
+	game, err := lookupGame(created["gameId"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// finish ends the current game with winner and returns the next one
+	finish := func(g *OnlineGame, winner string) *OnlineGame {
+		g.mu.Lock()
+		g.Player2, g.Status, g.Winner, g.Pattern = "Bob", "playing", winner, "row1"
+		g.finishLocked("game_state")
+		nextID := g.RematchID
+		g.mu.Unlock()
+		if nextID == "" {
+			return nil
+		}
+		next, err := lookupGame(nextID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return next
+	}
+
+	first := game.FirstPlayer
+	game = finish(game, "Alice")
+	if game == nil || game.Series.Game != 2 || game.Series.Player1Wins != 1 || game.Status != "playing" {
+		t.Fatalf("expected game 2 in progress after Alice's win, got %+v", game)
+	}
+	if game.FirstPlayer == first {
+		t.Errorf("expected the first player to swap, got %s twice", first)
+	}
+	game = finish(game, "")
+	if game == nil || game.Series.Game != 3 || game.Series.Ties != 1 {
+		t.Fatalf("expected a tie to be replayed, got %+v", game)
+	}
+	last := game
+	if finish(game, "Alice") != nil {
+		t.Fatal("expected no further games once Alice won the series")
+	}
+	if last.Series.Winner != "Alice" || last.Series.Player1Wins != 2 {
+		t.Errorf("expected Alice to win the series 2-0, got %+v", last.Series)
+	}
+
+	for i := 0; i < 100; i++ {
+		if item, _ := mem.QueryGame(context.Background(), last.ID); item != nil {
+			if getStringAttr(item, "seriesId") != created["seriesId"] || getStringAttr(item, "seriesWinner") != "Alice" {
+				t.Errorf("expected the final series result to be saved, got %v", item)
+			}
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("expected the deciding game to be saved")
+}
+
+func TestSeries_NextGameAtCapacity(t *testing.T) {
+	expireWaitingGames(time.Now().Add(-waitingGameTTL))
+	defer func(n int) { maxActiveGames = n }(maxActiveGames)
+	gamesMu.Lock()
+	games["sercap1"] = &OnlineGame{ID: "sercap1", Player1: "Carol", Player2: "Dave", Status: "playing"}
+	gamesMu.Unlock()
+	defer func() {
+		gamesMu.Lock()
+		delete(games, "sercap1")
+		gamesMu.Unlock()
+	}()
+	game := newOnlineGame("Alice", "X", 3, false)
+	// the other games already fill every slot, so the next game has none
+	maxActiveGames = activeGameCount() - 1
+	series := Series{ID: "s1", BestOf: 3, Game: 1}
+	game.mu.Lock()
+	defer game.mu.Unlock()
+	game.Series = &series
+	game.Player2, game.Status, game.Winner, game.Pattern = "Bob", "playing", "Alice", "row1"
+	before := testutil.ToFloat64(gamesRejectedCapacity)
+	game.finishLocked("game_state")
+	if game.RematchID != "" {
+		t.Errorf("expected no next game at capacity, got %s", game.RematchID)
+	}
+	if got := testutil.ToFloat64(gamesRejectedCapacity) - before; got != 1 {
+		t.Errorf("expected 1 rejection counted, got %v", got)
+	}
+}
+
+func TestCreateGameHandler_InvalidBestOf(t *testing.T) {
+	for _, body := range []string{`{"player1":"Alice","bestOf":2}`, `{"player1":"Alice","bestOf":11}`, `{"player1":"Alice","bestOf":-1}`} {
+		w := httptest.NewRecorder()
+		createGameHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/create", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", body, w.Code)
+		}
+	}
+}
+
+func TestDebugGamesHandler(t *testing.T) {
+	adminToken = "s3cret"
+	defer func() { adminToken = "" }()
+	game := newOnlineGame("Alice", "X", 3, false)
+
+	w := httptest.NewRecorder()
+	debugGamesHandler(w, httptest.NewRequest(http.MethodGet, "/api/debug/games", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/debug/games", nil)
+	req.Header.Set("X-Admin-Token", "s3cret")
+	w = httptest.NewRecorder()
+	debugGamesHandler(w, req)
+	var list []DebugGame
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	for _, g := range list {
+		if g.ID == game.ID {
+			if g.Status != "waiting" || g.Player1 != "Alice" || g.ConnCount != 0 {
+				t.Errorf("unexpected entry %+v", g)
+			}
+			return
+		}
+	}
+	t.Errorf("expected game %s to be listed", game.ID)
+}
+
+func TestDemoGameHandler(t *testing.T) {
+	mem := useMemoryStore(t)
+	defer func(d time.Duration) { demoMoveInterval = d }(demoMoveInterval)
+	demoMoveInterval = time.Millisecond
+
+	w := httptest.NewRecorder()
+	demoGameHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/demo", strings.NewReader(`{"difficulty":"hard"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&resp)
+	id, _ := resp["gameId"].(string)
+	if _, ok := resp["seed"].(float64); !ok {
+		t.Errorf("expected the demo's seed in the response, got %v", resp)
+	}
+
+	for i := 0; i < 200; i++ {
+		if item, _ := mem.QueryGame(context.Background(), id); item != nil {
+			// Perfect play on both sides always ends in a draw
+			if getStringAttr(item, "mode") != "ai" || !getBoolAttr(item, "isTie") || !getBoolAttr(item, "demo") {
+				t.Errorf("expected a saved ai demo tie, got %v", item)
+			}
+			if n := len(getMovesAttr(item, "moves")); n != 9 {
+				t.Errorf("expected 9 moves, got %d", n)
+			}
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("expected the demo game to finish and be saved")
+}
+
+func TestWSHandler_ResignNeedsBoundConnection(t *testing.T) {
+	game := &OnlineGame{ID: "wsresign", Size: 3, Board: make([]string, 9), Turn: "X", Player1: "Alice", Player2: "Bob", Status: "playing",
+		seatKeys: map[string]string{"Alice": "alice-key", "Bob": "bob-key"}}
+	gamesMu.Lock()
+	games[game.ID] = game
+	gamesMu.Unlock()
+	defer func() {
+		gamesMu.Lock()
+		delete(games, game.ID)
+		gamesMu.Unlock()
+	}()
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer srv.Close()
+	dial := func(query string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?id=wsresign"+query, nil)
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		var state WSMessage
+		conn.ReadJSON(&state)
+		return conn
+	}
+	resign := func(conn *websocket.Conn, player string) {
+		conn.WriteJSON(WSMessage{Type: "resign", Payload: map[string]interface{}{"player": player}})
+	}
+	status := func() string {
+		game.mu.Lock()
+		defer game.mu.Unlock()
+		return game.Status
+	}
+
+	// Unbound, or bound to the other seat: both ignored
+	anon := dial("")
+	defer anon.Close()
+	resign(anon, "Bob")
+	alice := dial("&player=Alice&key=alice-key")
+	defer alice.Close()
+	resign(alice, "Bob")
+	time.Sleep(50 * time.Millisecond)
+	if got := status(); got != "playing" {
+		t.Fatalf("expected the game to keep going, got %q", got)
+	}
+
+	resign(alice, "Alice")
+	deadline := time.Now().Add(2 * time.Second)
+	for status() != "finished" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	game.mu.Lock()
+	defer game.mu.Unlock()
+	if game.Status != "finished" || game.Winner != "Bob" {
+		t.Errorf("expected Bob to win after Alice resigned, got %q %q", game.Status, game.Winner)
+	}
+}
+
+func TestLeaveGameHandler_CancelsWaitingGame(t *testing.T) {
+	game := newOnlineGame("Alice", "X", 3, true)
+	game.mu.Lock()
+	key := game.issueSeatKeyLocked("Alice")
+	game.mu.Unlock()
+	body, _ := json.Marshal(map[string]string{"gameId": game.ID, "player": "Alice", "playerKey": key})
+	w := httptest.NewRecorder()
+	leaveGameHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/leave", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if _, err := lookupGame(game.ID); !errors.Is(err, ErrGameNotFound) {
+		t.Errorf("expected cancelled game to be removed, got %v", err)
+	}
+	if _, err := lookupGameByCode(game.Code); !errors.Is(err, ErrGameNotFound) {
+		t.Errorf("expected room code to be released, got %v", err)
+	}
+}
+
+func TestDifficultyLabel(t *testing.T) {
+	cases := []struct {
+		result GameResult
+		want   string
+	}{
+		{GameResult{Mode: "local"}, "none"},
+		{GameResult{Mode: "ai", Difficulty: "medium"}, "medium"},
+		{GameResult{Mode: "ai"}, "unknown"},
+		{GameResult{Mode: "ai", Difficulty: "nightmare"}, "unknown"},
+	}
+	for _, c := range cases {
+		if got := difficultyLabel(c.result); got != c.want {
+			t.Errorf("difficultyLabel(%+v) = %q, want %q", c.result, got, c.want)
+		}
+	}
+}
+
+func TestAddAIGame(t *testing.T) {
+	byDifficulty := make(map[string]*AIDifficultyStats)
+	addAIGame(byDifficulty, map[string]types.AttributeValue{"difficulty": &types.AttributeValueMemberS{Value: "hard"}, "winner": &types.AttributeValueMemberS{Value: "AI"}})
+	addAIGame(byDifficulty, map[string]types.AttributeValue{"difficulty": &types.AttributeValueMemberS{Value: "hard"}, "isTie": &types.AttributeValueMemberBOOL{Value: true}})
+	addAIGame(byDifficulty, map[string]types.AttributeValue{"winner": &types.AttributeValueMemberS{Value: "Alice"}})
+	if hard := byDifficulty["hard"]; hard == nil || hard.Losses != 1 || hard.Ties != 1 || hard.TotalGames != 2 {
+		t.Errorf("unexpected hard stats %+v", hard)
+	}
+	if unknown := byDifficulty["unknown"]; unknown == nil || unknown.Wins != 1 {
+		t.Errorf("expected a win under unknown difficulty, got %+v", unknown)
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var seen string
+	handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = r.Context().Value(requestIDKey{}).(string)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if seen != "abc-123" || w.Header().Get("X-Request-ID") != "abc-123" {
+		t.Errorf("expected caller's request ID to propagate, got context %q header %q", seen, w.Header().Get("X-Request-ID"))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+	req.Header.Set("X-Request-ID", "bad id\n")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if seen == "" || seen == "bad id\n" || w.Header().Get("X-Request-ID") != seen {
+		t.Errorf("expected a generated request ID, got context %q header %q", seen, w.Header().Get("X-Request-ID"))
+	}
+}
+
+func TestWSHandler_OversizedMessageClosesConnection(t *testing.T) {
+	game := &OnlineGame{ID: "bigmsg", Size: 3, Board: make([]string, 9), Turn: "X", Player1: "Alice", Player2: "Bob", Status: "playing"}
+	gamesMu.Lock()
+	games[game.ID] = game
+	gamesMu.Unlock()
+	defer func() {
+		gamesMu.Lock()
+		delete(games, game.ID)
+		gamesMu.Unlock()
+	}()
+
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?id=bigmsg", nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	var state WSMessage
+	conn.ReadJSON(&state)
+
+	huge := `{"type":"chat","payload":{"text":"` + strings.Repeat("a", int(wsMaxMessageBytes)) + `"}}`
+	conn.WriteMessage(websocket.TextMessage, []byte(huge))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("expected close with message too big, got %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		game.mu.Lock()
+		n := len(game.Conns)
+		game.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected connection to be removed from the game")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHandleMessage_RejectedMoves(t *testing.T) {
+	resetMetrics()
+	game := &OnlineGame{ID: "rej1", Size: 3, Board: []string{"X", "X", "", "O", "O", "", "", "", ""}, Turn: "X", Player1: "Alice", Player2: "Bob", Status: "playing"}
+	move := func(index int, player string) {
+		game.handleMessage(WSMessage{Type: "move", Payload: map[string]interface{}{"index": float64(index), "player": player}})
+	}
+	move(5, "Bob")   // wrong turn
+	move(3, "Alice") // occupied
+	move(9, "Alice") // out of range
+	move(2, "Alice") // wins
+	move(2, "Alice") // re-sent winning move
+	move(5, "Bob")   // after game over
+	for reason, want := range map[string]float64{"wrong_turn": 1, "occupied": 1, "out_of_range": 1, "game_over": 2} {
+		if got := testutil.ToFloat64(movesRejected.WithLabelValues(reason)); got != want {
+			t.Errorf("expected %v %s rejections, got %v", want, reason, got)
+		}
+	}
+	game.mu.Lock()
+	defer game.mu.Unlock()
+	if game.Winner != "Alice" || len(game.Moves) != 1 {
+		t.Errorf("expected a single winning move by Alice, got winner %q moves %v", game.Winner, game.Moves)
+	}
+}
+
+func TestWinningLine(t *testing.T) {
+	cases := []struct {
+		pattern string
+		size    int
+		want    []int
+	}{
+		{"row1", 3, []int{0, 1, 2}},
+		{"col3", 3, []int{2, 5, 8}},
+		{"diag1", 3, []int{0, 4, 8}},
+		{"diag2", 3, []int{2, 4, 6}},
+		{"row4", 4, []int{12, 13, 14, 15}},
+		{"row4", 3, nil},
+		{"resignation", 3, nil},
+	}
+	for _, c := range cases {
+		if got := winningLine(c.pattern, c.size); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("winningLine(%q, %d) = %v, want %v", c.pattern, c.size, got, c.want)
+		}
+	}
+	// Every pattern checkWinSize reports maps back to a line of that mark
+	for _, size := range []int{3, 4, 5} {
+		for _, pattern := range []string{"row2", "col1", "diag1", "diag2"} {
+			board := make([]string, size*size)
+			for _, i := range winningLine(pattern, size) {
+				board[i] = "X"
+			}
+			if _, got := checkWinSize(board, size); got != pattern {
+				t.Errorf("size %d: expected %s round-trip, got %q", size, pattern, got)
+			}
+		}
+	}
+}
+
+func TestDeletePlayerHandler_RequiresAdminToken(t *testing.T) {
+	del := func(token string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/api/player?player=Alice", nil)
+		if token != "" {
+			req.Header.Set("X-Admin-Token", token)
+		}
+		w := httptest.NewRecorder()
+		playerHandler(w, req)
+		return w.Code
+	}
+	if code := del("anything"); code != http.StatusForbidden {
+		t.Errorf("expected 403 with admin endpoints disabled, got %d", code)
+	}
+	adminToken = "s3cret"
+	defer func() { adminToken = "" }()
+	if code := del("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with a wrong token, got %d", code)
+	}
+	if code := del("s3cret"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected to get past auth to the database check, got %d", code)
+	}
+}
+
+func TestDeletePlayerHandler_AnonymizesSeriesWinner(t *testing.T) {
+	decider := savedGame("s3", "2024-01-03T00:00:00Z", "Alice", "Bob", "Alice", "row1")
+	decider["seriesWinner"] = &types.AttributeValueMemberS{Value: "Alice"}
+	fake := useMemoryStore(t,
+		savedGame("s1", "2024-01-01T00:00:00Z", "Alice", "Bob", "Bob", "col1"),
+		decider,
+		savedGame("g1", "2024-01-04T00:00:00Z", "Carol", "Dave", "Carol", "diag1"),
+	)
+	adminToken = "s3cret"
+	defer func() { adminToken = "" }()
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/player?player=Alice", nil)
+	req.Header.Set("X-Admin-Token", "s3cret")
+	w := httptest.NewRecorder()
+	playerHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	item := fake.item("s3", "2024-01-03T00:00:00Z")
+	for _, attr := range []string{"player1", "winner", "seriesWinner"} {
+		if got := getStringAttr(item, attr); got != deletedPlayerName {
+			t.Errorf("expected %s to be %s, got %q", attr, deletedPlayerName, got)
+		}
+	}
+	if got := getStringAttr(fake.item("g1", "2024-01-04T00:00:00Z"), "player1"); got != "Carol" {
+		t.Errorf("expected other players' games untouched, got %q", got)
+	}
+}
+
+func TestPurgeHandler(t *testing.T) {
+	fake := useMemoryStore(t,
+		savedGame("g1", "2024-01-01T00:00:00Z", "SyntheticA", "SyntheticB", "SyntheticA", "row1"),
+		savedGame("g2", "2024-01-02T00:00:00Z", "Alice", "SyntheticOnline", "Alice", "col1"),
+		savedGame("g3", "2024-01-03T00:00:00Z", "Alice", "Bob", "Bob", "diag1"),
+	)
+	adminToken = "s3cret"
+	defer func() { adminToken = "" }()
+
+	purge := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/purge"+query, nil)
+		req.Header.Set("X-Admin-Token", "s3cret")
+		w := httptest.NewRecorder()
+		purgeHandler(w, req)
+		return w
+	}
+	if w := purge(""); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a prefix, got %d", w.Code)
+	}
+	w := purge("?prefix=Synthetic")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp map[string]int
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp["deleted"] != 2 {
+		t.Errorf("expected 2 games deleted, got %v", resp)
+	}
+	if len(fake.items) != 1 || getStringAttr(fake.items[0], "gameId") != "g3" {
+		t.Errorf("expected only g3 left, got %d items", len(fake.items))
+	}
+}
+
+func TestWSHandler_PlayerReconnect(t *testing.T) {
+	game := &OnlineGame{ID: "recon1", Size: 3, Board: make([]string, 9), Turn: "X", Player1: "Alice", Player2: "Bob", Status: "playing",
+		seatKeys: map[string]string{"Alice": "alice-key"}}
+	gamesMu.Lock()
+	games[game.ID] = game
+	gamesMu.Unlock()
+	defer func() {
+		gamesMu.Lock()
+		delete(games, game.ID)
+		gamesMu.Unlock()
+	}()
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer srv.Close()
+	dial := func(query string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?id=recon1&player=Alice"+query, nil)
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		return conn
+	}
+	expect := func(conn *websocket.Conn, types ...string) {
+		for _, want := range types {
+			var msg WSMessage
+			if err := conn.ReadJSON(&msg); err != nil || msg.Type != want {
+				t.Fatalf("expected %s, got %q (%v)", want, msg.Type, err)
+			}
+		}
+	}
+
+	first := dial("&key=alice-key")
+	defer first.Close()
+	expect(first, "game_state", "player_joined")
+	game.mu.Lock()
+	seat := game.playerConns["Alice"]
+	game.mu.Unlock()
+
+	// Without the key, naming Alice doesn't take her seat's socket
+	anonymous := dial("")
+	defer anonymous.Close()
+	expect(anonymous, "game_state")
+	game.mu.Lock()
+	kept := game.playerConns["Alice"] == seat
+	game.mu.Unlock()
+	select {
+	case <-seat.done:
+		t.Fatal("expected an unbound connection to leave Alice's socket open")
+	default:
+	}
+	if !kept {
+		t.Error("expected Alice's socket to stay attached to her seat")
+	}
+
+	second := dial("&key=alice-key")
+	defer second.Close()
+	expect(second, "game_state", "player_reconnected")
+	if _, _, err := first.ReadMessage(); err == nil {
+		t.Error("expected the stale connection to be closed")
+	}
+}
+
+func TestParseBuckets(t *testing.T) {
+	def := []float64{1}
+	cases := []struct {
+		in   string
+		want []float64
+	}{
+		{"", def},
+		{"0.1, 1,10", []float64{0.1, 1, 10}},
+		{"1,abc", def},
+		{"1,0.5", def},
+	}
+	for _, c := range cases {
+		if got := parseBuckets(c.in, def); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("parseBuckets(%q) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	resetMetrics()
+	old := writeBackoff
+	writeBackoff = time.Millisecond
+	defer func() { writeBackoff = old }()
+
+	calls := 0
+	err := withRetry(context.Background(), "PutItem", func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("throttled")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("expected success on the third attempt, got %v after %d calls", err, calls)
+	}
+	if got := testutil.ToFloat64(dynamoDBRetries.WithLabelValues("PutItem")); got != 2 {
+		t.Errorf("expected 2 retries, got %v", got)
+	}
+
+	calls = 0
+	err = withRetry(context.Background(), "PutItem", func() error {
+		calls++
+		return errors.New("throttled")
+	})
+	if err == nil || calls != writeAttempts {
+		t.Errorf("expected failure after %d attempts, got %v after %d calls", writeAttempts, err, calls)
+	}
+}
+
+// slowDynamo answers Query and Scan only after delay, or fails once ctx is done.
+type slowDynamo struct {
+	dynamoDBAPI
+	delay time.Duration
+}
+
+func (d slowDynamo) wait(ctx context.Context) error {
+	select {
+	case <-time.After(d.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d slowDynamo) Query(ctx context.Context, _ *dynamodb.QueryInput, _ ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	if err := d.wait(ctx); err != nil {
+		return nil, err
+	}
+	return &dynamodb.QueryOutput{}, nil
+}
+
+func (d slowDynamo) Scan(ctx context.Context, _ *dynamodb.ScanInput, _ ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	if err := d.wait(ctx); err != nil {
+		return nil, err
+	}
+	return &dynamodb.ScanOutput{}, nil
+}
+
+func TestDynamoTimeoutReturns503(t *testing.T) {
+	resetMetrics()
+	oldStore, oldTimeout := store, dynamoTimeout
+	store = &dynamoStore{client: slowDynamo{delay: time.Second}, table: "games"}
+	dynamoTimeout = 20 * time.Millisecond
+	defer func() { store, dynamoTimeout = oldStore, oldTimeout }()
+
+	rec := httptest.NewRecorder()
+	gameReplayHandler(rec, httptest.NewRequest(http.MethodGet, "/api/replay?id=abc", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "DATABASE_TIMEOUT") {
+		t.Errorf("expected DATABASE_TIMEOUT, got %s", rec.Body.String())
+	}
+	if got := testutil.ToFloat64(dynamoDBOps.WithLabelValues("Query", "error")); got != 1 {
+		t.Errorf("expected 1 Query error, got %v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	recentGamesHandler(rec, httptest.NewRequest(http.MethodGet, "/api/recent", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 from /api/recent, got %d", rec.Code)
+	}
+}
+
+func TestDynamoStore_RecordsLatencyAndScanSize(t *testing.T) {
+	resetMetrics()
+	s := &dynamoStore{client: slowDynamo{delay: time.Millisecond}, table: "games"}
+	scans := func() uint64 {
+		var m dto.Metric
+		dynamoDBScanItems.Write(&m)
+		return m.GetHistogram().GetSampleCount()
+	}
+	before := scans()
+
+	if err := s.ScanGames(context.Background(), GameFilter{}, func([]map[string]types.AttributeValue) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.QueryGame(context.Background(), "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.CollectAndCount(dynamoDBOpDuration, "tictactoe_dynamodb_op_duration_seconds"); n != 2 {
+		t.Errorf("expected Scan and Query durations, got %d series", n)
+	}
+	if got := scans() - before; got != 1 {
+		t.Errorf("expected 1 scan size observation, got %d", got)
+	}
+}
+
+// memoryStore is an in-memory GameStore for handler tests.
+type memoryStore struct {
+	mu      sync.Mutex
+	items   []map[string]types.AttributeValue
+	pingErr error
+}
+
+func (m *memoryStore) index(gameID, timestamp string) int {
+	for i, item := range m.items {
+		if getStringAttr(item, "gameId") == gameID && getStringAttr(item, "timestamp") == timestamp {
+			return i
+		}
+	}
+	return -1
+}
+
+// item returns the stored game with the given key, creating it if needed.
+func (m *memoryStore) item(gameID, timestamp string) map[string]types.AttributeValue {
+	if i := m.index(gameID, timestamp); i >= 0 {
+		return m.items[i]
+	}
+	item := map[string]types.AttributeValue{
+		"gameId":    &types.AttributeValueMemberS{Value: gameID},
+		"timestamp": &types.AttributeValueMemberS{Value: timestamp},
+	}
+	m.items = append(m.items, item)
+	return item
+}
+
+func (f GameFilter) matches(item map[string]types.AttributeValue) bool {
+	p1, p2 := getStringAttr(item, "player1"), getStringAttr(item, "player2")
+	switch {
+	case f.Mode != "" && getStringAttr(item, "mode") != f.Mode:
+		return false
+	case f.Player != "" && p1 != f.Player && p2 != f.Player:
+		return false
+	case f.PlayerPrefix != "" && !strings.HasPrefix(p1, f.PlayerPrefix) && !strings.HasPrefix(p2, f.PlayerPrefix):
+		return false
+	case f.Winner != "" && getStringAttr(item, "winner") != f.Winner:
+		return false
+	case f.Pattern != "" && getStringAttr(item, "pattern") != f.Pattern:
+		return false
+	case f.Before != "" && getStringAttr(item, "timestamp") >= f.Before:
+		return false
+	case f.Since != "" && getStringAttr(item, "timestamp") < f.Since:
+		return false
+	case f.SkipSynthetic && isSyntheticGame(item):
+		return false
+	}
+	return true
+}
+
+func (m *memoryStore) SaveGame(_ context.Context, item map[string]types.AttributeValue) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i := m.index(getStringAttr(item, "gameId"), getStringAttr(item, "timestamp")); i >= 0 {
+		m.items[i] = item
+	} else {
+		m.items = append(m.items, item)
+	}
+	return nil
+}
+
+func (m *memoryStore) QueryGame(_ context.Context, gameID string) (map[string]types.AttributeValue, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, item := range m.items {
+		if getStringAttr(item, "gameId") == gameID {
+			return item, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memoryStore) match(filter GameFilter) []map[string]types.AttributeValue {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var items []map[string]types.AttributeValue
+	for _, item := range m.items {
+		if filter.matches(item) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (m *memoryStore) ScanGames(_ context.Context, filter GameFilter, fn func([]map[string]types.AttributeValue) error) error {
+	return fn(m.match(filter))
+}
+
+func (m *memoryStore) RecentGames(_ context.Context, filter GameFilter, limit int) ([]map[string]types.AttributeValue, error) {
+	items := m.match(filter)
+	sortItemsByTime(items)
+	return items[:min(limit, len(items))], nil
+}
+
+func (m *memoryStore) UpdateGame(_ context.Context, gameID, timestamp string, set map[string]types.AttributeValue) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item := m.item(gameID, timestamp)
+	for attr, v := range set {
+		item[attr] = v
+	}
+	return nil
+}
+
+func (m *memoryStore) AppendMoves(ctx context.Context, gameID, timestamp string, moves []Move, set map[string]types.AttributeValue) error {
+	m.mu.Lock()
+	item := m.item(gameID, timestamp)
+	var existing []types.AttributeValue
+	if l, ok := item["moves"].(*types.AttributeValueMemberL); ok {
+		existing = l.Value
+	}
+	item["moves"] = &types.AttributeValueMemberL{Value: append(existing, movesToAttr(moves)...)}
+	m.mu.Unlock()
+	return m.UpdateGame(ctx, gameID, timestamp, set)
+}
+
+func (m *memoryStore) DeleteGame(_ context.Context, gameID, timestamp string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i := m.index(gameID, timestamp); i >= 0 {
+		m.items = append(m.items[:i], m.items[i+1:]...)
+	}
+	return nil
+}
+
+func (m *memoryStore) Ping(context.Context) error { return m.pingErr }
+
+// useMemoryStore swaps in a fake store holding items for the rest of the test.
+func useMemoryStore(t *testing.T, items ...map[string]types.AttributeValue) *memoryStore {
+	t.Helper()
+	// Let saves started by earlier tests finish before swapping the store
+	pendingSaves.Wait()
+	resetMetrics()
+	old := store
+	fake := &memoryStore{items: items}
+	store = fake
+	t.Cleanup(func() {
+		pendingSaves.Wait()
+		store = old
+	})
+	return fake
+}
+
+// syntheticGame marks item as recorded by the synthetic monitor.
+func syntheticGame(item map[string]types.AttributeValue) map[string]types.AttributeValue {
+	item["synthetic"] = &types.AttributeValueMemberBOOL{Value: true}
+	return item
+}
+
+// savedGame builds an online game item; an empty winner makes it a tie.
+func savedGame(id, timestamp, player1, player2, winner, pattern string) map[string]types.AttributeValue {
+	item := map[string]types.AttributeValue{
+		"gameId":    &types.AttributeValueMemberS{Value: id},
+		"timestamp": &types.AttributeValueMemberS{Value: timestamp},
+		"player1":   &types.AttributeValueMemberS{Value: player1},
+		"player2":   &types.AttributeValueMemberS{Value: player2},
+		"mode":      &types.AttributeValueMemberS{Value: "online"},
+		"isTie":     &types.AttributeValueMemberBOOL{Value: winner == ""},
+	}
+	if winner != "" {
+		item["winner"] = &types.AttributeValueMemberS{Value: winner}
+		item["pattern"] = &types.AttributeValueMemberS{Value: pattern}
+	}
+	return item
+}
+
+func getLeaderboard(t *testing.T, query string) LeaderboardResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	leaderboardHandler(w, httptest.NewRequest(http.MethodGet, "/api/leaderboard"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp LeaderboardResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestLeaderboardHandler_Aggregates(t *testing.T) {
+	interrupted := savedGame("g6", "2024-01-06T00:00:00Z", "Alice", "Bob", "", "")
+	interrupted["status"] = &types.AttributeValueMemberS{Value: "interrupted"}
+	aiGame := savedGame("g7", "2024-01-07T00:00:00Z", "Bob", "AI", "Bob", "row")
+	aiGame["mode"] = &types.AttributeValueMemberS{Value: "ai"}
+	useMemoryStore(t,
+		savedGame("g1", "2024-01-01T00:00:00Z", "Alice", "Bob", "Alice", "row"),
+		savedGame("g2", "2024-01-02T00:00:00Z", "Bob", "Alice", "Alice", "row"),
+		savedGame("g3", "2024-01-03T00:00:00Z", "Bob", "Carol", "", ""),
+		savedGame("g4", "2024-01-04T00:00:00Z", "Carol", "Alice", "Carol", "diagonal"),
+		syntheticGame(savedGame("g5", "2024-01-05T00:00:00Z", "Alice", "Dave", "Dave", "row")),
+		interrupted,
+		aiGame,
+	)
+
+	resp := getLeaderboard(t, "")
+	if resp.Total != 3 || len(resp.Players) != 3 {
+		t.Fatalf("expected 3 players, got total=%d players=%+v", resp.Total, resp.Players)
+	}
+	want := []PlayerStats{
+		{Player: "Alice", Wins: 2, Losses: 1, TotalGames: 3, BestPattern: "row"},
+		{Player: "Carol", Wins: 1, Ties: 1, TotalGames: 2, BestPattern: "diagonal"},
+		{Player: "Bob", Losses: 2, Ties: 1, TotalGames: 3},
+	}
+	for i, w := range want {
+		got := resp.Players[i]
+		if got.Player != w.Player || got.Wins != w.Wins || got.Losses != w.Losses || got.Ties != w.Ties ||
+			got.TotalGames != w.TotalGames || got.BestPattern != w.BestPattern {
+			t.Errorf("rank %d: expected %+v, got %+v", i+1, w, got)
+		}
+	}
+	if got := resp.Players[0].WinRate; got < 66.6 || got > 66.7 {
+		t.Errorf("expected Alice's win rate ~66.7, got %v", got)
+	}
+}
+
+func TestLeaderboardHandler_PagesAndSortsByElo(t *testing.T) {
+	useMemoryStore(t,
+		savedGame("g1", "2024-01-01T00:00:00Z", "Alice", "Bob", "Alice", "row"),
+		savedGame("g2", "2024-01-02T00:00:00Z", "Alice", "Carol", "Alice", "row"),
+		savedGame("g3", "2024-01-03T00:00:00Z", "Carol", "Bob", "Carol", "column"),
+	)
+
+	resp := getLeaderboard(t, "?limit=1&offset=1")
+	if resp.Total != 3 || len(resp.Players) != 1 || resp.Players[0].Player != "Carol" {
+		t.Errorf("expected page with Carol of 3 players, got total=%d players=%+v", resp.Total, resp.Players)
+	}
+
+	resp = getLeaderboard(t, "?sort=elo")
+	for i := 1; i < len(resp.Players); i++ {
+		if resp.Players[i].Elo > resp.Players[i-1].Elo {
+			t.Errorf("players not sorted by elo: %+v", resp.Players)
+		}
+	}
+	if resp.Players[0].Player != "Alice" || resp.Players[0].Elo <= 1200 {
+		t.Errorf("expected Alice on top above 1200, got %+v", resp.Players[0])
+	}
+}
+
+func TestLoadWinStreaksFromDynamoDB_Lookback(t *testing.T) {
+	resetMetrics()
+	recent := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	useMemoryStore(t,
+		savedGame("old", "2020-01-01T00:00:00Z", "Alice", "Bob", "Alice", "row1"),
+		savedGame("new", recent, "Alice", "Bob", "Alice", "row1"),
+	)
+	loadWinStreaksFromDynamoDB()
+	if streak, _ := getWinStreak("Alice"); streak != 1 {
+		t.Errorf("expected only the recent win to count, got streak %d", streak)
+	}
+}
+
+func TestGameFilterExpression(t *testing.T) {
+	expr, names, values := GameFilter{Mode: "online", Player: "Alice", SkipSynthetic: true}.expression()
+	if expr != "#m = :mode AND (player1 = :p OR player2 = :p) AND (attribute_not_exists(#syn) OR #syn = :false)" {
+		t.Errorf("unexpected expression %q", expr)
+	}
+	if names["#m"] != "mode" || names["#syn"] != "synthetic" || len(values) != 3 {
+		t.Errorf("unexpected placeholders %v %v", names, values)
+	}
+	if expr, _, values := (GameFilter{PlayerPrefix: "Synthetic"}).expression(); expr != "(begins_with(player1, :prefix) OR begins_with(player2, :prefix))" || len(values) != 1 {
+		t.Errorf("unexpected prefix expression %q", expr)
+	}
+	if expr, names, values := (GameFilter{Since: "2024-01-01T00:00:00Z"}).expression(); expr != "#ts >= :since" || names["#ts"] != "timestamp" || len(values) != 1 {
+		t.Errorf("unexpected since expression %q", expr)
+	}
+	if expr, names, _ := (GameFilter{}).expression(); expr != "" || names != nil {
+		t.Errorf("expected empty filter, got %q %v", expr, names)
+	}
+}
+
+func TestReplaysHandler(t *testing.T) {
+	useMemoryStore(t,
+		savedGame("g1", "2024-01-01T00:00:00Z", "Alice", "Bob", "Alice", "diag1"),
+		savedGame("g2", "2024-01-02T00:00:00Z", "Bob", "Carol", "Carol", "row1"),
+		savedGame("g3", "2024-01-03T00:00:00Z", "Carol", "Alice", "Carol", "diag1"),
+		syntheticGame(savedGame("g4", "2024-01-04T00:00:00Z", "Synthetic-1", "Bob", "Bob", "diag1")),
+		savedGame("g5", "2024-01-05T00:00:00Z", "Dave", "Bob", "Dave", "diag1"),
+	)
+
+	w := httptest.NewRecorder()
+	replaysHandler(w, httptest.NewRequest(http.MethodGet, "/api/replays?pattern=diag1&limit=2", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var replays []RecentGame
+	if err := json.Unmarshal(w.Body.Bytes(), &replays); err != nil {
+		t.Fatal(err)
+	}
+	if len(replays) != 2 || replays[0].GameID != "g5" || replays[1].GameID != "g3" {
+		t.Errorf("expected g5 then g3, got %+v", replays)
+	}
+
+	for _, query := range []string{"", "?pattern=row4", "?pattern=diag1&limit=x"} {
+		w = httptest.NewRecorder()
+		replaysHandler(w, httptest.NewRequest(http.MethodGet, "/api/replays"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestHeatmapHandler(t *testing.T) {
+	opening := func(item map[string]types.AttributeValue, cell int, mark string) map[string]types.AttributeValue {
+		item["moves"] = &types.AttributeValueMemberL{Value: movesToAttr([]Move{{Index: cell, Player: mark}})}
+		item["firstPlayer"] = &types.AttributeValueMemberS{Value: mark}
+		return item
+	}
+	big := opening(savedGame("g5", "2024-01-05T00:00:00Z", "Alice", "Bob", "Alice", "row1"), 4, "X")
+	big["size"] = &types.AttributeValueMemberN{Value: "4"}
+	useMemoryStore(t,
+		opening(savedGame("g1", "2024-01-01T00:00:00Z", "Alice", "Bob", "Alice", "diag1"), 4, "X"),
+		opening(savedGame("g2", "2024-01-02T00:00:00Z", "Alice", "Bob", "Alice", "row1"), 4, "O"),
+		opening(savedGame("g3", "2024-01-03T00:00:00Z", "Alice", "Bob", "", ""), 0, "X"),
+		savedGame("g4", "2024-01-04T00:00:00Z", "Alice", "Bob", "Bob", "col1"),
+		big,
+	)
+
+	w := httptest.NewRecorder()
+	heatmapHandler(w, httptest.NewRequest(http.MethodGet, "/api/heatmap", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp Heatmap
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Games != 3 || resp.FirstMoves[4] != 2 || resp.FirstMoves[0] != 1 {
+		t.Errorf("unexpected counts %+v", resp)
+	}
+	// The centre opener won once in two games; the corner game was a tie
+	if resp.WinRates[4] != 50 || resp.WinRates[0] != 0 {
+		t.Errorf("unexpected win rates %v", resp.WinRates)
+	}
+}
+
+func TestTieAnalysisHandler(t *testing.T) {
+	opening := func(item map[string]types.AttributeValue, cell int) map[string]types.AttributeValue {
+		item["moves"] = &types.AttributeValueMemberL{Value: movesToAttr([]Move{{Index: cell, Player: "X"}})}
+		return item
+	}
+	useMemoryStore(t,
+		opening(savedGame("g1", "2024-01-01T00:00:00Z", "Alice", "Bob", "", ""), 4),
+		opening(savedGame("g2", "2024-01-02T00:00:00Z", "Alice", "Bob", "", ""), 4),
+		opening(savedGame("g3", "2024-01-03T00:00:00Z", "Alice", "Bob", "Alice", "row1"), 4),
+		opening(savedGame("g4", "2024-01-04T00:00:00Z", "Alice", "Bob", "Bob", "col1"), 0),
+		opening(savedGame("g5", "2024-01-05T00:00:00Z", "Alice", "Bob", "Alice", "row1"), 0),
+		savedGame("g6", "2024-01-06T00:00:00Z", "Alice", "Bob", "", ""),
+	)
+
+	w := httptest.NewRecorder()
+	tieAnalysisHandler(w, httptest.NewRequest(http.MethodGet, "/api/analysis/ties", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp TieAnalysis
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	// The game without moves can't say how it opened
+	if resp.Ties != 2 || resp.Wins != 3 || resp.TieOpenings[4] != 2 || resp.WinOpenings[4] != 1 || resp.WinOpenings[0] != 2 {
+		t.Errorf("unexpected counts %+v", resp)
+	}
+	if math.Abs(resp.TieRates[4]-200.0/3) > 1e-9 || resp.TieRates[0] != 0 {
+		t.Errorf("unexpected tie rates %v", resp.TieRates)
+	}
+	if resp.Correlation <= 0 || resp.Correlation >= 1 {
+		t.Errorf("expected a partial positive correlation, got %v", resp.Correlation)
+	}
+}
+
+func TestPearson(t *testing.T) {
+	if got := pearson([]int{1, 2, 3}, []int{2, 4, 6}); math.Abs(got-1) > 1e-9 {
+		t.Errorf("expected 1, got %v", got)
+	}
+	if got := pearson([]int{1, 2, 3}, []int{3, 2, 1}); math.Abs(got+1) > 1e-9 {
+		t.Errorf("expected -1, got %v", got)
+	}
+	if got := pearson([]int{1, 1, 1}, []int{1, 2, 3}); got != 0 {
+		t.Errorf("expected 0 for a constant series, got %v", got)
+	}
+}
+
+func TestPatternsHandler(t *testing.T) {
+	big := savedGame("g4", "2024-01-04T00:00:00Z", "Alice", "Bob", "Alice", "row1")
+	big["size"] = &types.AttributeValueMemberN{Value: "4"}
+	useMemoryStore(t,
+		savedGame("g1", "2024-01-01T00:00:00Z", "Alice", "Bob", "Alice", "row1"),
+		savedGame("g2", "2024-01-02T00:00:00Z", "Alice", "Bob", "Bob", "row1"),
+		savedGame("g3", "2024-01-03T00:00:00Z", "Alice", "Bob", "Alice", "diag2"),
+		savedGame("g5", "2024-01-05T00:00:00Z", "Alice", "Bob", "", ""),
+		big,
+	)
+
+	w := httptest.NewRecorder()
+	patternsHandler(w, httptest.NewRequest(http.MethodGet, "/api/patterns", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var counts map[string]int
+	if err := json.Unmarshal(w.Body.Bytes(), &counts); err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 8 || counts["row1"] != 2 || counts["diag2"] != 1 || counts["col1"] != 0 {
+		t.Errorf("unexpected pattern counts %v", counts)
+	}
+}
+
+func TestPlayerPatternsHandler(t *testing.T) {
+	useMemoryStore(t,
+		savedGame("g1", "2024-01-01T00:00:00Z", "Alice", "Bob", "Alice", "row1"),
+		savedGame("g2", "2024-01-02T00:00:00Z", "Bob", "Alice", "Alice", "row1"),
+		savedGame("g3", "2024-01-03T00:00:00Z", "Alice", "Carol", "Alice", "diag1"),
+		savedGame("g4", "2024-01-04T00:00:00Z", "Alice", "Carol", "Carol", "col2"),
+		savedGame("g5", "2024-01-05T00:00:00Z", "Alice", "Bob", "", ""),
+		savedGame("g6", "2024-01-06T00:00:00Z", "Alice", "Bob", "Alice", "resignation"),
+	)
+
+	w := httptest.NewRecorder()
+	playerPatternsHandler(w, httptest.NewRequest(http.MethodGet, "/api/player/patterns?player=Alice", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp PlayerPatterns
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Patterns) != 2 || resp.Patterns["row1"] != 2 || resp.Patterns["diag1"] != 1 {
+		t.Errorf("unexpected patterns %v", resp.Patterns)
+	}
+	if resp.Favorite != "row1" || resp.LeastUsed != "diag1" {
+		t.Errorf("expected favorite row1 and least used diag1, got %q and %q", resp.Favorite, resp.LeastUsed)
+	}
+
+	w = httptest.NewRecorder()
+	playerPatternsHandler(w, httptest.NewRequest(http.MethodGet, "/api/player/patterns", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without player, got %d", w.Code)
+	}
+}
+
+func TestPlayerStreaksHandler(t *testing.T) {
+	useMemoryStore(t,
+		savedGame("g3", "2024-01-03T00:00:00Z", "Alice", "Bob", "Alice", "row1"),
+		savedGame("g1", "2024-01-01T00:00:00Z", "Alice", "Bob", "Alice", "row1"),
+		savedGame("g2", "2024-01-02T00:00:00Z", "Carol", "Alice", "Alice", "col1"),
+		savedGame("g4", "2024-01-04T00:00:00Z", "Alice", "Bob", "", ""),
+		savedGame("g5", "2024-01-05T00:00:00Z", "Alice", "Carol", "Alice", "diag1"),
+		savedGame("g6", "2024-01-06T00:00:00Z", "Bob", "Carol", "Bob", "row2"),
+	)
+
+	w := httptest.NewRecorder()
+	playerStreaksHandler(w, httptest.NewRequest(http.MethodGet, "/api/player/streaks?player=Alice", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp PlayerStreaks
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.CurrentStreak != 1 || resp.LongestStreak != 3 || resp.LastResult != "win" {
+		t.Errorf("expected current 1, longest 3 after a win, got %+v", resp)
+	}
+
+	w = httptest.NewRecorder()
+	playerStreaksHandler(w, httptest.NewRequest(http.MethodGet, "/api/player/streaks", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a player, got %d", w.Code)
+	}
+}
+
+func TestPatternExtremes(t *testing.T) {
+	favorite, least := patternExtremes(map[string]int{"col2": 3, "row1": 3, "diag1": 1, "diag2": 1})
+	if favorite != "col2" || least != "diag1" {
+		t.Errorf("expected col2 and diag1, got %q and %q", favorite, least)
+	}
+	if favorite, least := patternExtremes(nil); favorite != "" || least != "" {
+		t.Errorf("expected no patterns, got %q and %q", favorite, least)
+	}
+}
+
+func TestLeaderboardHandler_Mode(t *testing.T) {
+	local := savedGame("g2", "2024-01-02T00:00:00Z", "Kiosk1", "Kiosk2", "Kiosk1", "row1")
+	local["mode"] = &types.AttributeValueMemberS{Value: "local"}
+	ai := savedGame("g3", "2024-01-03T00:00:00Z", "Kiosk1", "AI", "AI", "row1")
+	ai["mode"] = &types.AttributeValueMemberS{Value: "ai"}
+	useMemoryStore(t, savedGame("g1", "2024-01-01T00:00:00Z", "Alice", "Bob", "Alice", "row1"), local, ai)
+
+	players := func(resp LeaderboardResponse) []string {
+		var names []string
+		for _, p := range resp.Players {
+			names = append(names, p.Player)
+		}
+		sort.Strings(names)
+		return names
+	}
+	for _, tt := range []struct {
+		query string
+		want  string
+	}{
+		{"", "Alice,Bob"},
+		{"?mode=online", "Alice,Bob"},
+		{"?mode=local", "Kiosk1,Kiosk2"},
+		{"?mode=all", "Alice,Bob,Kiosk1,Kiosk2"},
+	} {
+		resp := getLeaderboard(t, tt.query)
+		if got := strings.Join(players(resp), ","); got != tt.want {
+			t.Errorf("%q: expected players %s, got %s", tt.query, tt.want, got)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	leaderboardHandler(w, httptest.NewRequest(http.MethodGet, "/api/leaderboard?mode=ai", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for mode=ai, got %d", w.Code)
+	}
+}
+
+func TestStatsHandler_FirstMoverWinRate(t *testing.T) {
+	oFirst := savedGame("g1", "2024-01-01T00:00:00Z", "Alice", "Bob", "Bob", "row1")
+	oFirst["firstPlayer"] = &types.AttributeValueMemberS{Value: "O"}
+	xFirst := savedGame("g2", "2024-01-02T00:00:00Z", "Alice", "Bob", "Bob", "row1")
+	xFirst["firstPlayer"] = &types.AttributeValueMemberS{Value: "X"}
+	// Saved before firstPlayer was stored; the first move tells who started
+	legacy := savedGame("g3", "2024-01-03T00:00:00Z", "Alice", "Bob", "Bob", "diag1")
+	legacy["moves"] = &types.AttributeValueMemberL{Value: movesToAttr([]Move{{Index: 4, Player: "O"}, {Index: 0, Player: "X"}})}
+	useMemoryStore(t, oFirst, xFirst, legacy)
+
+	w := httptest.NewRecorder()
+	statsHandler(w, httptest.NewRequest(http.MethodGet, "/api/stats", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp StatsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.OWinRate != 100 {
+		t.Errorf("expected O to win every game, got %v", resp.OWinRate)
+	}
+	if resp.FirstMoverWinRate < 66.6 || resp.FirstMoverWinRate > 66.7 || resp.SecondMoverWinRate < 33.3 || resp.SecondMoverWinRate > 33.4 {
+		t.Errorf("expected first/second mover rates ~66.7/33.3, got %v/%v", resp.FirstMoverWinRate, resp.SecondMoverWinRate)
+	}
+	if resp.FirstMoverWinRateByPattern["row1"] != 50 || resp.FirstMoverWinRateByPattern["diag1"] != 100 {
+		t.Errorf("unexpected per-pattern rates %v", resp.FirstMoverWinRateByPattern)
+	}
+}
+
+func TestPatternAggregates_SkipEndReasons(t *testing.T) {
+	useMemoryStore(t,
+		savedGame("g1", "2024-01-01T00:00:00Z", "Alice", "Bob", "Alice", "diag1"),
+		savedGame("g2", "2024-01-02T00:00:00Z", "Alice", "Bob", "Alice", "timeout"),
+		savedGame("g3", "2024-01-03T00:00:00Z", "Alice", "Bob", "Alice", "resignation"),
+		savedGame("g4", "2024-01-04T00:00:00Z", "Alice", "Bob", "Alice", "timeout"),
+	)
+
+	w := httptest.NewRecorder()
+	statsHandler(w, httptest.NewRequest(http.MethodGet, "/api/stats", nil))
+	var resp StatsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.TopPatterns) != 1 || resp.TopPatterns["diag1"] != 1 {
+		t.Errorf("expected only diag1 in top patterns, got %v", resp.TopPatterns)
+	}
+	if _, ok := resp.FirstMoverWinRateByPattern["timeout"]; ok || len(resp.FirstMoverWinRateByPattern) > 1 {
+		t.Errorf("expected no end reasons in per-pattern rates, got %v", resp.FirstMoverWinRateByPattern)
+	}
+	for _, p := range getLeaderboard(t, "").Players {
+		if p.Player == "Alice" && p.BestPattern != "diag1" {
+			t.Errorf("expected Alice's best pattern to be diag1, got %q", p.BestPattern)
+		}
+	}
+}
+
+func TestFirstPlayerSavedAndExposed(t *testing.T) {
+	useMemoryStore(t)
+	saveOnlineGameToDynamoDB(&OnlineGame{
+		ID: "g1", Player1: "Alice", Player2: "Bob", FirstPlayer: "O", Size: 3,
+		Status: "finished", Winner: "Bob", Pattern: "row1",
+		Moves: []Move{{Index: 0, Player: "O"}},
+	})
+
+	w := httptest.NewRecorder()
+	gameReplayHandler(w, httptest.NewRequest(http.MethodGet, "/api/replay?id=g1", nil))
+	var replay GameReplay
+	if err := json.Unmarshal(w.Body.Bytes(), &replay); err != nil {
+		t.Fatalf("decoding replay %q: %v", w.Body.String(), err)
+	}
+	if replay.FirstPlayer != "O" {
+		t.Errorf("expected replay firstPlayer O, got %q", replay.FirstPlayer)
+	}
+
+	w = httptest.NewRecorder()
+	recentGamesHandler(w, httptest.NewRequest(http.MethodGet, "/api/recent", nil))
+	var recent []RecentGame
+	if err := json.Unmarshal(w.Body.Bytes(), &recent); err != nil {
+		t.Fatalf("decoding recent games %q: %v", w.Body.String(), err)
+	}
+	if len(recent) != 1 || recent[0].FirstPlayer != "O" {
+		t.Errorf("expected one recent game started by O, got %+v", recent)
+	}
+}
+
+func TestRecentGames_MoveCount(t *testing.T) {
+	legacy := savedGame("g1", "2024-01-01T00:00:00Z", "Alice", "Bob", "Alice", "row1")
+	legacy["moves"] = &types.AttributeValueMemberL{Value: movesToAttr([]Move{{0, "X", 0}, {3, "O", 1}, {1, "X", 2}})}
+	useMemoryStore(t, legacy)
+	saveOnlineGameToDynamoDB(&OnlineGame{
+		ID: "g2", Player1: "Alice", Player2: "Bob", Size: 3, Status: "finished", Winner: "Alice", Pattern: "row1",
+		Moves: []Move{{0, "X", 0}, {3, "O", 1}, {1, "X", 2}, {4, "O", 3}, {2, "X", 4}},
+	})
+
+	for name, handler := range map[string]http.HandlerFunc{"/api/recent": recentGamesHandler, "/api/player/games?player=Alice": playerGamesHandler} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, name, nil))
+		var games []RecentGame
+		if err := json.Unmarshal(w.Body.Bytes(), &games); err != nil {
+			t.Fatalf("%s: decoding %q: %v", name, w.Body.String(), err)
+		}
+		counts := make(map[string]int)
+		for _, g := range games {
+			counts[g.GameID] = g.MoveCount
+		}
+		if counts["g1"] != 3 || counts["g2"] != 5 {
+			t.Errorf("%s: expected move counts 3 and 5, got %v", name, counts)
+		}
+	}
+}
+
+func TestSaveOnlineGame_InvalidMoveSequence(t *testing.T) {
+	fake := useMemoryStore(t)
+	before := testutil.ToFloat64(invalidMoveSequences)
+	saveOnlineGameToDynamoDB(&OnlineGame{
+		ID: "ok", Player1: "Alice", Player2: "Bob", Size: 4, Status: "finished",
+		Moves: []Move{{Index: 15, Player: "X"}, {Index: 0, Player: "O", Time: 400}},
+	})
+	if got := testutil.ToFloat64(invalidMoveSequences) - before; got != 0 {
+		t.Fatalf("expected a legal 4x4 sequence to pass, got %v violations", got)
+	}
+	saveOnlineGameToDynamoDB(&OnlineGame{
+		ID: "bad", Player1: "Alice", Player2: "Bob", Size: 3, Status: "finished",
+		Moves: []Move{{Index: 4, Player: "X"}, {Index: 4, Player: "O", Time: 400}},
+	})
+	if got := testutil.ToFloat64(invalidMoveSequences) - before; got != 1 {
+		t.Errorf("expected one violation, got %v", got)
+	}
+	if len(fake.items) != 2 {
+		t.Errorf("expected both games saved, got %d", len(fake.items))
+	}
+}
+
+func TestSaveOnlineGame_TruncatesRunawayMoves(t *testing.T) {
+	fake := useMemoryStore(t)
+	before := testutil.ToFloat64(movesTruncated)
+	moves := make([]Move, 50)
+	for i := range moves {
+		moves[i] = Move{Index: i % 9, Player: []string{"X", "O"}[i%2], Time: int64(i * 100)}
+	}
+	saveOnlineGameToDynamoDB(&OnlineGame{ID: "runaway", Player1: "Alice", Player2: "Bob", Size: 3, Status: "finished", Moves: moves})
+
+	if got := testutil.ToFloat64(movesTruncated) - before; got != 1 {
+		t.Errorf("expected one truncation, got %v", got)
+	}
+	if n := len(getMovesAttr(fake.items[0], "moves")); n != 9 {
+		t.Errorf("expected 9 saved moves, got %d", n)
+	}
+	if d := getIntAttr(fake.items[0], "duration"); d != 800 {
+		t.Errorf("expected duration of the last saved move (800), got %d", d)
+	}
+}
+
+func TestPasswordGame(t *testing.T) {
+	w := httptest.NewRecorder()
+	createGameHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/create", strings.NewReader(`{"player1":"Alice","password":"hunter2"}`)))
+	var created map[string]string
+	json.NewDecoder(w.Body).Decode(&created)
+	if created["token"] == "" {
+		t.Fatalf("expected a WebSocket token for the creator, got %v", created)
+	}
+	id := created["gameId"]
+
+	join := func(password string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"gameId": id, "player2": "Bob", "password": password})
+		w := httptest.NewRecorder()
+		joinGameHandler(w, httptest.NewRequest(http.MethodPost, "/api/game/join", bytes.NewReader(body)))
+		return w
+	}
+	if w := join("wrong"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a wrong password, got %d", w.Code)
+	}
+	w = join("hunter2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 with the right password, got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "$2a$") {
+		t.Error("expected the password hash not to be returned")
+	}
+	var state map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&state)
+	bobToken, _ := state["token"].(string)
+	if bobToken == "" {
+		t.Fatal("expected a WebSocket token for the joining player")
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer srv.Close()
+	dial := func(query string) (*websocket.Conn, int) {
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?id="+id+"&"+query, nil)
+		if err != nil {
+			return nil, resp.StatusCode
+		}
+		return conn, http.StatusSwitchingProtocols
+	}
+	if _, code := dial("player=Bob"); code != http.StatusForbidden {
+		t.Errorf("expected 403 without a token, got %d", code)
+	}
+	conn, code := dial("token=" + bobToken)
+	if code != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the token to be accepted, got %d", code)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msg WSMessage
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "game_state" {
+		t.Fatalf("expected game_state, got %q (%v)", msg.Type, err)
+	}
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "reconnect_token" {
+		t.Fatalf("expected reconnect_token, got %q (%v)", msg.Type, err)
+	}
+	if _, code := dial("token=" + bobToken); code != http.StatusForbidden {
+		t.Errorf("expected a used token to be rejected, got %d", code)
+	}
+
+	// Bob's connection can't move for Alice, even on her turn
+	game, _ := lookupGame(id)
+	game.mu.Lock()
+	game.Turn = "X"
+	game.mu.Unlock()
+	dropped := wsMessagesTotal.WithLabelValues("move", "dropped")
+	before := testutil.ToFloat64(dropped)
+	conn.WriteJSON(WSMessage{Type: "move", Payload: map[string]interface{}{"index": 0, "player": "Alice"}})
+	deadline := time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(dropped) == before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	game.mu.Lock()
+	defer game.mu.Unlock()
+	if testutil.ToFloat64(dropped) != before+1 || game.Board[0] != "" {
+		t.Errorf("expected the move for Alice to be dropped, board %v", game.Board)
+	}
+}
+
+func TestWSHandler_DeltaSubscription(t *testing.T) {
+	game := &OnlineGame{ID: "delta1", Size: 3, Board: make([]string, 9), Turn: "X", Player1: "Alice", Player2: "Bob", Status: "playing"}
+	gamesMu.Lock()
+	games[game.ID] = game
+	gamesMu.Unlock()
+	defer func() {
+		gamesMu.Lock()
+		delete(games, game.ID)
+		gamesMu.Unlock()
+	}()
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer srv.Close()
+	dial := func(query string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?id=delta1&"+query, nil)
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var msg WSMessage
+		if err := conn.ReadJSON(&msg); err != nil || msg.Type != "game_state" {
+			t.Fatalf("expected initial game_state, got %q (%v)", msg.Type, err)
+		}
+		return conn
+	}
+
+	full := dial("spectator=true")
+	defer full.Close()
+	delta := dial("spectator=true")
+	defer delta.Close()
+	delta.WriteJSON(WSMessage{Type: "subscribe", Payload: map[string]string{"mode": "delta"}})
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		game.mu.Lock()
+		subscribed := len(game.deltaConns) == 1
+		game.mu.Unlock()
+		if subscribed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("subscribe was not processed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	game.handleMessage(WSMessage{Type: "move", Payload: map[string]interface{}{"index": float64(4), "player": "Alice"}})
+
+	var msg struct {
+		Type    string                 `json:"type"`
+		Payload map[string]interface{} `json:"payload"`
+	}
+	if err := full.ReadJSON(&msg); err != nil || msg.Type != "game_state" || msg.Payload["version"] != float64(1) {
+		t.Errorf("expected full game_state at version 1, got %+v (%v)", msg, err)
+	}
+	msg.Payload = nil
+	if err := delta.ReadJSON(&msg); err != nil || msg.Type != "move_delta" {
+		t.Fatalf("expected move_delta, got %+v (%v)", msg, err)
+	}
+	want := map[string]interface{}{"version": float64(1), "index": float64(4), "mark": "X", "turn": "O", "status": "playing"}
+	for k, v := range want {
+		if msg.Payload[k] != v {
+			t.Errorf("move_delta %s: expected %v, got %v", k, v, msg.Payload[k])
+		}
+	}
+	if len(msg.Payload) != len(want) {
+		t.Errorf("expected only %d fields in move_delta, got %v", len(want), msg.Payload)
+	}
+
+	// A spectator joining late can ask for the moves so far
+	full.WriteJSON(WSMessage{Type: "get_moves"})
+	msg.Payload = nil
+	if err := full.ReadJSON(&msg); err != nil || msg.Type != "moves_history" {
+		t.Fatalf("expected moves_history, got %+v (%v)", msg, err)
+	}
+	if moves, _ := msg.Payload["moves"].([]interface{}); len(moves) != 1 {
+		t.Errorf("expected 1 move in history, got %v", msg.Payload["moves"])
+	}
+}
+
+func TestToJSON_IsTie(t *testing.T) {
+	cases := []struct {
+		status, winner string
+		want           bool
+	}{
+		{"finished", "", true},
+		{"finished", "Alice", false},
+		{"playing", "", false},
+		{"interrupted", "", false},
+	}
+	for _, c := range cases {
+		g := &OnlineGame{Status: c.status, Winner: c.winner}
+		if got := g.toJSON()["isTie"]; got != c.want {
+			t.Errorf("status %q winner %q: isTie = %v, want %v", c.status, c.winner, got, c.want)
+		}
+	}
+}
+
+func TestValidateMove(t *testing.T) {
+	board := []string{"X", "", "", "", "", "", "", "", ""}
+	tests := []struct {
+		name         string
+		status, turn string
+		player       string
+		idx          int
+		want         error
+	}{
+		{"valid", "playing", "O", "Bob", 4, nil},
+		{"game over", "finished", "O", "Bob", 4, ErrGameNotPlaying},
+		{"waiting", "waiting", "X", "Alice", 4, ErrGameNotPlaying},
+		{"wrong turn", "playing", "O", "Alice", 4, ErrWrongTurn},
+		{"stranger", "playing", "O", "Mallory", 4, ErrWrongTurn},
+		{"negative index", "playing", "O", "Bob", -1, ErrOutOfRange},
+		{"past the board", "playing", "O", "Bob", 9, ErrOutOfRange},
+		{"occupied", "playing", "O", "Bob", 0, ErrCellOccupied},
+	}
+	for _, tt := range tests {
+		if err := validateMove(board, tt.status, tt.turn, tt.player, "Alice", "Bob", tt.idx); err != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, err)
+		}
+		if tt.want != nil && moveRejectReasons[tt.want] == "" {
+			t.Errorf("%s: no rejection reason for %v", tt.name, tt.want)
+		}
+	}
+}
@@ -8,8 +8,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -23,6 +25,10 @@ var (
 		prometheus.GaugeOpts{Name: "synthetic_test_duration_seconds", Help: "Synthetic test duration in seconds"},
 		[]string{"test", "environment"},
 	)
+	gamesCleanedUp = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "synthetic_games_cleaned_up_total", Help: "Synthetic online games resigned or cancelled after a run"},
+		[]string{"environment"},
+	)
 	testTimestamp = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{Name: "synthetic_test_timestamp", Help: "Synthetic test last run timestamp"},
 		[]string{"environment"},
@@ -30,7 +36,7 @@ var (
 )
 
 func init() {
-	prometheus.MustRegister(testResult, testDuration, testTimestamp)
+	prometheus.MustRegister(testResult, testDuration, testTimestamp, gamesCleanedUp)
 }
 
 type GameResult struct {
@@ -40,6 +46,28 @@ type GameResult struct {
 	Pattern string `json:"pattern"`
 	IsTie   bool   `json:"isTie"`
 	Mode    string `json:"mode"`
+	// Synthetic keeps the game out of the backend's read endpoints
+	Synthetic bool `json:"synthetic"`
+}
+
+// client is used for every request so a hung backend fails the test after
+// REQUEST_TIMEOUT instead of blocking the run.
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// createdGame is an online game a test created and testCleanup must leave.
+type createdGame struct {
+	ID     string
+	Player string
+	Key    string // the player's seat key from create, needed to leave
+}
+
+// createdGames collects the games created during the current run.
+var createdGames []createdGame
+
+func trackGame(id, player, key string) {
+	if id != "" {
+		createdGames = append(createdGames, createdGame{ID: id, Player: player, Key: key})
+	}
 }
 
 func runTest(name string, env string, testFunc func() error) {
@@ -57,7 +85,7 @@ func runTest(name string, env string, testFunc func() error) {
 }
 
 func testFrontendHealth(url string) error {
-	resp, err := http.Get(url + "/healthz")
+	resp, err := client.Get(url + "/healthz")
 	if err != nil {
 		return fmt.Errorf("request failed: %w", err)
 	}
@@ -69,7 +97,7 @@ func testFrontendHealth(url string) error {
 }
 
 func testBackendHealth(url string) error {
-	resp, err := http.Get(url + "/api/game")
+	resp, err := client.Get(url + "/api/game")
 	if err != nil {
 		return fmt.Errorf("request failed: %w", err)
 	}
@@ -81,9 +109,9 @@ func testBackendHealth(url string) error {
 }
 
 func testLocalGameRecording(url string) error {
-	game := GameResult{Player1: "SyntheticA", Player2: "SyntheticB", Winner: "SyntheticA", Pattern: "row1", Mode: "local"}
+	game := GameResult{Player1: "SyntheticA", Player2: "SyntheticB", Winner: "SyntheticA", Pattern: "row1", Mode: "local", Synthetic: true}
 	body, _ := json.Marshal(game)
-	resp, err := http.Post(url+"/api/game", "application/json", bytes.NewReader(body))
+	resp, err := client.Post(url+"/api/game", "application/json", bytes.NewReader(body))
 	if err != nil {
 		return fmt.Errorf("request failed: %w", err)
 	}
@@ -96,8 +124,8 @@ func testLocalGameRecording(url string) error {
 }
 
 func testOnlineGameCreate(url string) error {
-	body, _ := json.Marshal(map[string]string{"player1": "SyntheticOnline"})
-	resp, err := http.Post(url+"/api/game/create", "application/json", bytes.NewReader(body))
+	body, _ := json.Marshal(map[string]interface{}{"player1": "SyntheticOnline", "synthetic": true})
+	resp, err := client.Post(url+"/api/game/create", "application/json", bytes.NewReader(body))
 	if err != nil {
 		return fmt.Errorf("request failed: %w", err)
 	}
@@ -112,13 +140,14 @@ func testOnlineGameCreate(url string) error {
 	if result["gameId"] == "" {
 		return fmt.Errorf("no gameId returned")
 	}
+	trackGame(result["gameId"], "SyntheticOnline", result["playerKey"])
 	return nil
 }
 
 func testOnlineGameFlow(url string) error {
 	// Create game
-	body, _ := json.Marshal(map[string]string{"player1": "SyntheticP1"})
-	resp, err := http.Post(url+"/api/game/create", "application/json", bytes.NewReader(body))
+	body, _ := json.Marshal(map[string]interface{}{"player1": "SyntheticP1", "synthetic": true})
+	resp, err := client.Post(url+"/api/game/create", "application/json", bytes.NewReader(body))
 	if err != nil {
 		return fmt.Errorf("create failed: %w", err)
 	}
@@ -126,10 +155,11 @@ func testOnlineGameFlow(url string) error {
 	var createRes map[string]string
 	json.NewDecoder(resp.Body).Decode(&createRes)
 	gameId := createRes["gameId"]
+	trackGame(gameId, "SyntheticP1", createRes["playerKey"])
 	
 	// Join game
 	joinBody, _ := json.Marshal(map[string]string{"gameId": gameId, "player2": "SyntheticP2"})
-	resp2, err := http.Post(url+"/api/game/join", "application/json", bytes.NewReader(joinBody))
+	resp2, err := client.Post(url+"/api/game/join", "application/json", bytes.NewReader(joinBody))
 	if err != nil {
 		return fmt.Errorf("join failed: %w", err)
 	}
@@ -139,7 +169,7 @@ func testOnlineGameFlow(url string) error {
 	}
 	
 	// Get game state
-	resp3, err := http.Get(url + "/api/game/get?id=" + gameId)
+	resp3, err := client.Get(url + "/api/game/get?id=" + gameId)
 	if err != nil {
 		return fmt.Errorf("get failed: %w", err)
 	}
@@ -150,8 +180,99 @@ func testOnlineGameFlow(url string) error {
 	return nil
 }
 
-func testLeaderboardAPI(url string) error {
-	resp, err := http.Get(url + "/api/leaderboard")
+type wsMessage struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type gameState struct {
+	Board  []string `json:"board"`
+	Turn   string   `json:"turn"`
+	Status string   `json:"status"`
+}
+
+func testOnlineGameMove(url string) error {
+	// Create and join a game so both players can connect
+	body, _ := json.Marshal(map[string]interface{}{"player1": "SyntheticMoveP1", "synthetic": true})
+	resp, err := client.Post(url+"/api/game/create", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create failed: %w", err)
+	}
+	defer resp.Body.Close()
+	var createRes map[string]string
+	json.NewDecoder(resp.Body).Decode(&createRes)
+	gameId := createRes["gameId"]
+	if gameId == "" {
+		return fmt.Errorf("no gameId returned")
+	}
+	trackGame(gameId, "SyntheticMoveP1", createRes["playerKey"])
+	joinBody, _ := json.Marshal(map[string]string{"gameId": gameId, "player2": "SyntheticMoveP2"})
+	resp2, err := client.Post(url+"/api/game/join", "application/json", bytes.NewReader(joinBody))
+	if err != nil {
+		return fmt.Errorf("join failed: %w", err)
+	}
+	defer resp2.Body.Close()
+	if resp2.StatusCode != http.StatusOK {
+		return fmt.Errorf("join status: %d", resp2.StatusCode)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(url, "http") + "/api/game/ws?id=" + gameId
+	conns := make([]*websocket.Conn, 2)
+	for i := range conns {
+		dialer := websocket.Dialer{Proxy: http.ProxyFromEnvironment, HandshakeTimeout: client.Timeout}
+		conn, _, err := dialer.Dial(wsURL, nil)
+		if err != nil {
+			return fmt.Errorf("websocket dial failed: %w", err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(client.Timeout))
+		var msg wsMessage
+		if err := conn.ReadJSON(&msg); err != nil || msg.Type != "game_state" {
+			return fmt.Errorf("expected initial game_state, got %q (%v)", msg.Type, err)
+		}
+		conns[i] = conn
+	}
+
+	// X is always player1; the coin flip only decides who moves first
+	mover := "SyntheticMoveP1"
+	if createRes["firstPlayer"] == "O" {
+		mover = "SyntheticMoveP2"
+	}
+	move := map[string]interface{}{"type": "move", "payload": map[string]interface{}{"index": 4, "player": mover}}
+	if err := conns[0].WriteJSON(move); err != nil {
+		return fmt.Errorf("send move failed: %w", err)
+	}
+	for _, conn := range conns {
+		var msg wsMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return fmt.Errorf("no broadcast after move: %w", err)
+		}
+		var state gameState
+		if msg.Type != "game_state" || json.Unmarshal(msg.Payload, &state) != nil {
+			return fmt.Errorf("expected game_state broadcast, got %q", msg.Type)
+		}
+		if len(state.Board) < 5 || state.Board[4] == "" {
+			return fmt.Errorf("board not updated after move: %v", state.Board)
+		}
+	}
+	return nil
+}
+
+type leaderboardResponse struct {
+	Players []struct {
+		Player     string `json:"player"`
+		TotalGames int    `json:"totalGames"`
+	} `json:"players"`
+	Total int `json:"total"`
+}
+
+type statsResponse struct {
+	TotalGames  int            `json:"totalGames"`
+	TopPatterns map[string]int `json:"topPatterns"`
+}
+
+func testLeaderboard(url string) error {
+	resp, err := client.Get(url + "/api/leaderboard")
 	if err != nil {
 		return fmt.Errorf("leaderboard request failed: %w", err)
 	}
@@ -159,11 +280,23 @@ func testLeaderboardAPI(url string) error {
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("leaderboard status: %d", resp.StatusCode)
 	}
+	var leaderboard leaderboardResponse
+	if err := json.NewDecoder(resp.Body).Decode(&leaderboard); err != nil {
+		return fmt.Errorf("failed to decode leaderboard: %w", err)
+	}
+	if leaderboard.Total < 0 {
+		return fmt.Errorf("negative total: %d", leaderboard.Total)
+	}
+	for _, p := range leaderboard.Players {
+		if p.TotalGames < 0 {
+			return fmt.Errorf("negative totalGames for %s: %d", p.Player, p.TotalGames)
+		}
+	}
 	return nil
 }
 
-func testStatsAPI(url string) error {
-	resp, err := http.Get(url + "/api/stats")
+func testStats(url string) error {
+	resp, err := client.Get(url + "/api/stats")
 	if err != nil {
 		return fmt.Errorf("stats request failed: %w", err)
 	}
@@ -171,6 +304,75 @@ func testStatsAPI(url string) error {
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("stats status: %d", resp.StatusCode)
 	}
+	var stats statsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return fmt.Errorf("failed to decode stats: %w", err)
+	}
+	if stats.TotalGames < 0 {
+		return fmt.Errorf("negative totalGames: %d", stats.TotalGames)
+	}
+	return nil
+}
+
+// expectedMetrics are backend series that exist from startup; labelled
+// series such as tictactoe_games_total only appear once a game is recorded
+// on that replica, so they can't be relied on here.
+var expectedMetrics = []string{
+	"tictactoe_online_games_active",
+	"tictactoe_online_games_created_total",
+	"tictactoe_websocket_connections_active",
+}
+
+// testMetricsEndpoint checks the backend's /metrics scrapes cleanly, so a
+// broken registration shows up here and not only as a down target.
+func testMetricsEndpoint(url string) error {
+	resp, err := client.Get(url + "/metrics")
+	if err != nil {
+		return fmt.Errorf("metrics request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("metrics status: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read metrics: %w", err)
+	}
+	var missing []string
+	for _, name := range expectedMetrics {
+		if !strings.Contains(string(body), "\n"+name+" ") {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing series: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// testCleanup leaves every game created during the run: waiting games are
+// cancelled and games in progress resigned, so none linger on the backend.
+func testCleanup(url, env string) error {
+	defer func() { createdGames = nil }()
+	var failed []string
+	for _, g := range createdGames {
+		body, _ := json.Marshal(map[string]string{"gameId": g.ID, "player": g.Player, "playerKey": g.Key})
+		resp, err := client.Post(url+"/api/game/leave", "application/json", bytes.NewReader(body))
+		if err != nil {
+			failed = append(failed, g.ID)
+			continue
+		}
+		resp.Body.Close()
+		// 404 means the game is already gone, which is what we want
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+			failed = append(failed, fmt.Sprintf("%s (%d)", g.ID, resp.StatusCode))
+			continue
+		}
+		gamesCleanedUp.WithLabelValues(env).Inc()
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to leave games: %s", strings.Join(failed, ", "))
+	}
 	return nil
 }
 
@@ -181,8 +383,11 @@ func runAllTests(frontendURL, backendURL, env string) {
 	runTest("local_game_recording", env, func() error { return testLocalGameRecording(backendURL) })
 	runTest("online_game_create", env, func() error { return testOnlineGameCreate(backendURL) })
 	runTest("online_game_flow", env, func() error { return testOnlineGameFlow(backendURL) })
-	runTest("leaderboard_api", env, func() error { return testLeaderboardAPI(backendURL) })
-	runTest("stats_api", env, func() error { return testStatsAPI(backendURL) })
+	runTest("online_game_move", env, func() error { return testOnlineGameMove(backendURL) })
+	runTest("leaderboard_api", env, func() error { return testLeaderboard(backendURL) })
+	runTest("stats_api", env, func() error { return testStats(backendURL) })
+	runTest("metrics_endpoint", env, func() error { return testMetricsEndpoint(backendURL) })
+	runTest("cleanup", env, func() error { return testCleanup(backendURL, env) })
 	testTimestamp.WithLabelValues(env).Set(float64(time.Now().Unix()))
 	log.Printf("Synthetic tests completed")
 }
@@ -198,6 +403,9 @@ func main() {
 	if frontendURL == "" || backendURL == "" || env == "" {
 		log.Fatal("FRONTEND_URL, BACKEND_URL and ENVIRONMENT must be set")
 	}
+	if d, err := time.ParseDuration(os.Getenv("REQUEST_TIMEOUT")); err == nil && d > 0 {
+		client.Timeout = d
+	}
 	testInterval, _ := time.ParseDuration(interval)
 	if testInterval == 0 {
 		testInterval = 60 * time.Second